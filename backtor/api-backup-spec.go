@@ -6,9 +6,11 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/robfig/cron"
 	"github.com/sirupsen/logrus"
 )
 
@@ -16,7 +18,7 @@ func (h *HTTPServer) setupBackupSpecHandlers() {
 	h.router.GET("/backup", ListBackupSpecs())
 	h.router.POST("/backup", CreateBackupSpec())
 	h.router.PUT("/backup/:name", UpdateBackupSpec())
-	// h.router.DELETE("/backup/:name", DeleteBackupSpec())
+	h.router.DELETE("/backup/:name", DeleteBackupSpec())
 }
 
 //ListBackupSpecs list
@@ -34,13 +36,16 @@ func ListBackupSpecs() func(*gin.Context) {
 			}
 			enabled = &en
 		}
-		backups, err := listBackupSpecs(enabled)
+		backups, err := store.ListBackupSpecs(enabled)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"message": fmt.Sprintf("Error getting backup specs. err=%s", err)})
 			apiInvocationsCounter.WithLabelValues("backup-spec", "error").Inc()
 			return
 		}
 
+		for i := range backups {
+			localizeBackupSpec(&backups[i])
+		}
 		apiInvocationsCounter.WithLabelValues("backup-spec", "success").Inc()
 		c.JSON(http.StatusOK, backups)
 	}
@@ -59,15 +64,19 @@ func CreateBackupSpec() func(*gin.Context) {
 			return
 		}
 
-		if bs.Name == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("'name' is required")})
+		bs.Purging = 0
+		bs.ManagedBy = ""
+		bs.LastScheduledTime = nil
+		bs.CatchupPending = 0
+		setBackupSpecDefaultValues(&bs)
+		errs := validateBackupSpec(bs)
+		if len(errs) > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid backup spec", "errors": errs})
 			return
 		}
-
-		setBackupSpecDefaultValues(&bs)
 		bs.LastUpdate = time.Now()
 
-		err = createBackupSpec(bs)
+		err = store.CreateBackupSpec(bs)
 		if err != nil {
 			apiInvocationsCounter.WithLabelValues("backup-spec", "error").Inc()
 			c.JSON(http.StatusInternalServerError, gin.H{"message": fmt.Sprintf("Error creating backup spec. err=%s", err)})
@@ -103,10 +112,28 @@ func UpdateBackupSpec() func(*gin.Context) {
 		}
 		bs.Name = name
 
+		current, err := store.GetBackupSpec(name)
+		if err == nil && current.Purging == 1 {
+			c.JSON(http.StatusConflict, gin.H{"message": fmt.Sprintf("Backup spec %s is being purged and cannot be updated", name)})
+			return
+		}
+		if err == nil && checkManagedBy(current) != nil {
+			c.JSON(http.StatusConflict, gin.H{"message": checkManagedBy(current).Error()})
+			return
+		}
+		bs.Purging = 0
+		bs.ManagedBy = ""
+		bs.LastScheduledTime = nil
+		bs.CatchupPending = 0
 		setBackupSpecDefaultValues(&bs)
+		errs := validateBackupSpec(bs)
+		if len(errs) > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid backup spec", "errors": errs})
+			return
+		}
 		bs.LastUpdate = time.Now()
 
-		err = updateBackupSpec(bs)
+		err = store.UpdateBackupSpec(bs)
 		if err != nil {
 			apiInvocationsCounter.WithLabelValues("backup-spec", "error").Inc()
 			c.JSON(http.StatusInternalServerError, gin.H{"message": fmt.Sprintf("Error updating backup spec. err=%s", err)})
@@ -126,22 +153,126 @@ func UpdateBackupSpec() func(*gin.Context) {
 	}
 }
 
-//DeleteBackupSpec get currently tracked backups
-// func DeleteBackupSpec() func(*gin.Context) {
-// 	return func(c *gin.Context) {
-// 		logrus.Debugf("DeleteBackupSpec")
-// 		name := c.Param("name")
-
-// 		err := deleteBackupSpec(name)
-// 		if err != nil {
-// 			apiInvocationsCounter.WithLabelValues("backup-spec", "error").Inc()
-// 			c.JSON(http.StatusInternalServerError, gin.H{"message": fmt.Sprintf("Error deleting backup spec. err=%s", err)})
-// 			return
-// 		}
-// 		c.JSON(http.StatusCreated, gin.H{"message": fmt.Sprintf("Backup spec deleted. name=%s", name)})
-// 		apiInvocationsCounter.WithLabelValues("backup-spec", "success").Inc()
-// 	}
-// }
+//DeleteBackupSpec delete a backup spec. Query param 'mode' is "orphan" (keep materialized backups and their data) or "purge" (remove all backup data before deleting the spec)
+func DeleteBackupSpec() func(*gin.Context) {
+	return func(c *gin.Context) {
+		logrus.Debugf("DeleteBackupSpec")
+		name := c.Param("name")
+		mode := c.Query("mode")
+
+		if mode != "orphan" && mode != "purge" {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Query param 'mode' must be 'orphan' or 'purge'"})
+			return
+		}
+
+		current, err := store.GetBackupSpec(name)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"message": fmt.Sprintf("Backup spec not found. err=%s", err)})
+			return
+		}
+		err = checkManagedBy(current)
+		if err != nil {
+			c.JSON(http.StatusConflict, gin.H{"message": err.Error()})
+			return
+		}
+
+		if mode == "orphan" {
+			err = store.DeleteBackupSpec(name)
+		} else {
+			err = triggerBackupSpecPurge(name)
+		}
+		if err != nil {
+			apiInvocationsCounter.WithLabelValues("backup-spec", "error").Inc()
+			c.JSON(http.StatusInternalServerError, gin.H{"message": fmt.Sprintf("Error deleting backup spec. err=%s", err)})
+			return
+		}
+
+		err1 := prepareTimers()
+		if err1 != nil {
+			logrus.Errorf("Error updating timers. err=%s", err1)
+			apiInvocationsCounter.WithLabelValues("backup-spec", "error").Inc()
+			c.JSON(http.StatusInternalServerError, gin.H{"message": fmt.Sprintf("Backup spec deleted but timer could not be updated. err=%s", err1)})
+			return
+		}
+
+		apiInvocationsCounter.WithLabelValues("backup-spec", "success").Inc()
+		if mode == "orphan" {
+			c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Backup spec deleted. Materialized backups were kept. name=%s", name)})
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"message": fmt.Sprintf("Backup spec purge started. It will be deleted after all its materialized backups are removed. name=%s", name)})
+	}
+}
+
+//FieldError invalid field of a request
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+//retentionField name of the retention field of a period. Ex.: "daily" -> "retentionDaily"
+func retentionField(period string) string {
+	return "retention" + strings.ToUpper(period[:1]) + period[1:]
+}
+
+//validateBackupSpec checks all fields of a backup spec with default values already set. Returns one error per invalid field
+func validateBackupSpec(bs BackupSpec) []FieldError {
+	errs := make([]FieldError, 0)
+	add := func(field string, err error) {
+		if err != nil {
+			errs = append(errs, FieldError{Field: field, Message: err.Error()})
+		}
+	}
+
+	if bs.Name == "" {
+		add("name", fmt.Errorf("'name' is required"))
+	}
+	if bs.Enabled != 0 && bs.Enabled != 1 {
+		add("enabled", fmt.Errorf("'enabled' must be 0 or 1"))
+	}
+	for _, pr := range [][2]string{{"minutely", bs.RetentionMinutely}, {"hourly", bs.RetentionHourly}, {"daily", bs.RetentionDaily},
+		{"weekly", bs.RetentionWeekly}, {"monthly", bs.RetentionMonthly}, {"yearly", bs.RetentionYearly}} {
+		add(retentionField(pr[0]), checkRetention(pr[0], pr[1]))
+	}
+	crons := []struct {
+		field string
+		value *string
+	}{
+		{"backupCronString", bs.BackupCronString},
+		{"verifyCronString", bs.VerifyCronString},
+		{"incrementalCronString", bs.IncrementalCronString},
+	}
+	for _, cr := range crons {
+		if cr.value == nil {
+			continue
+		}
+		_, err := cron.Parse(*cr.value)
+		if err != nil {
+			add(cr.field, fmt.Errorf("Invalid cron expression '%s'. err=%s", *cr.value, err))
+		}
+	}
+	if bs.TimeoutSeconds != nil && *bs.TimeoutSeconds <= 0 {
+		add("timeoutSeconds", fmt.Errorf("'timeoutSeconds' must be positive"))
+	}
+	if bs.FromDate != nil && bs.ToDate != nil && !bs.ToDate.After(*bs.FromDate) {
+		add("toDate", fmt.Errorf("'toDate' must be after 'fromDate'"))
+	}
+	if bs.VerifySampleSize < 1 {
+		add("verifySampleSize", fmt.Errorf("'verifySampleSize' must be positive"))
+	}
+	add("replicationTargets", checkReplicationTargets(bs))
+	add("notify", checkNotifyConfig(bs))
+	add("misfirePolicy", checkMisfirePolicy(bs))
+	add("timezone", checkTimezone(bs))
+	add("periods", checkRetentionPeriods(bs))
+	if bs.MaxTotalSizeMB < 0 {
+		add("maxTotalSizeMB", fmt.Errorf("'maxTotalSizeMB' must not be negative"))
+	}
+	if bs.MaxBackupCount < 0 {
+		add("maxBackupCount", fmt.Errorf("'maxBackupCount' must not be negative"))
+	}
+	return errs
+}
 
 func setBackupSpecDefaultValues(bs *BackupSpec) {
 	if bs.RetentionMinutely == "" {
@@ -163,6 +294,23 @@ func setBackupSpecDefaultValues(bs *BackupSpec) {
 		bs.RetentionYearly = "2@L"
 	}
 
+	if bs.VerifySampleSize == 0 {
+		bs.VerifySampleSize = 1
+	}
+
+	if bs.MisfirePolicy == "" {
+		bs.MisfirePolicy = misfireSkip
+	}
+	if bs.MisfirePolicy == misfireRunAll && bs.MisfireMaxRuns == 0 {
+		bs.MisfireMaxRuns = defaultMisfireMaxRuns
+	}
+
+	for i := range bs.Periods {
+		if bs.Periods[i].Every == 0 {
+			bs.Periods[i].Every = 1
+		}
+	}
+
 	if bs.BackupCronString == nil {
 		cp := calculateCronString(bs.MinutelyParams(), bs.HourlyParams(), bs.DailyParams(), bs.WeeklyParams(), bs.MonthlyParams(), bs.YearlyParams())
 		bs.BackupCronString = &cp
@@ -171,7 +319,7 @@ func setBackupSpecDefaultValues(bs *BackupSpec) {
 
 // CalculateCronString calculates a default cron string based on retention time
 func calculateCronString(minutelyParams []string, hourlyParams []string, dailyParams []string, weeklyParams []string, monthlyParams []string, yearlyParams []string) string {
-	// Seconds      Minutes      Hours      Day Of Month      Month      Day Of Week      Year
+	// Seconds      Minutes      Hours      Day Of Month      Month      Day Of Week
 	minutelyRef := minutelyParams[1] + " "
 	if minutelyRef == "L " {
 		minutelyRef = "59 "
@@ -192,7 +340,11 @@ func calculateCronString(minutelyParams []string, hourlyParams []string, dailyPa
 		weeklyRef = "SAT "
 	}
 
+	//cron has no 'last day of month', so monthly backups run on day 1 instead
 	monthlyRef := monthlyParams[1] + " "
+	if monthlyRef == "L " {
+		monthlyRef = "1 "
+	}
 
 	yearlyRef := yearlyParams[1] + " "
 	if yearlyRef == "L " {
@@ -206,11 +358,11 @@ func calculateCronString(minutelyParams []string, hourlyParams []string, dailyPa
 	} else if dailyParams[0] != "0" {
 		return minutelyRef + hourlyRef + dailyRef + "* * *"
 	} else if weeklyParams[0] != "0" {
-		return minutelyRef + hourlyRef + dailyRef + "* " + "* " + weeklyRef
+		return minutelyRef + hourlyRef + dailyRef + "* " + "* " + strings.TrimSpace(weeklyRef)
 	} else if monthlyParams[0] != "0" {
 		return minutelyRef + hourlyRef + dailyRef + monthlyRef + "* *"
 		// } else if yearlyParams[0] != "0" {
 	} else {
-		return minutelyRef + hourlyRef + dailyRef + monthlyRef + yearlyRef + "* *"
+		return minutelyRef + hourlyRef + dailyRef + monthlyRef + yearlyRef + "*"
 	}
 }
@@ -0,0 +1,150 @@
+package backtor
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/robfig/cron"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCalculateCronString1(t *testing.T) {
+	cs := calculateCronString(
+		[]string{"0", "L"}, //minute
+		[]string{"1", "L"}, //hour
+		[]string{"1", "L"}, //day
+		[]string{"0", "L"}, //week
+		[]string{"1", "L"}, //month
+		[]string{"1", "L"}) //year
+
+	assert.Equal(t, "59 59 * * * *", cs, "cron string")
+}
+
+func TestCalculateCronString2(t *testing.T) {
+	cs := calculateCronString(
+		[]string{"0", "L"}, //minute
+		[]string{"0", "L"}, //hour
+		[]string{"1", "L"}, //day
+		[]string{"1", "L"}, //week
+		[]string{"1", "L"}, //month
+		[]string{"1", "L"}) //year
+
+	assert.Equal(t, "59 59 23 * * *", cs, "cron string")
+}
+
+func TestCalculateCronString3(t *testing.T) {
+	cs := calculateCronString(
+		[]string{"0", "22"},  //minute
+		[]string{"0", "33"},  //hour
+		[]string{"458", "4"}, //day
+		[]string{"1", "L"},   //week
+		[]string{"1", "L"},   //month
+		[]string{"1", "L"})   //year
+
+	assert.Equal(t, "22 33 4 * * *", cs, "cron string")
+}
+
+func TestCalculateCronString4(t *testing.T) {
+	cs := calculateCronString(
+		[]string{"0", "22"}, //minute
+		[]string{"0", "L"},  //hour
+		[]string{"0", "7"},  //day
+		[]string{"4", "L"},  //week
+		[]string{"1", "L"},  //month
+		[]string{"1", "L"})  //year
+
+	// Seconds      Minutes      Hours      Day Of Month      Month      Day Of Week
+	assert.Equal(t, "22 59 7 * * SAT", cs, "cron string")
+}
+
+func TestCalculateCronString5(t *testing.T) {
+	cs := calculateCronString(
+		[]string{"0", "22"}, //minute
+		[]string{"0", "L"},  //hour
+		[]string{"0", "7"},  //day
+		[]string{"44", "L"}, //week
+		[]string{"0", "L"},  //month
+		[]string{"45", "L"}) //year
+
+	assert.Equal(t, "22 59 7 * * SAT", cs, "cron string")
+}
+
+func TestCalculateCronString6(t *testing.T) {
+	cs := calculateCronString(
+		[]string{"0", "22"}, //minute
+		[]string{"0", "L"},  //hour
+		[]string{"0", "7"},  //day
+		[]string{"0", "L"},  //week
+		[]string{"2", "10"}, //month
+		[]string{"45", "L"}) //year
+
+	assert.Equal(t, "22 59 7 10 * *", cs, "cron string")
+}
+
+func TestCalculateCronString7(t *testing.T) {
+	cs := calculateCronString(
+		[]string{"0", "22"}, //minute
+		[]string{"0", "L"},  //hour
+		[]string{"0", "7"},  //day
+		[]string{"0", "L"},  //week
+		[]string{"0", "L"},  //month
+		[]string{"0", "L"})  //year
+
+	assert.Equal(t, "22 59 7 1 12 *", cs, "cron string")
+	_, err := cron.Parse(cs)
+	assert.Nil(t, err, "default cron string must be accepted by the scheduler")
+}
+
+func TestCreateBackupSpecValidation(t *testing.T) {
+	_, teardown := setupTest(t)
+	defer teardown()
+
+	router := gin.New()
+	router.POST("/backup", CreateBackupSpec())
+	create := func(body string) (int, map[string]interface{}) {
+		req := httptest.NewRequest(http.MethodPost, "/backup", bytes.NewReader([]byte(body)))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		resp := make(map[string]interface{})
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+
+	code, resp := create(`{"name": "test", "retentionHourly": "abc@10", "retentionDaily": "4@XYZ", "retentionWeekly": "2@7",
+		"retentionMonthly": "1@0", "backupCronString": "0 0 25 * * *", "verifyCronString": "@every x"}`)
+	require.Equal(t, http.StatusBadRequest, code)
+	fields := make(map[string]bool)
+	for _, e := range resp["errors"].([]interface{}) {
+		fe := e.(map[string]interface{})
+		assert.NotEmpty(t, fe["message"])
+		fields[fe["field"].(string)] = true
+	}
+	assert.Equal(t, map[string]bool{"retentionHourly": true, "retentionDaily": true, "retentionWeekly": true,
+		"retentionMonthly": true, "backupCronString": true, "verifyCronString": true}, fields)
+	_, err := store.GetBackupSpec("test")
+	assert.NotNil(t, err)
+
+	code, _ = create(`{"name": "test", "retentionHourly": "24@30", "retentionDaily": "7@L", "retentionWeekly": "4@0", "retentionMonthly": "12@1", "retentionYearly": "3@12"}`)
+	require.Equal(t, http.StatusCreated, code)
+	bs, err := store.GetBackupSpec("test")
+	require.Nil(t, err)
+	assert.Equal(t, "59 30 * * * *", *bs.BackupCronString)
+
+	//default cron strings computed for monthly or yearly only retention must be accepted too
+	code, _ = create(`{"name": "monthly", "retentionMinutely": "0", "retentionHourly": "0", "retentionDaily": "0", "retentionWeekly": "0", "retentionMonthly": "3@L", "retentionYearly": "2@L"}`)
+	require.Equal(t, http.StatusCreated, code)
+	bs, err = store.GetBackupSpec("monthly")
+	require.Nil(t, err)
+	assert.Equal(t, "59 59 23 1 * *", *bs.BackupCronString)
+
+	code, _ = create(`{"name": "yearly", "retentionMinutely": "0", "retentionHourly": "0", "retentionDaily": "0", "retentionWeekly": "0", "retentionMonthly": "0", "retentionYearly": "2@L"}`)
+	require.Equal(t, http.StatusCreated, code)
+	bs, err = store.GetBackupSpec("yearly")
+	require.Nil(t, err)
+	assert.Equal(t, "59 59 23 1 12 *", *bs.BackupCronString)
+}
@@ -0,0 +1,235 @@
+package backtor
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+//signatureHeader carries "sha256=<hex hmac-sha256 of the request body using the callback secret>"
+const signatureHeader = "X-Backtor-Signature"
+
+//workflowEventsRetention how long processed event ids are kept for deduplication
+const workflowEventsRetention = 7 * 24 * time.Hour
+
+var workflowEventsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "backtor_workflow_events_total",
+	Help: "Total workflow callbacks received",
+}, []string{
+	"type",
+	"status",
+})
+
+//WorkflowEvent workflow status notification sent by Conductor (workflow status listener or a final HTTP task)
+type WorkflowEvent struct {
+	//EventID optional unique id of the notification. Defaults to workflowId:status
+	EventID      string                 `json:"eventId"`
+	WorkflowID   string                 `json:"workflowId"`
+	WorkflowType string                 `json:"workflowType"`
+	WorkflowName string                 `json:"workflowName"`
+	Status       string                 `json:"status"`
+	BackupName   string                 `json:"backupName"`
+	Input        map[string]interface{} `json:"input"`
+}
+
+func (h *HTTPServer) setupEventHandlers() {
+	prometheus.MustRegister(workflowEventsCounter)
+	h.router.POST("/events/conductor", ReceiveConductorEvent())
+}
+
+//ReceiveConductorEvent records the outcome of a create, remove, restore, verify or replicate workflow as soon as it finishes
+func ReceiveConductorEvent() func(*gin.Context) {
+	return func(c *gin.Context) {
+		logrus.Debugf("ReceiveConductorEvent")
+		if opt.CallbackSecret == "" {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"message": "Workflow callbacks are disabled. Set --callback-secret to enable them"})
+			return
+		}
+
+		data, err := ioutil.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Couldn't read request body. err=%s", err)})
+			return
+		}
+		if !validSignature(data, c.GetHeader(signatureHeader), opt.CallbackSecret) {
+			logrus.Warnf("Workflow event with invalid signature received from %s", c.ClientIP())
+			workflowEventsCounter.WithLabelValues("", "invalid-signature").Inc()
+			c.JSON(http.StatusUnauthorized, gin.H{"message": "Invalid signature"})
+			return
+		}
+
+		e := WorkflowEvent{}
+		err = json.Unmarshal(data, &e)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Invalid event. err=%s", err)})
+			return
+		}
+		if e.WorkflowType == "" {
+			e.WorkflowType = e.WorkflowName
+		}
+		if e.BackupName == "" {
+			if bn, ok := e.Input["backupName"].(string); ok {
+				e.BackupName = bn
+			}
+		}
+		if e.WorkflowID == "" || e.BackupName == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "'workflowId' and 'backupName' (or 'input.backupName') are required"})
+			return
+		}
+		if e.EventID == "" {
+			e.EventID = fmt.Sprintf("%s:%s", e.WorkflowID, e.Status)
+		}
+
+		processed, err := store.IsWorkflowEventProcessed(e.EventID)
+		if err != nil {
+			workflowEventsCounter.WithLabelValues(e.WorkflowType, "error").Inc()
+			c.JSON(http.StatusInternalServerError, gin.H{"message": fmt.Sprintf("Error checking event. err=%s", err)})
+			return
+		}
+		if processed {
+			logrus.Debugf("Workflow event %s already processed", e.EventID)
+			workflowEventsCounter.WithLabelValues(e.WorkflowType, "duplicate").Inc()
+			c.JSON(http.StatusOK, gin.H{"message": "Event already processed", "duplicate": true})
+			return
+		}
+
+		_, err = store.GetBackupSpec(e.BackupName)
+		if err != nil {
+			workflowEventsCounter.WithLabelValues(e.WorkflowType, "error").Inc()
+			c.JSON(http.StatusNotFound, gin.H{"message": fmt.Sprintf("Backup spec %s not found", e.BackupName)})
+			return
+		}
+
+		recorded, err := processWorkflowEvent(e)
+		if err != nil {
+			workflowEventsCounter.WithLabelValues(e.WorkflowType, "error").Inc()
+			c.JSON(http.StatusServiceUnavailable, gin.H{"message": fmt.Sprintf("Error processing event. Send it again later. err=%s", err)})
+			return
+		}
+		if !recorded {
+			//not saved as processed, so that the event is accepted when sent again
+			logrus.Infof("Workflow %s of event %s is not finished or not recorded yet", e.WorkflowID, e.EventID)
+			workflowEventsCounter.WithLabelValues(e.WorkflowType, "not-finished").Inc()
+			c.JSON(http.StatusConflict, gin.H{"message": fmt.Sprintf("Workflow %s is not finished yet. Send the event again later", e.WorkflowID)})
+			return
+		}
+
+		_, err = store.SaveWorkflowEvent(e.EventID, e.WorkflowID, e.Status, time.Now())
+		if err != nil {
+			logrus.Warnf("Couldn't record workflow event %s. It may be processed again. err=%s", e.EventID, err)
+		}
+		err = store.DeleteWorkflowEventsBefore(time.Now().Add(-workflowEventsRetention))
+		if err != nil {
+			logrus.Warnf("Couldn't delete old workflow events. err=%s", err)
+		}
+
+		workflowEventsCounter.WithLabelValues(e.WorkflowType, "processed").Inc()
+		c.JSON(http.StatusOK, gin.H{"message": "Event processed"})
+	}
+}
+
+//processWorkflowEvent runs the same checks done by the backup timer, but only for the kind of workflow that finished.
+//Workflow status is always read back from the executor, so the event only tells which check to run.
+//Returns whether the workflow has finished and its outcome was recorded. Events sent while the workflow is still running
+//(ex.: by a final HTTP task of the workflow itself) must be sent again
+func processWorkflowEvent(e WorkflowEvent) (bool, error) {
+	logrus.Infof("Workflow event received. workflowId=%s type=%s status=%s backup=%s", e.WorkflowID, e.WorkflowType, e.Status, e.BackupName)
+	wf, err := getWorkflowInstance(e.WorkflowID)
+	if err != nil && wf.Status != "NOT_FOUND" {
+		return false, fmt.Errorf("Couldn't get workflow instance %s. err=%s", e.WorkflowID, err)
+	}
+	if wf.Status == "RUNNING" {
+		return false, nil
+	}
+
+	switch e.WorkflowType {
+	case workflowCreate:
+		checkBackupWorkflow(e.BackupName)
+	case workflowRemove:
+		checkWorkflowBackupRemove(e.BackupName)
+	case opt.RestoreWorkflowName:
+		checkRestoreWorkflows(e.BackupName)
+	case workflowVerify:
+		checkVerifyWorkflows(e.BackupName)
+	case workflowReplicate:
+		checkReplicateWorkflows(e.BackupName)
+	default:
+		checkBackupWorkflow(e.BackupName)
+		checkWorkflowBackupRemove(e.BackupName)
+		checkRestoreWorkflows(e.BackupName)
+		checkVerifyWorkflows(e.BackupName)
+		checkReplicateWorkflows(e.BackupName)
+	}
+	return workflowRecorded(e.BackupName, e.WorkflowID)
+}
+
+//workflowRecorded whether no record of a backup spec is waiting for workflowID anymore
+func workflowRecorded(backupName string, workflowID string) (bool, error) {
+	bs, err := store.GetBackupSpec(backupName)
+	if err != nil {
+		return false, err
+	}
+	if bs.RunningCreateWorkflowID != nil && *bs.RunningCreateWorkflowID == workflowID {
+		return false, nil
+	}
+	deleting, err := store.GetMaterializedBackups(backupName, 0, "", "deleting", false)
+	if err != nil {
+		return false, err
+	}
+	for _, mb := range deleting {
+		if mb.RunningDeleteWorkflowID != nil && *mb.RunningDeleteWorkflowID == workflowID {
+			return false, nil
+		}
+	}
+	verifying, err := store.GetVerifyingMaterializedBackups(backupName)
+	if err != nil {
+		return false, err
+	}
+	for _, mb := range verifying {
+		if mb.RunningVerifyWorkflowID != nil && *mb.RunningVerifyWorkflowID == workflowID {
+			return false, nil
+		}
+	}
+	replicating, err := store.GetReplicaBackups(backupName, "", "replicating")
+	if err != nil {
+		return false, err
+	}
+	for _, mb := range replicating {
+		if mb.ID == workflowID {
+			return false, nil
+		}
+	}
+	restores, err := store.GetRestores(backupName, "RUNNING")
+	if err != nil {
+		return false, err
+	}
+	for _, r := range restores {
+		if r.ID == workflowID {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func validSignature(body []byte, signature string, secret string) bool {
+	if !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+	sig, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(sig, mac.Sum(nil))
+}
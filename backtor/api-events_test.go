@@ -0,0 +1,101 @@
+package backtor
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/flaviostutz/backtor/backtor/backtortest"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func postEvent(t *testing.T, router *gin.Engine, body []byte, secret string) (int, map[string]interface{}) {
+	req := httptest.NewRequest(http.MethodPost, "/events/conductor", bytes.NewReader(body))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	req.Header.Set(signatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	resp := make(map[string]interface{})
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w.Code, resp
+}
+
+func TestConductorEventMaterializesBackup(t *testing.T) {
+	conductor, teardown := setupTest(t)
+	defer teardown()
+	opt.CallbackSecret = "s3cret"
+
+	router := gin.New()
+	router.POST("/events/conductor", ReceiveConductorEvent())
+
+	createTestBackupSpec(t, BackupSpec{Name: "test"})
+	wid, err := triggerNewBackup("test")
+	require.Nil(t, err)
+	require.Nil(t, conductor.Finish(wid, backtortest.Completed("data1", 2)))
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"workflowId":   wid,
+		"workflowType": "create_backup",
+		"status":       "COMPLETED",
+		"input":        map[string]interface{}{"backupName": "test"},
+	})
+
+	code, _ := postEvent(t, router, body, "wrong")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	_, err = store.GetMaterializedBackup(wid)
+	assert.NotNil(t, err, "unsigned events must not be processed")
+
+	code, resp := postEvent(t, router, body, "s3cret")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Nil(t, resp["duplicate"])
+	mb, err := store.GetMaterializedBackup(wid)
+	require.Nil(t, err)
+	assert.Equal(t, "COMPLETED", mb.Status)
+	assert.True(t, hasTag(mb, "reference"))
+
+	code, resp = postEvent(t, router, body, "s3cret")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, true, resp["duplicate"])
+}
+
+func TestConductorEventBeforeWorkflowFinishes(t *testing.T) {
+	conductor, teardown := setupTest(t)
+	defer teardown()
+	opt.CallbackSecret = "s3cret"
+
+	router := gin.New()
+	router.POST("/events/conductor", ReceiveConductorEvent())
+
+	createTestBackupSpec(t, BackupSpec{Name: "test"})
+	wid, err := triggerNewBackup("test")
+	require.Nil(t, err)
+
+	//a final HTTP task notifies while Conductor still reports the workflow as running
+	body, _ := json.Marshal(map[string]interface{}{
+		"workflowId":   wid,
+		"workflowType": "create_backup",
+		"status":       "COMPLETED",
+		"input":        map[string]interface{}{"backupName": "test"},
+	})
+	code, _ := postEvent(t, router, body, "s3cret")
+	assert.Equal(t, http.StatusConflict, code)
+	_, err = store.GetMaterializedBackup(wid)
+	assert.NotNil(t, err)
+
+	//the retry is processed once the workflow has finished
+	require.Nil(t, conductor.Finish(wid, backtortest.Completed("data1", 2)))
+	code, resp := postEvent(t, router, body, "s3cret")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Nil(t, resp["duplicate"])
+	mb, err := store.GetMaterializedBackup(wid)
+	require.Nil(t, err)
+	assert.Equal(t, "COMPLETED", mb.Status)
+}
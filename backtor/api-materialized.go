@@ -1,8 +1,15 @@
 package backtor
 
 import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
@@ -11,28 +18,251 @@ import (
 func (h *HTTPServer) setupMaterializedHandlers() {
 	h.router.GET("/backup/:name/materialized", ListMaterizalized())
 	h.router.POST("/backup/:name/materialized", TriggerBackup())
+	h.router.POST("/backup/:name/verify", TriggerVerify())
+	h.router.GET("/backup/:name/replicas", ListReplicas())
+	h.router.GET("/backup/:name/catchups", ListCatchups())
+	h.router.POST("/backup/:name/materialized/:id/hold", HoldMaterialized())
+	h.router.POST("/backup/:name/materialized/:id/unhold", UnholdMaterialized())
+	//the router doesn't allow a static segment next to :id, so import is served by this route
+	h.router.POST("/backup/:name/materialized/:id", materializedAction())
 }
 
-//ListMaterizalized get currently tracked backups
+func materializedAction() func(*gin.Context) {
+	importBackups := ImportMaterialized()
+	return func(c *gin.Context) {
+		if c.Param("id") == "import" {
+			importBackups(c)
+			return
+		}
+		c.JSON(http.StatusNotFound, gin.H{"message": fmt.Sprintf("Unknown action %s", c.Param("id"))})
+	}
+}
+
+//ImportMaterialized records backups created outside backtor as COMPLETED materialized backups. The request body is a backup or a list of backups
+func ImportMaterialized() func(*gin.Context) {
+	return func(c *gin.Context) {
+		logrus.Debugf("ImportMaterialized")
+		bn := c.Param("name")
+
+		backups := make([]ImportedBackup, 0)
+		data, _ := ioutil.ReadAll(c.Request.Body)
+		err := json.Unmarshal(data, &backups)
+		if err != nil {
+			b := ImportedBackup{}
+			err = json.Unmarshal(data, &b)
+			backups = []ImportedBackup{b}
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Invalid import request. err=%s", err)})
+			return
+		}
+
+		_, err = store.GetBackupSpec(bn)
+		if err != nil {
+			apiInvocationsCounter.WithLabelValues("import", "error").Inc()
+			c.JSON(http.StatusNotFound, gin.H{"message": fmt.Sprintf("Backup spec %s not found", bn)})
+			return
+		}
+
+		ids, err := importBackups(bn, backups)
+		if err != nil {
+			apiInvocationsCounter.WithLabelValues("import", "error").Inc()
+			if _, ok := err.(importError); ok {
+				c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"message": fmt.Sprintf("Error importing backups. err=%s", err), "ids": ids})
+			return
+		}
+		apiInvocationsCounter.WithLabelValues("import", "success").Inc()
+		c.JSON(http.StatusCreated, gin.H{"message": fmt.Sprintf("%d backups imported", len(ids)), "ids": ids})
+	}
+}
+
+//defaultMaterializedPageSize backups per page when 'limit' is not set
+const defaultMaterializedPageSize = 100
+
+//maxMaterializedPageSize max 'limit' of materialized listings
+const maxMaterializedPageSize = 1000
+
+//ListMaterizalized get currently tracked backups, one page at a time. The total number of matching backups is sent in the X-Total-Count header and,
+//if there are more pages, the cursor of the next page in X-Next-Cursor
 func ListMaterizalized() func(*gin.Context) {
 	return func(c *gin.Context) {
 		logrus.Debugf("ListMaterizalized")
-		tag := c.Query("tag")
-		status := c.Query("status")
 		name := c.Param("name")
 
-		backups, err := getMaterializedBackups(name, 0, tag, status, false)
+		q, err := materializedQuery(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+		limit := q.Limit
+		//one more backup tells whether there is a next page
+		q.Limit = limit + 1
+
+		backups, total, err := store.ListMaterializedBackups(q)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"message": fmt.Sprintf("Error getting materialized. err=%s", err)})
 			apiInvocationsCounter.WithLabelValues("materialized", "error").Inc()
 			return
 		}
+		if len(backups) > limit {
+			backups = backups[:limit]
+			last := backups[limit-1]
+			c.Header("X-Next-Cursor", encodeMaterializedCursor(MaterializedCursor{StartTime: last.StartTime, ID: last.ID}))
+		}
+		c.Header("X-Total-Count", strconv.Itoa(total))
 
+		loc := apiLocation(name)
+		for i := range backups {
+			localizeMaterialized(&backups[i], loc)
+		}
 		apiInvocationsCounter.WithLabelValues("materialized", "success").Inc()
 		c.JSON(http.StatusOK, backups)
 	}
 }
 
+//materializedQuery parses the query params of a materialized listing:
+//'tag', 'status' (repeated or comma separated), 'from' and 'to' (RFC3339), 'sort' ('desc' or 'asc'), 'limit' and 'cursor'
+func materializedQuery(c *gin.Context) (MaterializedQuery, error) {
+	name := c.Param("name")
+	q := MaterializedQuery{BackupName: name, Limit: defaultMaterializedPageSize}
+
+	tag := c.Query("tag")
+	if tag != "" {
+		//custom periods are valid tags too. Built-in tags are used if the spec is not found
+		bs, _ := store.GetBackupSpec(name)
+		valid := false
+		for _, t := range retentionTiers(bs) {
+			if t == tag {
+				valid = true
+			}
+		}
+		if !valid {
+			return q, fmt.Errorf("Query param 'tag' must be one of %s", strings.Join(retentionTiers(bs), ", "))
+		}
+		q.Tag = tag
+	}
+
+	for _, st := range c.QueryArray("status") {
+		for _, s := range strings.Split(st, ",") {
+			s = strings.TrimSpace(s)
+			if s != "" {
+				q.Statuses = append(q.Statuses, s)
+			}
+		}
+	}
+
+	for _, p := range []struct {
+		param string
+		dest  **time.Time
+	}{{"from", &q.From}, {"to", &q.To}} {
+		v := c.Query(p.param)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return q, fmt.Errorf("Query param '%s' must be a RFC3339 time. err=%s", p.param, err)
+		}
+		*p.dest = &t
+	}
+
+	switch c.DefaultQuery("sort", "desc") {
+	case "desc":
+	case "asc":
+		q.Ascending = true
+	default:
+		return q, fmt.Errorf("Query param 'sort' must be 'asc' or 'desc'")
+	}
+
+	l := c.Query("limit")
+	if l != "" {
+		limit, err := strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > maxMaterializedPageSize {
+			return q, fmt.Errorf("Query param 'limit' must be a number between 1 and %d", maxMaterializedPageSize)
+		}
+		q.Limit = limit
+	}
+
+	cursor := c.Query("cursor")
+	if cursor != "" {
+		mc, err := decodeMaterializedCursor(cursor)
+		if err != nil {
+			return q, fmt.Errorf("Invalid query param 'cursor'. err=%s", err)
+		}
+		q.After = &mc
+	}
+	return q, nil
+}
+
+//encodeMaterializedCursor opaque cursor sent to API clients. The listing order is not part of it, so it must be used with the same query params
+func encodeMaterializedCursor(mc MaterializedCursor) string {
+	data, _ := json.Marshal(mc)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeMaterializedCursor(cursor string) (MaterializedCursor, error) {
+	mc := MaterializedCursor{}
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return mc, err
+	}
+	err = json.Unmarshal(data, &mc)
+	if err != nil {
+		return mc, err
+	}
+	if mc.ID == "" {
+		return mc, fmt.Errorf("cursor without id")
+	}
+	return mc, nil
+}
+
+//ListReplicas get replicas of a backup spec's materialized backups. Query params 'target' and 'status' are optional filters
+func ListReplicas() func(*gin.Context) {
+	return func(c *gin.Context) {
+		logrus.Debugf("ListReplicas")
+		name := c.Param("name")
+
+		replicas, err := store.GetReplicaBackups(name, c.Query("target"), c.Query("status"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": fmt.Sprintf("Error getting replicas. err=%s", err)})
+			apiInvocationsCounter.WithLabelValues("replicas", "error").Inc()
+			return
+		}
+
+		loc := apiLocation(name)
+		for i := range replicas {
+			localizeMaterialized(&replicas[i], loc)
+		}
+		apiInvocationsCounter.WithLabelValues("replicas", "success").Inc()
+		c.JSON(http.StatusOK, replicas)
+	}
+}
+
+//ListCatchups lists missed schedule windows and the catch-up backups launched for them, newest first
+func ListCatchups() func(*gin.Context) {
+	return func(c *gin.Context) {
+		logrus.Debugf("ListCatchups")
+		name := c.Param("name")
+
+		catchups, err := store.GetCatchups(name)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": fmt.Sprintf("Error getting catch-ups. err=%s", err)})
+			apiInvocationsCounter.WithLabelValues("catchups", "error").Inc()
+			return
+		}
+
+		loc := apiLocation(name)
+		for i := range catchups {
+			localizeCatchup(&catchups[i], loc)
+		}
+		apiInvocationsCounter.WithLabelValues("catchups", "success").Inc()
+		c.JSON(http.StatusOK, catchups)
+	}
+}
+
 func TriggerBackup() func(*gin.Context) {
 	return func(c *gin.Context) {
 		logrus.Debugf("TriggerBackup")
@@ -47,3 +277,106 @@ func TriggerBackup() func(*gin.Context) {
 		apiInvocationsCounter.WithLabelValues("materialized", "success").Inc()
 	}
 }
+
+//TriggerVerify launches verify workflows for a random sample of COMPLETED materialized backups now
+func TriggerVerify() func(*gin.Context) {
+	return func(c *gin.Context) {
+		logrus.Debugf("TriggerVerify")
+		bn := c.Param("name")
+		_, err := store.GetBackupSpec(bn)
+		if err != nil {
+			apiInvocationsCounter.WithLabelValues("materialized", "error").Inc()
+			c.JSON(http.StatusNotFound, gin.H{"message": fmt.Sprintf("Backup spec %s not found", bn)})
+			return
+		}
+		wids, err := triggerVerify(bn)
+		if err != nil {
+			apiInvocationsCounter.WithLabelValues("materialized", "error").Inc()
+			c.JSON(http.StatusInternalServerError, gin.H{"message": fmt.Sprintf("Error triggering verification. err=%s", err)})
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"message": fmt.Sprintf("Verification scheduled for %d materialized backups", len(wids)), "workflowIds": wids})
+		apiInvocationsCounter.WithLabelValues("materialized", "success").Inc()
+	}
+}
+
+//HoldMaterialized places a legal hold on a materialized backup so that it is kept past its retention
+func HoldMaterialized() func(*gin.Context) {
+	return func(c *gin.Context) {
+		logrus.Debugf("HoldMaterialized")
+		req := struct {
+			By     string     `json:"by"`
+			Reason string     `json:"reason"`
+			Until  *time.Time `json:"until"`
+		}{}
+		data, _ := ioutil.ReadAll(c.Request.Body)
+		err := json.Unmarshal(data, &req)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Invalid hold request. err=%s", err)})
+			return
+		}
+		if req.By == "" || req.Reason == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "'by' and 'reason' are required"})
+			return
+		}
+		now := time.Now()
+		if req.Until != nil && !req.Until.After(now) {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "'until' must be in the future"})
+			return
+		}
+
+		mb, ok := materializedOf(c)
+		if !ok {
+			return
+		}
+		if mb.Status == "deleting" || mb.Status == "deleted" {
+			apiInvocationsCounter.WithLabelValues("hold", "error").Inc()
+			c.JSON(http.StatusConflict, gin.H{"message": fmt.Sprintf("Materialized backup %s cannot be held because its status is %s", mb.ID, mb.Status)})
+			return
+		}
+
+		err = store.SetHoldMaterializedBackup(mb.ID, &req.By, &req.Reason, &now, req.Until)
+		if err != nil {
+			apiInvocationsCounter.WithLabelValues("hold", "error").Inc()
+			c.JSON(http.StatusInternalServerError, gin.H{"message": fmt.Sprintf("Error placing hold. err=%s", err)})
+			return
+		}
+		logrus.Infof("Materialized backup %s of %s put on hold by %s. reason=%s until=%v", mb.ID, mb.BackupName, req.By, req.Reason, req.Until)
+		apiInvocationsCounter.WithLabelValues("hold", "success").Inc()
+		c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Materialized backup %s is on hold", mb.ID)})
+	}
+}
+
+//UnholdMaterialized removes the legal hold of a materialized backup. It will be handled by retention again
+func UnholdMaterialized() func(*gin.Context) {
+	return func(c *gin.Context) {
+		logrus.Debugf("UnholdMaterialized")
+		mb, ok := materializedOf(c)
+		if !ok {
+			return
+		}
+		err := store.SetHoldMaterializedBackup(mb.ID, nil, nil, nil, nil)
+		if err != nil {
+			apiInvocationsCounter.WithLabelValues("hold", "error").Inc()
+			c.JSON(http.StatusInternalServerError, gin.H{"message": fmt.Sprintf("Error removing hold. err=%s", err)})
+			return
+		}
+		logrus.Infof("Hold removed from materialized backup %s of %s", mb.ID, mb.BackupName)
+		apiInvocationsCounter.WithLabelValues("hold", "success").Inc()
+		c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Hold removed from materialized backup %s", mb.ID)})
+	}
+}
+
+//materializedOf loads the materialized backup identified by the 'name' and 'id' path params. Writes a 404 response if not found (500 if it couldn't be loaded)
+func materializedOf(c *gin.Context) (MaterializedBackup, bool) {
+	mb, err := store.GetMaterializedBackup(c.Param("id"))
+	if err != nil && err != sql.ErrNoRows {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": fmt.Sprintf("Couldn't load materialized backup %s. err=%s", c.Param("id"), err)})
+		return MaterializedBackup{}, false
+	}
+	if err == sql.ErrNoRows || mb.BackupName != c.Param("name") {
+		c.JSON(http.StatusNotFound, gin.H{"message": fmt.Sprintf("Materialized backup %s not found in backup %s", c.Param("id"), c.Param("name"))})
+		return MaterializedBackup{}, false
+	}
+	return mb, true
+}
@@ -0,0 +1,208 @@
+package backtor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/flaviostutz/backtor/backtor/backtortest"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHoldMaterialized(t *testing.T) {
+	conductor, teardown := setupTest(t)
+	defer teardown()
+
+	router := gin.New()
+	router.POST("/backup/:name/materialized/:id/hold", HoldMaterialized())
+	router.POST("/backup/:name/materialized/:id/unhold", UnholdMaterialized())
+	post := func(path string, body string) int {
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader([]byte(body)))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	createTestBackupSpec(t, BackupSpec{Name: "test", RetentionDaily: "2@L"})
+	conductor.Script("remove_backup", backtortest.Completed("", 0))
+	ids := make(map[string]string)
+	for day := 6; day <= 9; day++ {
+		dataID := fmt.Sprintf("day%d", day)
+		conductor.Script("create_backup", backtortest.Completed(dataID, 1))
+		now := time.Date(2020, 1, day, 23, 0, 0, 0, time.UTC)
+		conductor.Now = func() time.Time { return now }
+		runBackupCycle(t, "test")
+		mbs, err := store.GetMaterializedBackups("test", 1, "", "COMPLETED", false)
+		require.Nil(t, err)
+		ids[dataID] = mbs[0].ID
+
+		if day == 7 {
+			assert.Equal(t, http.StatusBadRequest, post("/backup/test/materialized/"+ids["day7"]+"/hold", `{"by": "auditor"}`))
+			assert.Equal(t, http.StatusBadRequest, post("/backup/test/materialized/"+ids["day7"]+"/hold", `{"by": "auditor", "reason": "audit", "until": "2001-01-01T00:00:00Z"}`))
+			assert.Equal(t, http.StatusNotFound, post("/backup/other/materialized/"+ids["day7"]+"/hold", `{"by": "auditor", "reason": "audit"}`))
+			require.Equal(t, http.StatusOK, post("/backup/test/materialized/"+ids["day7"]+"/hold", `{"by": "auditor", "reason": "audit 2020"}`))
+		}
+	}
+
+	//the held backup doesn't take one of the 2 daily places
+	assert.Equal(t, map[string]string{"day6": "COMPLETED", "day7": "COMPLETED", "day8": "COMPLETED", "day9": "COMPLETED"}, materializedStatuses(t, "test"))
+	mb, err := store.GetMaterializedBackup(ids["day7"])
+	require.Nil(t, err)
+	require.NotNil(t, mb.HoldBy)
+	assert.Equal(t, "auditor", *mb.HoldBy)
+	assert.Equal(t, "audit 2020", *mb.HoldReason)
+	assert.NotNil(t, mb.HoldTime)
+	assert.Nil(t, mb.HoldUntil)
+	assert.NotNil(t, triggerBackupDelete(ids["day7"]), "held backups must not be deleted")
+
+	require.Equal(t, http.StatusOK, post("/backup/test/materialized/"+ids["day7"]+"/unhold", ""))
+	RunRetentionTask("test")
+	checkWorkflowBackupRemove("test")
+	assert.Equal(t, map[string]string{"day6": "deleted", "day7": "COMPLETED", "day8": "COMPLETED", "day9": "COMPLETED"}, materializedStatuses(t, "test"))
+
+	//expired holds don't protect backups anymore
+	past := time.Now().Add(-time.Hour)
+	by := "auditor"
+	mb.HoldUntil = &past
+	assert.False(t, isHeld(mb, time.Now()))
+	mb.HoldUntil = nil
+	mb.HoldBy = &by
+	assert.True(t, isHeld(mb, time.Now()))
+}
+
+func TestImportMaterialized(t *testing.T) {
+	conductor, teardown := setupTest(t)
+	defer teardown()
+
+	router := gin.New()
+	router.POST("/backup/:name/materialized/:id/hold", HoldMaterialized())
+	router.POST("/backup/:name/materialized/:id", materializedAction())
+	post := func(path string, body string) int {
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader([]byte(body)))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	createTestBackupSpec(t, BackupSpec{Name: "test", RetentionDaily: "2@L"})
+	conductor.Script("remove_backup", backtortest.Completed("", 0))
+
+	body := `[
+		{"dataId": "old1", "startTime": "2019-01-01T23:00:00Z", "endTime": "2019-01-01T23:30:00Z", "sizeMB": 10},
+		{"dataId": "old2", "startTime": "2019-01-02T23:00:00Z", "endTime": "2019-01-02T23:30:00Z", "sizeMB": 10},
+		{"dataId": "old3", "startTime": "2019-01-03T23:00:00Z", "endTime": "2019-01-03T23:30:00Z", "sizeMB": 10, "externalId": "dba-3"}
+	]`
+	assert.Equal(t, http.StatusNotFound, post("/backup/other/materialized/import", body))
+	assert.Equal(t, http.StatusBadRequest, post("/backup/test/materialized/import", `{"dataId": "old4"}`))
+	assert.Equal(t, http.StatusBadRequest, post("/backup/test/materialized/import", `[
+		{"dataId": "dup1", "startTime": "2019-01-01T22:00:00Z", "externalId": "dup"},
+		{"dataId": "dup2", "startTime": "2019-01-02T22:00:00Z", "externalId": "dup"}
+	]`), "externalId repeated in the request")
+	assert.Equal(t, map[string]string{}, materializedStatuses(t, "test"), "nothing is recorded if any backup is invalid")
+	require.Equal(t, http.StatusCreated, post("/backup/test/materialized/import", body))
+	assert.Equal(t, http.StatusBadRequest, post("/backup/test/materialized/import", `{"dataId": "old1", "startTime": "2019-01-05T23:00:00Z"}`), "dataId already imported")
+	require.Equal(t, http.StatusCreated, post("/backup/test/materialized/import", `{"dataId": "old4", "startTime": "2019-01-04T23:00:00Z", "sizeMB": 10}`))
+
+	mb, err := store.GetMaterializedBackup("dba-3")
+	require.Nil(t, err)
+	assert.Equal(t, "old3", mb.DataID)
+	assert.Equal(t, "COMPLETED", mb.Status)
+	assert.Equal(t, 10.0, mb.SizeMB)
+
+	//imported backups are tagged and follow retention like the other ones
+	mbs, err := store.GetMaterializedBackups("test", 1, "", "COMPLETED", false)
+	require.Nil(t, err)
+	assert.Equal(t, "old4", mbs[0].DataID)
+	assert.Equal(t, mbs[0].StartTime, mbs[0].EndTime)
+	assert.True(t, hasTag(mbs[0], "yearly"))
+
+	RunRetentionTask("test")
+	checkWorkflowBackupRemove("test")
+	assert.Equal(t, map[string]string{"old1": "deleted", "old2": "COMPLETED", "old3": "COMPLETED", "old4": "COMPLETED"}, materializedStatuses(t, "test"))
+}
+
+func TestListMaterializedPages(t *testing.T) {
+	_, teardown := setupTest(t)
+	defer teardown()
+
+	router := gin.New()
+	router.GET("/backup/:name/materialized", ListMaterizalized())
+	list := func(query string) (int, []MaterializedBackup, http.Header) {
+		req := httptest.NewRequest(http.MethodGet, "/backup/test/materialized?"+query, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		mbs := make([]MaterializedBackup, 0)
+		json.Unmarshal(w.Body.Bytes(), &mbs)
+		return w.Code, mbs, w.Header()
+	}
+	ids := func(mbs []MaterializedBackup) []string {
+		r := make([]string, 0)
+		for _, mb := range mbs {
+			r = append(r, mb.ID)
+		}
+		return r
+	}
+
+	createTestBackupSpec(t, BackupSpec{Name: "test", Periods: []RetentionPeriod{{Name: "quarterly", Unit: "month", Every: 3, Keep: 4}}})
+	//times written with different offsets must still be ordered by instant. b and c started at the same time
+	brt := time.FixedZone("BRT", -3*3600)
+	backups := []struct {
+		id     string
+		start  time.Time
+		status string
+	}{
+		{"a", time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC), "deleted"},
+		{"b", time.Date(2020, 1, 2, 7, 0, 0, 0, brt), "COMPLETED"},
+		{"c", time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC), "COMPLETED"},
+		{"d", time.Date(2020, 1, 2, 9, 0, 0, 0, brt), "delete-error"},
+		{"e", time.Date(2020, 1, 4, 10, 0, 0, 0, time.UTC), "COMPLETED"},
+	}
+	size := 1.0
+	for _, b := range backups {
+		id := b.id
+		require.Nil(t, store.CreateMaterializedBackup(id, "test", &id, b.status, b.start, b.start, &size, "", nil, nil))
+	}
+
+	code, mbs, h := list("")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{"e", "d", "c", "b", "a"}, ids(mbs))
+	assert.Equal(t, "5", h.Get("X-Total-Count"))
+	assert.Equal(t, "", h.Get("X-Next-Cursor"))
+
+	//walk all pages oldest first
+	all := make([]string, 0)
+	cursor := ""
+	for i := 0; i < 5; i++ {
+		code, mbs, h = list("sort=asc&limit=2&cursor=" + cursor)
+		require.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "5", h.Get("X-Total-Count"))
+		all = append(all, ids(mbs)...)
+		cursor = h.Get("X-Next-Cursor")
+		if cursor == "" {
+			break
+		}
+	}
+	assert.Equal(t, []string{"a", "b", "c", "d", "e"}, all)
+
+	_, mbs, h = list("status=COMPLETED,delete-error&from=2020-01-02T10:00:00Z&to=2020-01-03T00:00:00Z")
+	assert.Equal(t, []string{"d", "c", "b"}, ids(mbs))
+	assert.Equal(t, "3", h.Get("X-Total-Count"))
+	_, mbs, _ = list("status=deleted&status=delete-error")
+	assert.Equal(t, []string{"d", "a"}, ids(mbs))
+
+	require.Nil(t, tagAllBackups("test"))
+	code, mbs, _ = list("tag=quarterly")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{"e"}, ids(mbs))
+
+	for _, q := range []string{"tag=daily'%20OR%201=1", "tag=decennial", "limit=0", "limit=5000", "sort=up", "from=yesterday", "cursor=xyz"} {
+		code, _, _ = list(q)
+		assert.Equal(t, http.StatusBadRequest, code, q)
+	}
+}
@@ -0,0 +1,77 @@
+package backtor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+func (h *HTTPServer) setupRestoreHandlers() {
+	h.router.POST("/backup/:name/materialized/:id/restore", TriggerRestore())
+	h.router.GET("/backup/:name/restores", ListRestores())
+}
+
+//TriggerRestore launch a restore workflow for a materialized backup
+func TriggerRestore() func(*gin.Context) {
+	return func(c *gin.Context) {
+		logrus.Debugf("TriggerRestore")
+		bn := c.Param("name")
+		id := c.Param("id")
+
+		req := struct {
+			Target map[string]interface{} `json:"target"`
+		}{}
+		data, _ := ioutil.ReadAll(c.Request.Body)
+		if len(data) > 0 {
+			err := json.Unmarshal(data, &req)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Invalid restore request. err=%s", err)})
+				return
+			}
+		}
+
+		rid, err := triggerRestore(bn, id, req.Target)
+		if err != nil {
+			apiInvocationsCounter.WithLabelValues("restore", "error").Inc()
+			if re, ok := err.(restoreError); ok {
+				if re.conflict {
+					c.JSON(http.StatusConflict, gin.H{"message": re.Error()})
+					return
+				}
+				c.JSON(http.StatusNotFound, gin.H{"message": re.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"message": fmt.Sprintf("Error triggering restore. err=%s", err)})
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"message": fmt.Sprintf("Restore launched. id=%s", rid), "id": rid})
+		apiInvocationsCounter.WithLabelValues("restore", "success").Inc()
+	}
+}
+
+//ListRestores list restores of a backup spec
+func ListRestores() func(*gin.Context) {
+	return func(c *gin.Context) {
+		logrus.Debugf("ListRestores")
+		status := c.Query("status")
+		name := c.Param("name")
+
+		restores, err := store.GetRestores(name, status)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": fmt.Sprintf("Error getting restores. err=%s", err)})
+			apiInvocationsCounter.WithLabelValues("restore", "error").Inc()
+			return
+		}
+
+		loc := apiLocation(name)
+		for i := range restores {
+			localizeRestore(&restores[i], loc)
+		}
+		apiInvocationsCounter.WithLabelValues("restore", "success").Inc()
+		c.JSON(http.StatusOK, restores)
+	}
+}
@@ -0,0 +1,159 @@
+package backtor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+func (h *HTTPServer) setupRetentionHandlers() {
+	h.router.GET("/backup/:name/retention/preview", PreviewRetention())
+}
+
+//PreviewRetention shows the tags and keep/delete verdict of every materialized backup under the current retention policy,
+//or under the retention strings sent in the request body
+func PreviewRetention() func(*gin.Context) {
+	return func(c *gin.Context) {
+		logrus.Debugf("PreviewRetention")
+		name := c.Param("name")
+
+		bs, err := store.GetBackupSpec(name)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"message": fmt.Sprintf("Backup spec %s not found", name)})
+			return
+		}
+
+		proposed := struct {
+			RetentionMinutely *string            `json:"retentionMinutely"`
+			RetentionHourly   *string            `json:"retentionHourly"`
+			RetentionDaily    *string            `json:"retentionDaily"`
+			RetentionWeekly   *string            `json:"retentionWeekly"`
+			RetentionMonthly  *string            `json:"retentionMonthly"`
+			RetentionYearly   *string            `json:"retentionYearly"`
+			Periods           *[]RetentionPeriod `json:"periods"`
+			MaxTotalSizeMB    *float64           `json:"maxTotalSizeMB"`
+			MaxBackupCount    *int               `json:"maxBackupCount"`
+		}{}
+		data, _ := ioutil.ReadAll(c.Request.Body)
+		if len(data) > 0 {
+			err := json.Unmarshal(data, &proposed)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Invalid retention policy. err=%s", err)})
+				return
+			}
+		}
+		fields := []struct {
+			period string
+			value  *string
+			dest   *string
+		}{
+			{"minutely", proposed.RetentionMinutely, &bs.RetentionMinutely},
+			{"hourly", proposed.RetentionHourly, &bs.RetentionHourly},
+			{"daily", proposed.RetentionDaily, &bs.RetentionDaily},
+			{"weekly", proposed.RetentionWeekly, &bs.RetentionWeekly},
+			{"monthly", proposed.RetentionMonthly, &bs.RetentionMonthly},
+			{"yearly", proposed.RetentionYearly, &bs.RetentionYearly},
+		}
+		errs := make([]FieldError, 0)
+		for _, f := range fields {
+			if f.value == nil {
+				continue
+			}
+			err := checkRetention(f.period, *f.value)
+			if err != nil {
+				errs = append(errs, FieldError{Field: retentionField(f.period), Message: err.Error()})
+				continue
+			}
+			*f.dest = *f.value
+		}
+		if proposed.Periods != nil {
+			bs.Periods = *proposed.Periods
+			setBackupSpecDefaultValues(&bs)
+			err := checkRetentionPeriods(bs)
+			if err != nil {
+				errs = append(errs, FieldError{Field: "periods", Message: err.Error()})
+			}
+		}
+		if proposed.MaxTotalSizeMB != nil {
+			if *proposed.MaxTotalSizeMB < 0 {
+				errs = append(errs, FieldError{Field: "maxTotalSizeMB", Message: "'maxTotalSizeMB' must not be negative"})
+			}
+			bs.MaxTotalSizeMB = *proposed.MaxTotalSizeMB
+		}
+		if proposed.MaxBackupCount != nil {
+			if *proposed.MaxBackupCount < 0 {
+				errs = append(errs, FieldError{Field: "maxBackupCount", Message: "'maxBackupCount' must not be negative"})
+			}
+			bs.MaxBackupCount = *proposed.MaxBackupCount
+		}
+		if len(errs) > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid retention policy", "errors": errs})
+			return
+		}
+
+		items, err := previewRetention(bs)
+		if err != nil {
+			apiInvocationsCounter.WithLabelValues("retention", "error").Inc()
+			c.JSON(http.StatusInternalServerError, gin.H{"message": fmt.Sprintf("Error calculating retention preview. err=%s", err)})
+			return
+		}
+
+		summary := map[string]int{"keep": 0, "delete": 0, "ignored": 0}
+		loc := specTimezone(bs)
+		for i, it := range items {
+			summary[it.Verdict]++
+			localizeMaterialized(&items[i].MaterializedBackup, loc)
+		}
+		apiInvocationsCounter.WithLabelValues("retention", "success").Inc()
+		c.JSON(http.StatusOK, gin.H{
+			"retentionMinutely": bs.RetentionMinutely,
+			"retentionHourly":   bs.RetentionHourly,
+			"retentionDaily":    bs.RetentionDaily,
+			"retentionWeekly":   bs.RetentionWeekly,
+			"retentionMonthly":  bs.RetentionMonthly,
+			"retentionYearly":   bs.RetentionYearly,
+			"summary":           summary,
+			"materialized":      items,
+		})
+	}
+}
+
+//maxRetentionCount max backups retained per tag
+const maxRetentionCount = 10000
+
+//retentionReferences valid reference range of the retention string of each period: second of the minute, minute of the hour,
+//hour of the day, day of the week (0 is sunday), day of the month and month of the year
+var retentionReferences = map[string][2]int{
+	"minutely": {0, 59},
+	"hourly":   {0, 59},
+	"daily":    {0, 23},
+	"weekly":   {0, 6},
+	"monthly":  {1, 31},
+	"yearly":   {1, 12},
+}
+
+//checkRetention checks a "[count]" or "[count]@[reference]" retention string of a period. Reference is "L" or a number in the range of the period
+func checkRetention(period string, r string) error {
+	params := strings.Split(r, "@")
+	if len(params) > 2 {
+		return fmt.Errorf("Retention must be in the form '[count]@[reference]'")
+	}
+	count, err := strconv.Atoi(params[0])
+	if err != nil || count < 0 || count > maxRetentionCount {
+		return fmt.Errorf("Retention count must be a number between 0 and %d. value=%s", maxRetentionCount, params[0])
+	}
+	if len(params) == 2 && params[1] != "" && params[1] != "L" {
+		rg := retentionReferences[period]
+		ref, err := strconv.Atoi(params[1])
+		if err != nil || ref < rg[0] || ref > rg[1] {
+			return fmt.Errorf("Retention reference must be 'L' or a number between %d and %d. value=%s", rg[0], rg[1], params[1])
+		}
+	}
+	return nil
+}
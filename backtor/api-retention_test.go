@@ -0,0 +1,106 @@
+package backtor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/flaviostutz/backtor/backtor/backtortest"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetentionPreview(t *testing.T) {
+	conductor, teardown := setupTest(t)
+	defer teardown()
+
+	router := gin.New()
+	router.GET("/backup/:name/retention/preview", PreviewRetention())
+	preview := func(body string) (int, map[string]interface{}) {
+		req := httptest.NewRequest(http.MethodGet, "/backup/test/retention/preview", bytes.NewReader([]byte(body)))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		resp := make(map[string]interface{})
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+
+	createTestBackupSpec(t, BackupSpec{Name: "test", RetentionDaily: "5@L"})
+	for day := 6; day <= 9; day++ {
+		conductor.Script("create_backup", backtortest.Completed(fmt.Sprintf("data%d", day), 1))
+		d := day
+		conductor.Now = func() time.Time { return time.Date(2020, 1, d, 23, 0, 0, 0, time.UTC) }
+		runBackupCycle(t, "test")
+	}
+
+	code, resp := preview("")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]interface{}{"keep": 4.0, "delete": 0.0, "ignored": 0.0}, resp["summary"])
+
+	code, resp = preview(`{"retentionDaily": "1@L"}`)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "1@L", resp["retentionDaily"])
+	assert.Equal(t, map[string]interface{}{"keep": 2.0, "delete": 2.0, "ignored": 0.0}, resp["summary"])
+	for _, it := range resp["materialized"].([]interface{}) {
+		m := it.(map[string]interface{})
+		start, _ := time.Parse(time.RFC3339, m["startTime"].(string))
+		if start.Day() < 8 {
+			assert.Equal(t, "delete", m["verdict"], "day %d", start.Day())
+		} else {
+			assert.Equal(t, "keep", m["verdict"], "day %d", start.Day())
+		}
+	}
+
+	//preview must not change anything
+	assert.Equal(t, 4, len(materializedStatuses(t, "test")))
+	bs, err := store.GetBackupSpec("test")
+	require.Nil(t, err)
+	assert.Equal(t, "5@L", bs.RetentionDaily)
+
+	code, _ = preview(`{"retentionDaily": "x@L"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestRetentionPreviewPeriods(t *testing.T) {
+	conductor, teardown := setupTest(t)
+	defer teardown()
+
+	router := gin.New()
+	router.GET("/backup/:name/retention/preview", PreviewRetention())
+	preview := func(body string) (int, map[string]interface{}) {
+		req := httptest.NewRequest(http.MethodGet, "/backup/test/retention/preview", bytes.NewReader([]byte(body)))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		resp := make(map[string]interface{})
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+
+	createTestBackupSpec(t, BackupSpec{Name: "test", RetentionDaily: "0@L", RetentionWeekly: "0@L", RetentionMonthly: "0@L", RetentionYearly: "1@L"})
+	for month := 1; month <= 4; month++ {
+		conductor.Script("create_backup", backtortest.Completed(fmt.Sprintf("data%d", month), 1))
+		m := month
+		conductor.Now = func() time.Time { return time.Date(2020, time.Month(m), 15, 12, 0, 0, 0, time.UTC) }
+		runBackupCycle(t, "test")
+	}
+
+	code, resp := preview(`{"periods": [{"name": "semester", "unit": "month", "every": 6, "keep": 5}]}`)
+	require.Equal(t, http.StatusOK, code)
+	kept := 0
+	for _, it := range resp["materialized"].([]interface{}) {
+		m := it.(map[string]interface{})
+		if m["verdict"] == "keep" {
+			kept++
+			assert.Contains(t, m["tags"], "semester")
+		}
+	}
+	assert.Equal(t, 1, kept)
+
+	code, _ = preview(`{"periods": [{"name": "weekly", "unit": "week"}]}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
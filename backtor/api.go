@@ -37,6 +37,8 @@ func NewHTTPServer() *HTTPServer {
 		ValidateHeaders: false,
 	}))
 
+	router.Use(leaderOnly())
+
 	h := &HTTPServer{server: &http.Server{
 		Addr:    ":6000",
 		Handler: router,
@@ -47,6 +49,12 @@ func NewHTTPServer() *HTTPServer {
 	logrus.Infof("Initializing HTTP Handlers...")
 	h.setupMaterializedHandlers()
 	h.setupBackupSpecHandlers()
+	h.setupRestoreHandlers()
+	h.setupRetentionHandlers()
+	h.setupLeaderHandlers()
+	h.setupEventHandlers()
+	h.setupReconcilerHandlers()
+	h.setupMetricsHandlers()
 
 	return h
 }
@@ -0,0 +1,363 @@
+//Package backtortest provides an in-process fake Conductor server so that backtor can be exercised in tests without a real Conductor stack
+package backtortest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Workflow a workflow instance known by the fake Conductor
+type Workflow struct {
+	WorkflowID   string
+	WorkflowType string
+	Status       string
+	Input        map[string]interface{}
+	Output       map[string]interface{}
+	CreateTime   time.Time
+	EndTime      time.Time
+}
+
+//Outcome how a workflow instance finishes
+type Outcome struct {
+	Status string
+	Output map[string]interface{}
+}
+
+//Completed outcome of a successful workflow with the output expected from backup workers
+func Completed(dataID string, sizeMB float64) Outcome {
+	return Outcome{Status: "COMPLETED", Output: map[string]interface{}{"dataId": dataID, "dataSizeMB": sizeMB}}
+}
+
+//Full outcome of a create workflow that took a full backup of a full/incremental chain
+func Full(dataID string, sizeMB float64) Outcome {
+	return Outcome{Status: "COMPLETED", Output: map[string]interface{}{"dataId": dataID, "dataSizeMB": sizeMB, "backupType": "full"}}
+}
+
+//Incremental outcome of a create workflow that took an incremental backup on top of parentDataID
+func Incremental(dataID string, parentDataID string, sizeMB float64) Outcome {
+	return Outcome{Status: "COMPLETED", Output: map[string]interface{}{"dataId": dataID, "dataSizeMB": sizeMB, "backupType": "incremental", "parentDataId": parentDataID}}
+}
+
+//Failed outcome of a failed workflow
+func Failed() Outcome {
+	return Outcome{Status: "FAILED", Output: map[string]interface{}{}}
+}
+
+//TimedOut outcome of a workflow that timed out
+func TimedOut() Outcome {
+	return Outcome{Status: "TIMED_OUT", Output: map[string]interface{}{}}
+}
+
+//Running keeps a workflow in RUNNING status until Finish is called for it
+func Running() Outcome {
+	return Outcome{Status: "RUNNING"}
+}
+
+//Conductor fake Conductor API backed by httptest.Server
+type Conductor struct {
+	//Now returns the time used for workflow createTime and endTime. Defaults to time.Now
+	Now func() time.Time
+	//Unavailable makes every request fail with 503, like a Conductor that is down
+	Unavailable bool
+
+	server    *httptest.Server
+	mu        sync.Mutex
+	seq       int
+	workflows map[string]*Workflow
+	scripts   map[string][]Outcome
+	requests  map[string]int
+}
+
+//NewConductor starts a new fake Conductor server. Call Close when done
+func NewConductor() *Conductor {
+	c := &Conductor{
+		Now:       time.Now,
+		workflows: make(map[string]*Workflow),
+		scripts:   make(map[string][]Outcome),
+		requests:  make(map[string]int),
+	}
+	c.server = httptest.NewServer(http.HandlerFunc(c.serveHTTP))
+	return c
+}
+
+//URL base API URL to be used as backtor's --conductor-api-url
+func (c *Conductor) URL() string {
+	return c.server.URL
+}
+
+//Close stops the server
+func (c *Conductor) Close() {
+	c.server.Close()
+}
+
+//Script queues outcomes for the next instances of workflowType, in launch order.
+//Instances launched without a queued outcome stay RUNNING
+func (c *Conductor) Script(workflowType string, outcomes ...Outcome) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.scripts[workflowType] = append(c.scripts[workflowType], outcomes...)
+}
+
+//Finish sets the final outcome of a workflow instance
+func (c *Conductor) Finish(workflowID string, o Outcome) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	wf, ok := c.workflows[workflowID]
+	if !ok {
+		return fmt.Errorf("Workflow %s not found", workflowID)
+	}
+	c.apply(wf, o)
+	return nil
+}
+
+//Workflow returns a copy of a workflow instance
+func (c *Conductor) Workflow(workflowID string) (Workflow, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	wf, ok := c.workflows[workflowID]
+	if !ok {
+		return Workflow{}, false
+	}
+	return *wf, true
+}
+
+//Workflows returns all instances of workflowType (all types if empty) in launch order
+func (c *Conductor) Workflows(workflowType string) []Workflow {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	wfs := make([]Workflow, 0)
+	for _, wf := range c.sorted() {
+		if workflowType == "" || wf.WorkflowType == workflowType {
+			wfs = append(wfs, *wf)
+		}
+	}
+	return wfs
+}
+
+//Requests number of API requests served of a kind: launch, get, search or terminate
+func (c *Conductor) Requests(kind string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.requests[kind]
+}
+
+func (c *Conductor) count(kind string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests[kind]++
+}
+
+func (c *Conductor) apply(wf *Workflow, o Outcome) {
+	wf.Status = o.Status
+	if o.Output != nil {
+		wf.Output = o.Output
+	}
+	if o.Status != "RUNNING" {
+		wf.EndTime = c.Now()
+	}
+}
+
+func (c *Conductor) sorted() []*Workflow {
+	wfs := make([]*Workflow, 0, len(c.workflows))
+	for _, wf := range c.workflows {
+		wfs = append(wfs, wf)
+	}
+	sort.Slice(wfs, func(i, j int) bool {
+		return wfs[i].WorkflowID < wfs[j].WorkflowID
+	})
+	return wfs
+}
+
+func (c *Conductor) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if c.Unavailable {
+		http.Error(w, "conductor unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	path := strings.Trim(r.URL.Path, "/")
+	switch {
+	case path == "workflow" && r.Method == http.MethodPost:
+		c.count("launch")
+		c.launch(w, r)
+	case path == "workflow/search" && r.Method == http.MethodGet:
+		c.count("search")
+		c.search(w, r)
+	case strings.HasPrefix(path, "workflow/") && r.Method == http.MethodGet:
+		c.count("get")
+		c.get(w, strings.TrimPrefix(path, "workflow/"))
+	case strings.HasPrefix(path, "workflow/") && r.Method == http.MethodDelete:
+		c.count("terminate")
+		c.terminate(w, strings.TrimPrefix(path, "workflow/"), r.URL.Query().Get("reason"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (c *Conductor) launch(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name  string                 `json:"name"`
+		Input map[string]interface{} `json:"input"`
+	}
+	data, _ := ioutil.ReadAll(r.Body)
+	err := json.Unmarshal(data, &req)
+	if err != nil || req.Name == "" {
+		http.Error(w, "invalid workflow request", http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	wf := &Workflow{
+		WorkflowID:   fmt.Sprintf("wf-%06d", c.seq),
+		WorkflowType: req.Name,
+		Status:       "RUNNING",
+		Input:        req.Input,
+		Output:       map[string]interface{}{},
+		CreateTime:   c.Now(),
+	}
+	c.workflows[wf.WorkflowID] = wf
+	if outcomes := c.scripts[req.Name]; len(outcomes) > 0 {
+		c.scripts[req.Name] = outcomes[1:]
+		c.apply(wf, outcomes[0])
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(wf.WorkflowID))
+}
+
+func (c *Conductor) get(w http.ResponseWriter, workflowID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	wf, ok := c.workflows[workflowID]
+	if !ok {
+		http.Error(w, fmt.Sprintf("No such workflow found by id: %s", workflowID), http.StatusNotFound)
+		return
+	}
+	resp := map[string]interface{}{
+		"workflowId":   wf.WorkflowID,
+		"workflowType": wf.WorkflowType,
+		"status":       wf.Status,
+		"input":        wf.Input,
+		"output":       wf.Output,
+		"createTime":   millis(wf.CreateTime),
+	}
+	if !wf.EndTime.IsZero() {
+		resp["endTime"] = millis(wf.EndTime)
+	}
+	writeJSON(w, resp)
+}
+
+func (c *Conductor) terminate(w http.ResponseWriter, workflowID string, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	wf, ok := c.workflows[workflowID]
+	if !ok {
+		http.Error(w, fmt.Sprintf("No such workflow found by id: %s", workflowID), http.StatusNotFound)
+		return
+	}
+	if wf.Status == "RUNNING" {
+		c.apply(wf, Outcome{Status: "TERMINATED", Output: map[string]interface{}{"reason": reason}})
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//search supports the subset of freeText used by backtor: "backupName=X [AND [NOT ]status=Y]"
+//and the query "workflowId IN (id1,id2,...)"
+func (c *Conductor) search(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	size := 100
+	if s, err := strconv.Atoi(q.Get("size")); err == nil && s > 0 {
+		size = s
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	results := make([]map[string]interface{}, 0)
+	wfs := c.sorted()
+	sort.SliceStable(wfs, func(i, j int) bool {
+		return wfs[i].EndTime.After(wfs[j].EndTime)
+	})
+	for _, wf := range wfs {
+		if !matchFreeText(wf, q.Get("freeText")) || !matchQuery(wf, q.Get("query")) {
+			continue
+		}
+		input, _ := json.Marshal(wf.Input)
+		output, _ := json.Marshal(wf.Output)
+		res := map[string]interface{}{
+			"workflowId":   wf.WorkflowID,
+			"workflowType": wf.WorkflowType,
+			"status":       wf.Status,
+			"startTime":    wf.CreateTime.UTC().Format(time.RFC3339),
+			"input":        string(input),
+			"output":       string(output),
+		}
+		if !wf.EndTime.IsZero() {
+			res["endTime"] = wf.EndTime.UTC().Format(time.RFC3339)
+		}
+		results = append(results, res)
+	}
+	total := len(results)
+	if len(results) > size {
+		results = results[:size]
+	}
+	writeJSON(w, map[string]interface{}{"totalHits": total, "results": results})
+}
+
+func matchFreeText(wf *Workflow, freeText string) bool {
+	if freeText == "" || freeText == "*" {
+		return true
+	}
+	for _, cond := range strings.Split(freeText, " AND ") {
+		cond = strings.TrimSpace(cond)
+		negate := strings.HasPrefix(cond, "NOT ")
+		cond = strings.TrimPrefix(cond, "NOT ")
+		kv := strings.SplitN(cond, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := ""
+		if kv[0] == "status" {
+			value = wf.Status
+		} else if v, ok := wf.Input[kv[0]]; ok {
+			value = fmt.Sprintf("%v", v)
+		}
+		if (value == kv[1]) == negate {
+			return false
+		}
+	}
+	return true
+}
+
+func matchQuery(wf *Workflow, query string) bool {
+	if query == "" {
+		return true
+	}
+	if !strings.HasPrefix(query, "workflowId IN (") || !strings.HasSuffix(query, ")") {
+		return false
+	}
+	ids := strings.TrimSuffix(strings.TrimPrefix(query, "workflowId IN ("), ")")
+	for _, id := range strings.Split(ids, ",") {
+		if strings.TrimSpace(id) == wf.WorkflowID {
+			return true
+		}
+	}
+	return false
+}
+
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
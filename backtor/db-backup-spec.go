@@ -1,11 +1,12 @@
 package backtor
 
 import (
+	"database/sql"
+	"encoding/json"
 	"fmt"
 	"strings"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
 	"github.com/sirupsen/logrus"
 )
 
@@ -26,46 +27,211 @@ type BackupSpec struct {
 	RetentionWeekly         string     `json:"retentionWeekly,omitempty"`
 	RetentionMonthly        string     `json:"retentionMonthly,omitempty"`
 	RetentionYearly         string     `json:"retentionYearly,omitempty"`
+	Purging                 int        `json:"purging,omitempty"`
+	VerifyCronString        *string    `json:"verifyCronString,omitempty"`
+	VerifySampleSize        int        `json:"verifySampleSize,omitempty"`
+	//ManagedBy "file" for specs loaded from --specs-dir. They can't be changed through the API
+	ManagedBy string `json:"managedBy,omitempty"`
+	//ReplicationTargets secondary destinations that receive a copy of each new backup
+	ReplicationTargets []ReplicationTarget `json:"replicationTargets,omitempty"`
+	//IncrementalCronString schedule of incremental backups. When set, backupCronString schedules full backups
+	IncrementalCronString *string `json:"incrementalCronString,omitempty"`
+	//Notify notification channels of this spec
+	Notify *NotifyConfig `json:"notify,omitempty"`
+	//MisfirePolicy what to do with backups of the main schedule missed while no replica was leading: "skip", "run-once" or "run-all"
+	MisfirePolicy string `json:"misfirePolicy,omitempty"`
+	//MisfireMaxRuns max backups launched for missed windows with "run-all"
+	MisfireMaxRuns int `json:"misfireMaxRuns,omitempty"`
+	//LastScheduledTime last time the main schedule fired or was caught up
+	LastScheduledTime *time.Time `json:"lastScheduledTime,omitempty"`
+	//CatchupPending catch-up backups still to be launched
+	CatchupPending int `json:"catchupPending,omitempty"`
+	//Timezone IANA time zone of the cron schedules, of the tagging boundaries and of times shown by the API
+	Timezone string `json:"timezone,omitempty"`
+	//Periods custom retention periods, besides minutely...yearly
+	Periods []RetentionPeriod `json:"periods,omitempty"`
+	//MaxTotalSizeMB max total size of the retained backups. Retention deletes the oldest, lowest tier backups above it. 0 is unlimited
+	MaxTotalSizeMB float64 `json:"maxTotalSizeMB,omitempty"`
+	//MaxBackupCount max number of retained backups. 0 is unlimited
+	MaxBackupCount int `json:"maxBackupCount,omitempty"`
 }
 
-func createBackupSpec(bs BackupSpec) error {
-	stmt, err1 := db.Prepare(`INSERT INTO backup_spec (
-								name, enabled, running_create_workflow,
-								from_date, to_date, last_update, 
-								retention_minutely, retention_hourly, retention_daily, retention_weekly, 
-								retention_monthly, retention_yearly, backup_cron_string,
-								worker_config, timeout_seconds
-							) values(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?);`)
-	if err1 != nil {
-		return err1
+//RetentionPeriod custom retention period. Time is split in consecutive periods of 'every' units and the newest backup
+//of each period gets the period's name as tag. Ex.: unit "month", every 3 for quarters; unit "month", every 12, offset 3 for fiscal years starting in april
+type RetentionPeriod struct {
+	Name string `json:"name"`
+	//Unit "minute", "hour", "day", "week" (starting on monday), "month" or "year"
+	Unit string `json:"unit"`
+	//Every length of the period in units. Defaults to 1
+	Every int `json:"every,omitempty"`
+	//Offset units the start of the periods is shifted by. Must be less than 'every'
+	Offset int `json:"offset,omitempty"`
+	//Keep number of backups of this period to be retained
+	Keep int `json:"keep"`
+}
+
+//ReplicationTarget secondary destination of backup copies, with its own retention policy
+type ReplicationTarget struct {
+	Name string `json:"name"`
+	//WorkerConfig sent to replicate and remove workflows of this target. Defaults to the spec's workerConfig
+	WorkerConfig      *string `json:"workerConfig,omitempty"`
+	RetentionMinutely string  `json:"retentionMinutely,omitempty"`
+	RetentionHourly   string  `json:"retentionHourly,omitempty"`
+	RetentionDaily    string  `json:"retentionDaily,omitempty"`
+	RetentionWeekly   string  `json:"retentionWeekly,omitempty"`
+	RetentionMonthly  string  `json:"retentionMonthly,omitempty"`
+	RetentionYearly   string  `json:"retentionYearly,omitempty"`
+}
+
+const backupSpecColumns = `name, enabled, running_create_workflow,
+			from_date, to_date, last_update,
+			retention_minutely, retention_hourly, retention_daily, retention_weekly,
+			retention_monthly, retention_yearly, backup_cron_string,
+			worker_config, timeout_seconds, purging,
+			verify_cron_string, verify_sample_size, managed_by,
+			replication_targets, incremental_cron_string, notify,
+			misfire_policy, misfire_max_runs, last_scheduled_time, catchup_pending,
+			timezone, periods, max_total_size_mb, max_backup_count`
+
+func scanBackupSpec(rows *sql.Rows) (BackupSpec, error) {
+	b := BackupSpec{}
+	var targets sql.NullString
+	var notify sql.NullString
+	var periods sql.NullString
+	err := rows.Scan(&b.Name, &b.Enabled, &b.RunningCreateWorkflowID,
+		&b.FromDate, &b.ToDate, &b.LastUpdate,
+		&b.RetentionMinutely, &b.RetentionHourly, &b.RetentionDaily, &b.RetentionWeekly,
+		&b.RetentionMonthly, &b.RetentionYearly, &b.BackupCronString,
+		&b.WorkerConfig, &b.TimeoutSeconds, &b.Purging,
+		&b.VerifyCronString, &b.VerifySampleSize, &b.ManagedBy,
+		&targets, &b.IncrementalCronString, &notify,
+		&b.MisfirePolicy, &b.MisfireMaxRuns, &b.LastScheduledTime, &b.CatchupPending,
+		&b.Timezone, &periods, &b.MaxTotalSizeMB, &b.MaxBackupCount)
+	if err != nil {
+		return b, err
+	}
+	if periods.Valid && periods.String != "" {
+		err = json.Unmarshal([]byte(periods.String), &b.Periods)
+		if err != nil {
+			return b, err
+		}
+	}
+	if targets.Valid && targets.String != "" {
+		err = json.Unmarshal([]byte(targets.String), &b.ReplicationTargets)
+		if err != nil {
+			return b, err
+		}
+	}
+	if notify.Valid && notify.String != "" {
+		b.Notify = &NotifyConfig{}
+		err = json.Unmarshal([]byte(notify.String), b.Notify)
+	}
+	return b, err
+}
+
+//notifyColumn JSON stored in notify
+func notifyColumn(bs BackupSpec) (*string, error) {
+	if bs.Notify == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(bs.Notify)
+	if err != nil {
+		return nil, err
+	}
+	s := string(data)
+	return &s, nil
+}
+
+//periodsColumn JSON stored in periods
+func periodsColumn(bs BackupSpec) (*string, error) {
+	if len(bs.Periods) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(bs.Periods)
+	if err != nil {
+		return nil, err
 	}
-	_, err2 := stmt.Exec(bs.Name, bs.Enabled, bs.RunningCreateWorkflowID,
+	s := string(data)
+	return &s, nil
+}
+
+//replicationTargetsColumn JSON stored in replication_targets
+func replicationTargetsColumn(bs BackupSpec) (*string, error) {
+	if len(bs.ReplicationTargets) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(bs.ReplicationTargets)
+	if err != nil {
+		return nil, err
+	}
+	s := string(data)
+	return &s, nil
+}
+
+//CreateBackupSpec inserts a new backup spec
+func (s *sqlStore) CreateBackupSpec(bs BackupSpec) error {
+	targets, err := replicationTargetsColumn(bs)
+	if err != nil {
+		return err
+	}
+	notify, err := notifyColumn(bs)
+	if err != nil {
+		return err
+	}
+	periods, err := periodsColumn(bs)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec(`INSERT INTO backup_spec (`+backupSpecColumns+`
+							) values(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?);`,
+		bs.Name, bs.Enabled, bs.RunningCreateWorkflowID,
 		bs.FromDate, bs.ToDate, bs.LastUpdate,
 		bs.RetentionMinutely, bs.RetentionHourly, bs.RetentionDaily, bs.RetentionWeekly,
 		bs.RetentionMonthly, bs.RetentionYearly, bs.BackupCronString,
-		bs.WorkerConfig, bs.TimeoutSeconds)
-	if err2 != nil {
-		return err2
-	}
-	return nil
+		bs.WorkerConfig, bs.TimeoutSeconds, bs.Purging,
+		bs.VerifyCronString, bs.VerifySampleSize, bs.ManagedBy,
+		targets, bs.IncrementalCronString, notify,
+		bs.MisfirePolicy, bs.MisfireMaxRuns, bs.LastScheduledTime, bs.CatchupPending,
+		bs.Timezone, periods, bs.MaxTotalSizeMB, bs.MaxBackupCount)
+	return err
 }
 
-func updateBackupSpec(bs BackupSpec) error {
-	stmt, err1 := db.Prepare(`UPDATE backup_spec SET
-								name=?, enabled=?, running_create_workflow=?,
-								from_date=?, to_date=?, last_update=?, 
-								retention_minutely=?, retention_hourly=?, retention_daily=?, retention_weekly=?, 
-								retention_monthly=?, retention_yearly=?, backup_cron_string=?,
-								worker_config=?, timeout_seconds=?
-							  WHERE name='` + bs.Name + `';`)
-	if err1 != nil {
-		return err1
+//UpdateBackupSpec updates the definition of an existing backup spec. The running create workflow, the purge flag and the schedule state
+//(last scheduled time and pending catch-ups) are kept, as they are only changed by the tasks that track them
+func (s *sqlStore) UpdateBackupSpec(bs BackupSpec) error {
+	targets, err := replicationTargetsColumn(bs)
+	if err != nil {
+		return err
+	}
+	notify, err := notifyColumn(bs)
+	if err != nil {
+		return err
 	}
-	resp, err2 := stmt.Exec(bs.Name, bs.Enabled, bs.RunningCreateWorkflowID,
+	periods, err := periodsColumn(bs)
+	if err != nil {
+		return err
+	}
+	resp, err2 := s.exec(`UPDATE backup_spec SET
+								enabled=?,
+								from_date=?, to_date=?, last_update=?,
+								retention_minutely=?, retention_hourly=?, retention_daily=?, retention_weekly=?,
+								retention_monthly=?, retention_yearly=?, backup_cron_string=?,
+								worker_config=?, timeout_seconds=?,
+								verify_cron_string=?, verify_sample_size=?, managed_by=?,
+								replication_targets=?, incremental_cron_string=?, notify=?,
+								misfire_policy=?, misfire_max_runs=?, timezone=?, periods=?,
+								max_total_size_mb=?, max_backup_count=?
+							  WHERE name=?;`,
+		bs.Enabled,
 		bs.FromDate, bs.ToDate, bs.LastUpdate,
 		bs.RetentionMinutely, bs.RetentionHourly, bs.RetentionDaily, bs.RetentionWeekly,
 		bs.RetentionMonthly, bs.RetentionYearly, bs.BackupCronString,
-		bs.WorkerConfig, bs.TimeoutSeconds)
+		bs.WorkerConfig, bs.TimeoutSeconds,
+		bs.VerifyCronString, bs.VerifySampleSize, bs.ManagedBy,
+		targets, bs.IncrementalCronString, notify,
+		bs.MisfirePolicy, bs.MisfireMaxRuns, bs.Timezone, periods,
+		bs.MaxTotalSizeMB, bs.MaxBackupCount,
+		bs.Name)
 	if err2 != nil {
 		return err2
 	}
@@ -81,26 +247,16 @@ func updateBackupSpec(bs BackupSpec) error {
 	return nil
 }
 
-func getBackupSpec(backupName string) (BackupSpec, error) {
-	rows, err1 := db.Query(`SELECT 
-			name, enabled, running_create_workflow,
-			from_date, to_date, last_update, 
-			retention_minutely, retention_hourly, retention_daily, retention_weekly, 
-			retention_monthly, retention_yearly, backup_cron_string,
-			worker_config, timeout_seconds
-			FROM backup_spec WHERE name='` + backupName + `';`)
+//GetBackupSpec loads a backup spec by name
+func (s *sqlStore) GetBackupSpec(backupName string) (BackupSpec, error) {
+	rows, err1 := s.query(`SELECT `+backupSpecColumns+` FROM backup_spec WHERE name=?;`, backupName)
 	if err1 != nil {
 		return BackupSpec{}, err1
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		b := BackupSpec{}
-		err2 := rows.Scan(&b.Name, &b.Enabled, &b.RunningCreateWorkflowID,
-			&b.FromDate, &b.ToDate, &b.LastUpdate,
-			&b.RetentionMinutely, &b.RetentionHourly, &b.RetentionDaily, &b.RetentionWeekly,
-			&b.RetentionMonthly, &b.RetentionYearly, &b.BackupCronString,
-			&b.WorkerConfig, &b.TimeoutSeconds)
+		b, err2 := scanBackupSpec(rows)
 		if err2 != nil {
 			return BackupSpec{}, err2
 		}
@@ -113,21 +269,15 @@ func getBackupSpec(backupName string) (BackupSpec, error) {
 	return BackupSpec{}, fmt.Errorf("Backup spec name %s not found", backupName)
 }
 
-func listBackupSpecs(enabled *int) ([]BackupSpec, error) {
+//ListBackupSpecs lists all backup specs, optionally filtering by enabled
+func (s *sqlStore) ListBackupSpecs(enabled *int) ([]BackupSpec, error) {
 	where := ""
+	args := []interface{}{}
 	if enabled != nil {
-		where = fmt.Sprintf("WHERE enabled=%d", *enabled)
+		where = "WHERE enabled=?"
+		args = append(args, *enabled)
 	}
-	q := `SELECT 
-			name, enabled, running_create_workflow,
-			from_date, to_date, last_update, 
-			retention_minutely, retention_hourly, retention_daily, retention_weekly, 
-			retention_monthly, retention_yearly, backup_cron_string,
-			worker_config, timeout_seconds
-		FROM backup_spec ` + where + ` ORDER BY name;`
-
-	logrus.Debugf("query=%s", q)
-	rows, err1 := db.Query(q)
+	rows, err1 := s.query(`SELECT `+backupSpecColumns+` FROM backup_spec `+where+` ORDER BY name;`, args...)
 	if err1 != nil {
 		return []BackupSpec{}, err1
 	}
@@ -135,12 +285,7 @@ func listBackupSpecs(enabled *int) ([]BackupSpec, error) {
 
 	var backups = make([]BackupSpec, 0)
 	for rows.Next() {
-		b := BackupSpec{}
-		err2 := rows.Scan(&b.Name, &b.Enabled, &b.RunningCreateWorkflowID,
-			&b.FromDate, &b.ToDate, &b.LastUpdate,
-			&b.RetentionMinutely, &b.RetentionHourly, &b.RetentionDaily, &b.RetentionWeekly,
-			&b.RetentionMonthly, &b.RetentionYearly, &b.BackupCronString,
-			&b.WorkerConfig, &b.TimeoutSeconds)
+		b, err2 := scanBackupSpec(rows)
 		if err2 != nil {
 			return []BackupSpec{}, err2
 		}
@@ -153,14 +298,10 @@ func listBackupSpecs(enabled *int) ([]BackupSpec, error) {
 	return backups, nil
 }
 
-func deleteBackupSpec(backupName string) error {
+//DeleteBackupSpec deletes a backup spec row
+func (s *sqlStore) DeleteBackupSpec(backupName string) error {
 	logrus.Debugf("Deleting backup %s", backupName)
-	stmt, err1 := db.Prepare(`DELETE backup_spec 
-							  WHERE name='` + backupName + `';`)
-	if err1 != nil {
-		return err1
-	}
-	res, err2 := stmt.Exec()
+	res, err2 := s.exec(`DELETE FROM backup_spec WHERE name=?;`, backupName)
 	if err2 != nil {
 		return err2
 	}
@@ -175,22 +316,32 @@ func deleteBackupSpec(backupName string) error {
 	return nil
 }
 
-func updateBackupSpecRunningCreateWorkflowID(backupName string, runningCreateWorkflowID *string) error {
+//SetBackupSpecPurging disables a backup spec and marks it as being purged
+func (s *sqlStore) SetBackupSpecPurging(backupName string) error {
+	logrus.Debugf("Marking backup spec %s for purge", backupName)
+	res, err2 := s.exec(`UPDATE backup_spec SET enabled=0, purging=1 WHERE name=?;`, backupName)
+	if err2 != nil {
+		return err2
+	}
+	count, err3 := res.RowsAffected()
+	if err3 != nil {
+		return err3
+	}
+	if count != 1 {
+		return fmt.Errorf("Backup spec %s was not marked for purge. count=%d", backupName, count)
+	}
+	return nil
+}
+
+//UpdateBackupSpecRunningCreateWorkflowID sets or clears (nil) the create workflow currently running for a backup spec
+func (s *sqlStore) UpdateBackupSpecRunningCreateWorkflowID(backupName string, runningCreateWorkflowID *string) error {
 	if runningCreateWorkflowID == nil {
 		logrus.Debugf("Setting running_create_workflow of backup spec %s to nil", backupName)
 	} else {
 		logrus.Debugf("Setting running_create_workflow of backup spec %s to %s", backupName, *runningCreateWorkflowID)
 	}
 
-	workflowid := "NULL"
-	if runningCreateWorkflowID != nil {
-		workflowid = fmt.Sprintf("'%s'", *runningCreateWorkflowID)
-	}
-	stmt, err1 := db.Prepare(fmt.Sprintf("UPDATE backup_spec SET running_create_workflow=%s WHERE name='%s';", workflowid, backupName))
-	if err1 != nil {
-		return err1
-	}
-	res, err2 := stmt.Exec()
+	res, err2 := s.exec("UPDATE backup_spec SET running_create_workflow=? WHERE name=?;", runningCreateWorkflowID, backupName)
 	if err2 != nil {
 		return err2
 	}
@@ -206,6 +357,46 @@ func updateBackupSpecRunningCreateWorkflowID(backupName string, runningCreateWor
 	return nil
 }
 
+//ClearBackupSpecRunningCreateWorkflowID clears the running create workflow of a backup spec only if it is still workflowID.
+//Returns false if it was already cleared or replaced by a newer workflow
+func (s *sqlStore) ClearBackupSpecRunningCreateWorkflowID(backupName string, workflowID string) (bool, error) {
+	logrus.Debugf("Clearing running_create_workflow %s of backup spec %s", workflowID, backupName)
+	res, err := s.exec("UPDATE backup_spec SET running_create_workflow=NULL WHERE name=? AND running_create_workflow=?;", backupName, workflowID)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return count == 1, nil
+}
+
+//UpdateBackupSpecLastScheduledTime records the last time the main schedule of a backup spec fired or was checked for missed windows
+func (s *sqlStore) UpdateBackupSpecLastScheduledTime(backupName string, lastScheduledTime time.Time) error {
+	return s.updateBackupSpecColumn(backupName, "last_scheduled_time", lastScheduledTime)
+}
+
+//UpdateBackupSpecCatchupPending sets how many catch-up backups are still to be launched for a backup spec
+func (s *sqlStore) UpdateBackupSpecCatchupPending(backupName string, catchupPending int) error {
+	return s.updateBackupSpecColumn(backupName, "catchup_pending", catchupPending)
+}
+
+func (s *sqlStore) updateBackupSpecColumn(backupName string, column string, value interface{}) error {
+	res, err2 := s.exec("UPDATE backup_spec SET "+column+"=? WHERE name=?;", value, backupName)
+	if err2 != nil {
+		return err2
+	}
+	count, err3 := res.RowsAffected()
+	if err3 != nil {
+		return err3
+	}
+	if count != 1 {
+		return fmt.Errorf("%s of backup spec %s was not updated. count=%d", column, backupName, count)
+	}
+	return nil
+}
+
 func retentionParams(config string, lastReference string) []string {
 	if config == "" {
 		return []string{"0", lastReference}
@@ -0,0 +1,53 @@
+package backtor
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetentionParams0(t *testing.T) {
+	r := retentionParams("", "a")
+	assert.Equal(t, []string{"0", "a"}, r, "0")
+}
+
+func TestRetentionParams1(t *testing.T) {
+	r := retentionParams("0", "111")
+	assert.Equal(t, []string{"0", "111"}, r, "0")
+}
+
+func TestRetentionParams2(t *testing.T) {
+	r := retentionParams("0@", "bbb")
+	assert.Equal(t, []string{"0", "bbb"}, r, "0@")
+}
+
+func TestRetentionParams3(t *testing.T) {
+	r := retentionParams("0@32", "43")
+	assert.Equal(t, []string{"0", "32"}, r, "0@32")
+}
+
+func TestRetentionParams4(t *testing.T) {
+	r := retentionParams("34", "L")
+	assert.Equal(t, []string{"34", "L"}, r, "34")
+}
+
+func TestUpdateBackupSpecKeepsRunningState(t *testing.T) {
+	_, teardown := setupTest(t)
+	defer teardown()
+
+	//a snapshot taken before the create workflow was launched and the purge started
+	stale := createTestBackupSpec(t, BackupSpec{Name: "test"})
+	wid := "wf-1"
+	require.Nil(t, store.UpdateBackupSpecRunningCreateWorkflowID("test", &wid))
+	require.Nil(t, store.SetBackupSpecPurging("test"))
+
+	stale.RetentionDaily = "3@L"
+	require.Nil(t, store.UpdateBackupSpec(stale))
+	bs, err := store.GetBackupSpec("test")
+	require.Nil(t, err)
+	assert.Equal(t, "3@L", bs.RetentionDaily)
+	require.NotNil(t, bs.RunningCreateWorkflowID)
+	assert.Equal(t, wid, *bs.RunningCreateWorkflowID)
+	assert.Equal(t, 1, bs.Purging)
+}
@@ -0,0 +1,67 @@
+package backtor
+
+import (
+	"fmt"
+	"time"
+)
+
+//Catchup record of missed schedule windows of a backup spec (action "missed") or of a backup launched for one of them (action "run")
+type Catchup struct {
+	ID         string `json:"id"`
+	BackupName string `json:"backupName"`
+	Action     string `json:"action"`
+	Policy     string `json:"policy"`
+	//MissedCount windows missed ("missed") or 1 for the window covered by a catch-up backup ("run")
+	MissedCount int        `json:"missedCount"`
+	FirstMissed *time.Time `json:"firstMissed,omitempty"`
+	LastMissed  *time.Time `json:"lastMissed,omitempty"`
+	WorkflowID  *string    `json:"workflowId,omitempty"`
+	Time        time.Time  `json:"time"`
+}
+
+//CreateCatchup inserts a new catch-up record
+func (s *sqlStore) CreateCatchup(c Catchup) error {
+	if c.ID == "" {
+		return fmt.Errorf("'id' must be defined")
+	}
+	_, err := s.exec("INSERT INTO catchup (id, backup_name, action, policy, missed_count, first_missed, last_missed, workflow_id, time) values(?,?,?,?,?,?,?,?,?)",
+		c.ID, c.BackupName, c.Action, c.Policy, c.MissedCount, c.FirstMissed, c.LastMissed, c.WorkflowID, c.Time)
+	return err
+}
+
+//GetCatchups lists catch-up records of a backup spec (of all specs if backupName is empty), newest first
+func (s *sqlStore) GetCatchups(backupName string) ([]Catchup, error) {
+	q := "SELECT id,backup_name,action,policy,missed_count,first_missed,last_missed,workflow_id,time FROM catchup WHERE 1=1"
+	args := []interface{}{}
+	if backupName != "" {
+		q = q + " AND backup_name=?"
+		args = append(args, backupName)
+	}
+	q = q + " ORDER BY time DESC, id DESC"
+	rows, err1 := s.query(q, args...)
+	if err1 != nil {
+		return []Catchup{}, err1
+	}
+	defer rows.Close()
+
+	var catchups = make([]Catchup, 0)
+	for rows.Next() {
+		c := Catchup{}
+		err2 := rows.Scan(&c.ID, &c.BackupName, &c.Action, &c.Policy, &c.MissedCount, &c.FirstMissed, &c.LastMissed, &c.WorkflowID, &c.Time)
+		if err2 != nil {
+			return []Catchup{}, err2
+		}
+		catchups = append(catchups, c)
+	}
+	err := rows.Err()
+	if err != nil {
+		return []Catchup{}, err
+	}
+	return catchups, nil
+}
+
+//DeleteCatchups deletes all catch-up records of a backup spec
+func (s *sqlStore) DeleteCatchups(backupName string) error {
+	_, err := s.exec("DELETE FROM catchup WHERE backup_name=?", backupName)
+	return err
+}
@@ -0,0 +1,45 @@
+package backtor
+
+import (
+	"time"
+)
+
+//SaveWorkflowEvent records an event as processed. Returns false if it was already recorded
+func (s *sqlStore) SaveWorkflowEvent(id string, workflowID string, status string, receivedAt time.Time) (bool, error) {
+	processed, err := s.IsWorkflowEventProcessed(id)
+	if err != nil {
+		return false, err
+	}
+	if processed {
+		return false, nil
+	}
+	_, err = s.exec("INSERT INTO workflow_event (id, workflow_id, status, received_at) VALUES (?,?,?,?)", id, workflowID, status, unixMillis(receivedAt))
+	if err != nil {
+		//a concurrent delivery of the same event was recorded first
+		processed, err1 := s.IsWorkflowEventProcessed(id)
+		if err1 == nil && processed {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+//IsWorkflowEventProcessed whether an event id was already recorded
+func (s *sqlStore) IsWorkflowEventProcessed(id string) (bool, error) {
+	rows, err := s.query("SELECT id FROM workflow_event WHERE id=?", id)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	if rows.Next() {
+		return true, nil
+	}
+	return false, rows.Err()
+}
+
+//DeleteWorkflowEventsBefore forgets events received before t
+func (s *sqlStore) DeleteWorkflowEventsBefore(t time.Time) error {
+	_, err := s.exec("DELETE FROM workflow_event WHERE received_at<?", unixMillis(t))
+	return err
+}
@@ -0,0 +1,82 @@
+package backtor
+
+import (
+	"database/sql"
+	"time"
+)
+
+//Lease current holder of a named lease
+type Lease struct {
+	Name      string    `json:"name"`
+	Holder    string    `json:"holder"`
+	Address   *string   `json:"address,omitempty"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+//AcquireLease takes or renews the lease for holder if it is free, expired or already held by holder.
+//Expiration is stored as unix millis so that the comparison is done the same way by all databases
+func (s *sqlStore) AcquireLease(name string, holder string, address *string, now time.Time, ttl time.Duration) (bool, error) {
+	nowMillis := unixMillis(now)
+	expires := unixMillis(now.Add(ttl))
+
+	res, err := s.exec("UPDATE leader_lease SET holder=?, address=?, expires_at=? WHERE name=? AND (holder=? OR expires_at<?)", holder, address, expires, name, holder, nowMillis)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if n > 0 {
+		return true, nil
+	}
+
+	_, err = s.GetLease(name)
+	if err == nil {
+		//held by somebody else
+		return false, nil
+	}
+	if err != sql.ErrNoRows {
+		return false, err
+	}
+	_, err = s.exec("INSERT INTO leader_lease (name, holder, address, expires_at) VALUES (?,?,?,?)", name, holder, address, expires)
+	if err != nil {
+		//another replica inserted it first
+		return false, nil
+	}
+	return true, nil
+}
+
+//ReleaseLease expires the lease if it is held by holder so that another replica can take it right away
+func (s *sqlStore) ReleaseLease(name string, holder string) error {
+	_, err := s.exec("UPDATE leader_lease SET expires_at=0 WHERE name=? AND holder=?", name, holder)
+	return err
+}
+
+//GetLease current lease state. Returns sql.ErrNoRows if the lease was never taken
+func (s *sqlStore) GetLease(name string) (Lease, error) {
+	rows, err := s.query("SELECT name, holder, address, expires_at FROM leader_lease WHERE name=?", name)
+	if err != nil {
+		return Lease{}, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		err = rows.Err()
+		if err != nil {
+			return Lease{}, err
+		}
+		return Lease{}, sql.ErrNoRows
+	}
+	l := Lease{}
+	var expires int64
+	err = rows.Scan(&l.Name, &l.Holder, &l.Address, &expires)
+	if err != nil {
+		return Lease{}, err
+	}
+	l.ExpiresAt = time.Unix(0, expires*int64(time.Millisecond))
+	return l, nil
+}
+
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -3,9 +3,9 @@ package backtor
 import (
 	"database/sql"
 	"fmt"
+	"strings"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 )
@@ -27,268 +27,551 @@ type MaterializedBackup struct {
 	EndTime                 time.Time `json:"endTime"`
 	SizeMB                  float64   `json:"sizeMB"`
 	RunningDeleteWorkflowID *string   `json:"runningDeleteWorkflowId,omitempty"`
-	Reference               int       `json:"reference"`
-	Minutely                int       `json:"minutely"`
-	Hourly                  int       `json:"hourly"`
-	Daily                   int       `json:"daily"`
-	Weekly                  int       `json:"weekly"`
-	Monthly                 int       `json:"monthly"`
-	Yearly                  int       `json:"yearly"`
+	//Tags "reference" and the retention periods the backup was elected for, from the finest to the coarsest period
+	Tags                    []string   `json:"tags"`
+	RunningVerifyWorkflowID *string    `json:"runningVerifyWorkflowId,omitempty"`
+	VerifyStatus            *string    `json:"verifyStatus,omitempty"`
+	VerifyChecksum          *string    `json:"verifyChecksum,omitempty"`
+	VerifyTime              *time.Time `json:"verifyTime,omitempty"`
+	//Checksum of the backup contents reported by the create workflow. Verifications must report the same one
+	Checksum *string `json:"checksum,omitempty"`
+	//Target replication target of a replica. Empty for backups created by the backup spec itself
+	Target string `json:"target,omitempty"`
+	//SourceID materialized backup a replica was copied from
+	SourceID *string `json:"sourceId,omitempty"`
+	//BackupType "full" or "incremental", as reported by the create workflow. Empty for standalone backups
+	BackupType string `json:"backupType,omitempty"`
+	//ParentDataID dataId of the backup an incremental backup depends on
+	ParentDataID *string `json:"parentDataId,omitempty"`
+	//HoldBy who placed a legal hold on the backup. Held backups are never deleted by retention
+	HoldBy     *string    `json:"holdBy,omitempty"`
+	HoldReason *string    `json:"holdReason,omitempty"`
+	HoldTime   *time.Time `json:"holdTime,omitempty"`
+	//HoldUntil optional expiry of the hold
+	HoldUntil *time.Time `json:"holdUntil,omitempty"`
 }
 
-func createMaterializedBackup(id string, backupName string, dataID *string, status string, startDate time.Time, endDate time.Time, size *float64) error {
-	if id == "" {
-		return fmt.Errorf("'id' must be defined")
+//isHeld whether the backup has a legal hold that hasn't expired at now
+func isHeld(mb MaterializedBackup, now time.Time) bool {
+	return mb.HoldBy != nil && (mb.HoldUntil == nil || now.Before(*mb.HoldUntil))
+}
+
+//materializedTags tags of the built-in retention periods, from the lowest to the highest tier
+var materializedTags = []string{"minutely", "hourly", "daily", "weekly", "monthly", "yearly"}
+
+//tagsQueryBatch max materialized backups whose tags are loaded in a single query
+const tagsQueryBatch = 500
+
+const materializedColumns = "id,data_id,status,backup_name,start_time,end_time,running_delete_workflow,size,running_verify_workflow,verify_status,verify_checksum,verify_time,checksum,target,source_id,backup_type,parent_data_id,hold_by,hold_reason,hold_time,hold_until"
+
+func scanMaterializedBackup(rows *sql.Rows) (MaterializedBackup, error) {
+	m := MaterializedBackup{Tags: []string{}}
+	err := rows.Scan(&m.ID, &m.DataID, &m.Status, &m.BackupName, &m.StartTime, &m.EndTime, &m.RunningDeleteWorkflowID, &m.SizeMB, &m.RunningVerifyWorkflowID, &m.VerifyStatus, &m.VerifyChecksum, &m.VerifyTime, &m.Checksum, &m.Target, &m.SourceID, &m.BackupType, &m.ParentDataID, &m.HoldBy, &m.HoldReason, &m.HoldTime, &m.HoldUntil)
+	return m, err
+}
+
+func scanMaterializedBackups(rows *sql.Rows) ([]MaterializedBackup, error) {
+	var mbs = make([]MaterializedBackup, 0)
+	for rows.Next() {
+		m, err2 := scanMaterializedBackup(rows)
+		if err2 != nil {
+			return []MaterializedBackup{}, err2
+		}
+		mbs = append(mbs, m)
 	}
-	stmt, err1 := db.Prepare("INSERT INTO materialized_backup (id, backup_name, data_id, status, start_time, end_time, size) values(?,?,?,?,?,?,?)")
-	if err1 != nil {
-		return err1
+	err := rows.Err()
+	if err != nil {
+		return []MaterializedBackup{}, err
 	}
-	_, err2 := stmt.Exec(id, backupName, dataID, status, startDate, endDate, size)
-	if err2 != nil {
-		metricsSQLCounter.WithLabelValues("error").Inc()
-		return err2
+	return mbs, nil
+}
+
+//queryMaterializedBackups runs a query on materialized_backup selecting materializedColumns and loads the tags of the results
+func (s *sqlStore) queryMaterializedBackups(query string, args ...interface{}) ([]MaterializedBackup, error) {
+	rows, err := s.query(query, args...)
+	if err != nil {
+		return []MaterializedBackup{}, err
 	}
-	metricsSQLCounter.WithLabelValues("success").Inc()
-	// rows, _ := db.Query("SELECT id,  FROM backup_tasks")
-	return nil
+	mbs, err := scanMaterializedBackups(rows)
+	rows.Close()
+	if err != nil {
+		return []MaterializedBackup{}, err
+	}
+
+	byID := make(map[string]*MaterializedBackup)
+	for i := range mbs {
+		byID[mbs[i].ID] = &mbs[i]
+	}
+	for b := 0; b < len(mbs); b += tagsQueryBatch {
+		e := b + tagsQueryBatch
+		if e > len(mbs) {
+			e = len(mbs)
+		}
+		ids := make([]interface{}, 0)
+		for _, mb := range mbs[b:e] {
+			ids = append(ids, mb.ID)
+		}
+		trows, err := s.query("SELECT materialized_id, tag FROM materialized_tag WHERE materialized_id IN (?"+strings.Repeat(",?", len(ids)-1)+") ORDER BY materialized_id, position", ids...)
+		if err != nil {
+			return []MaterializedBackup{}, err
+		}
+		for trows.Next() {
+			var id, tag string
+			err = trows.Scan(&id, &tag)
+			if err != nil {
+				trows.Close()
+				return []MaterializedBackup{}, err
+			}
+			byID[id].Tags = append(byID[id].Tags, tag)
+		}
+		err = trows.Err()
+		trows.Close()
+		if err != nil {
+			return []MaterializedBackup{}, err
+		}
+	}
+	return mbs, nil
 }
 
-func getMaterializedBackup(id string) (MaterializedBackup, error) {
-	rows, err1 := db.Query("SELECT id,data_id,backup_name,status,start_time,end_time,running_delete_workflow,size,reference,minutely,hourly,daily,weekly,monthly,yearly FROM materialized_backup WHERE id='" + id + "'")
-	if err1 != nil {
-		metricsSQLCounter.WithLabelValues("error").Inc()
-		return MaterializedBackup{}, err1
+//CreateMaterializedBackup inserts a new materialized backup. backupType and parentDataID are set for backups that are part of a full/incremental chain
+func (s *sqlStore) CreateMaterializedBackup(id string, backupName string, dataID *string, status string, startDate time.Time, endDate time.Time, size *float64, backupType string, parentDataID *string, checksum *string) error {
+	if id == "" {
+		return fmt.Errorf("'id' must be defined")
 	}
-	defer rows.Close()
+	_, err := s.exec("INSERT INTO materialized_backup (id, backup_name, data_id, status, start_time, end_time, size, backup_type, parent_data_id, checksum) values(?,?,?,?,?,?,?,?,?,?)", id, backupName, dataID, status, startDate, endDate, size, backupType, parentDataID, checksum)
+	return err
+}
 
-	for rows.Next() {
-		logrus.Debugf("Materialized backup %s found", id)
-		backup := MaterializedBackup{}
-		err2 := rows.Scan(&backup.ID, &backup.DataID, &backup.BackupName, &backup.Status, &backup.StartTime, &backup.EndTime, &backup.RunningDeleteWorkflowID, &backup.SizeMB, &backup.Reference, &backup.Minutely, &backup.Hourly, &backup.Daily, &backup.Weekly, &backup.Monthly, &backup.Yearly)
-		if err2 != nil {
+//CreateMaterializedBackups inserts COMPLETED materialized backups in one transaction. Nothing is inserted if any of them fails
+func (s *sqlStore) CreateMaterializedBackups(backupName string, backups []MaterializedBackup) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("Error begining db transaction. err=%s", err)
+	}
+	stmt, err := tx.Prepare(s.dialect.rebind("INSERT INTO materialized_backup (id, backup_name, data_id, status, start_time, end_time, size, backup_type, parent_data_id, checksum) values(?,?,?,?,?,?,?,?,?,?)"))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for _, m := range backups {
+		if m.ID == "" {
+			tx.Rollback()
+			return fmt.Errorf("'id' must be defined")
+		}
+		_, err = stmt.Exec(m.ID, backupName, m.DataID, "COMPLETED", m.StartTime, m.EndTime, m.SizeMB, m.BackupType, m.ParentDataID, m.Checksum)
+		if err != nil {
 			metricsSQLCounter.WithLabelValues("error").Inc()
-			return MaterializedBackup{}, err2
+			tx.Rollback()
+			return fmt.Errorf("Error inserting materialized backup %s. err=%s", m.ID, err)
 		}
-		metricsSQLCounter.WithLabelValues("success").Inc()
-		return backup, nil
 	}
-	err := rows.Err()
+	err = tx.Commit()
 	if err != nil {
 		metricsSQLCounter.WithLabelValues("error").Inc()
-		return MaterializedBackup{}, err
+		return fmt.Errorf("Error commiting db transaction. err=%s", err)
 	}
 	metricsSQLCounter.WithLabelValues("success").Inc()
-	return MaterializedBackup{}, fmt.Errorf("Backup id %s not found", id)
+	return nil
 }
 
-func getMaterializedBackups(backupName string, limit int, tag string, status string, randomOrder bool) ([]MaterializedBackup, error) {
-	where := fmt.Sprintf(" WHERE backup_name='%s'", backupName)
-	if tag != "" || status != "" {
-		if tag != "" {
-			where = where + " AND " + tag + "=1"
-		}
-		if status != "" {
-			where = where + " AND status='" + status + "'"
-		}
+//GetMaterializedBackup loads a materialized backup by id
+func (s *sqlStore) GetMaterializedBackup(id string) (MaterializedBackup, error) {
+	mbs, err := s.queryMaterializedBackups("SELECT "+materializedColumns+" FROM materialized_backup WHERE id=?", id)
+	if err != nil {
+		return MaterializedBackup{}, err
+	}
+	if len(mbs) == 0 {
+		return MaterializedBackup{}, sql.ErrNoRows
+	}
+	logrus.Debugf("Materialized backup %s found", id)
+	return mbs[0], nil
+}
+
+//GetMaterializedBackups lists materialized backups of a backup spec (of all specs if backupName is empty), newest first (or in random order).
+//Replicas are not included
+func (s *sqlStore) GetMaterializedBackups(backupName string, limit int, tag string, status string, randomOrder bool) ([]MaterializedBackup, error) {
+	where := " WHERE target=''"
+	args := []interface{}{}
+	if backupName != "" {
+		where = where + " AND backup_name=?"
+		args = append(args, backupName)
+	}
+	if tag != "" {
+		where = where + " AND id IN (SELECT materialized_id FROM materialized_tag WHERE tag=?)"
+		args = append(args, tag)
+	}
+	if status != "" {
+		where = where + " AND status=?"
+		args = append(args, status)
 	}
 	orderBy := "start_time DESC"
 	if randomOrder {
 		orderBy = "RANDOM()"
 	}
-	q := "SELECT id,data_id,status,backup_name,start_time,end_time,running_delete_workflow,size,reference,minutely,hourly,daily,weekly,monthly,yearly FROM materialized_backup " + where + " ORDER BY " + orderBy
+	q := "SELECT " + materializedColumns + " FROM materialized_backup " + where + " ORDER BY " + orderBy
 	if limit != 0 {
-		q = q + fmt.Sprintf(" LIMIT %d", limit)
+		q = q + " LIMIT ?"
+		args = append(args, limit)
 	}
-	logrus.Debugf("query=%s", q)
-	rows, err1 := db.Query(q)
-	if err1 != nil {
-		metricsSQLCounter.WithLabelValues("error").Inc()
-		return []MaterializedBackup{}, err1
-	}
-	defer rows.Close()
+	return s.queryMaterializedBackups(q, args...)
+}
 
-	var materializeds = make([]MaterializedBackup, 0)
-	for rows.Next() {
-		m := MaterializedBackup{}
-		err2 := rows.Scan(&m.ID, &m.DataID, &m.Status, &m.BackupName, &m.StartTime, &m.EndTime, &m.RunningDeleteWorkflowID, &m.SizeMB, &m.Reference, &m.Minutely, &m.Hourly, &m.Daily, &m.Weekly, &m.Monthly, &m.Yearly)
-		if err2 != nil {
-			metricsSQLCounter.WithLabelValues("error").Inc()
-			return []MaterializedBackup{}, err2
+//MaterializedQuery filters, order and page of a materialized backups listing
+type MaterializedQuery struct {
+	BackupName string
+	Tag        string
+	//Statuses any of these statuses. All statuses if empty
+	Statuses []string
+	//From and To start time range, both inclusive
+	From *time.Time
+	To   *time.Time
+	//Ascending oldest first. Newest first if false
+	Ascending bool
+	//After position of the last backup of the previous page
+	After *MaterializedCursor
+	//Limit max backups in the page. 0 for all
+	Limit int
+}
+
+//MaterializedCursor position of a backup in a listing ordered by start time and id
+type MaterializedCursor struct {
+	StartTime time.Time `json:"startTime"`
+	ID        string    `json:"id"`
+}
+
+//ListMaterializedBackups lists a page of the materialized backups matching q, ordered by start time (and id for backups started at the same time),
+//and the number of backups matching q in all pages. Replicas are not included
+func (s *sqlStore) ListMaterializedBackups(q MaterializedQuery) ([]MaterializedBackup, int, error) {
+	startTime := s.dialect.timeValue("start_time")
+	where := " WHERE target=''"
+	args := []interface{}{}
+	if q.BackupName != "" {
+		where = where + " AND backup_name=?"
+		args = append(args, q.BackupName)
+	}
+	if q.Tag != "" {
+		where = where + " AND id IN (SELECT materialized_id FROM materialized_tag WHERE tag=?)"
+		args = append(args, q.Tag)
+	}
+	if len(q.Statuses) > 0 {
+		where = where + " AND status IN (?" + strings.Repeat(",?", len(q.Statuses)-1) + ")"
+		for _, st := range q.Statuses {
+			args = append(args, st)
 		}
-		materializeds = append(materializeds, m)
 	}
-	err := rows.Err()
+	if q.From != nil {
+		where = where + " AND " + startTime + ">=" + s.dialect.timeValue("?")
+		args = append(args, *q.From)
+	}
+	if q.To != nil {
+		where = where + " AND " + startTime + "<=" + s.dialect.timeValue("?")
+		args = append(args, *q.To)
+	}
+
+	total := 0
+	rows, err := s.query("SELECT COUNT(*) FROM materialized_backup"+where, args...)
 	if err != nil {
-		metricsSQLCounter.WithLabelValues("error").Inc()
-		return []MaterializedBackup{}, err
+		return []MaterializedBackup{}, 0, err
 	}
-	metricsSQLCounter.WithLabelValues("success").Inc()
-	return materializeds, nil
+	if rows.Next() {
+		err = rows.Scan(&total)
+	}
+	rows.Close()
+	if err != nil {
+		return []MaterializedBackup{}, 0, err
+	}
+
+	op := "<"
+	dir := "DESC"
+	if q.Ascending {
+		op = ">"
+		dir = "ASC"
+	}
+	if q.After != nil {
+		where = where + " AND (" + startTime + op + s.dialect.timeValue("?") + " OR (" + startTime + "=" + s.dialect.timeValue("?") + " AND id" + op + "?))"
+		args = append(args, q.After.StartTime, q.After.StartTime, q.After.ID)
+	}
+	query := "SELECT " + materializedColumns + " FROM materialized_backup" + where + " ORDER BY " + startTime + " " + dir + ", id " + dir
+	if q.Limit != 0 {
+		query = query + " LIMIT ?"
+		args = append(args, q.Limit)
+	}
+	mbs, err := s.queryMaterializedBackups(query, args...)
+	return mbs, total, err
 }
 
-func getExclusiveTagAvailableMaterializedBackups(backupName string, tag string, skipNewestCount int, limit int) ([]MaterializedBackup, error) {
-	whereTags := fmt.Sprintf("backup_name='%s'", backupName)
-	tags := []string{"minutely", "hourly", "daily", "weekly", "monthly", "yearly"}
+//SetStatusMaterializedBackup updates status and running delete workflow of a materialized backup
+func (s *sqlStore) SetStatusMaterializedBackup(materializedID string, status string, workflowID *string) error {
+	logrus.Infof("Setting materialized backup %s status to %s", materializedID, status)
+	_, err := s.exec("UPDATE materialized_backup SET status=?, running_delete_workflow=? WHERE id=?", status, workflowID, materializedID)
+	return err
+}
 
-	if tag != "" {
-		//find tag index
-		ti := -1
-		for i, t := range tags {
-			if t == tag {
-				ti = i
-			}
-		}
-		for i, t := range tags {
-			if i <= ti {
-				whereTags = whereTags + " AND " + t + "=1"
-			} else {
-				whereTags = whereTags + " AND " + t + "=0"
-			}
-		}
-	} else {
-		for _, t := range tags {
-			whereTags = whereTags + " AND " + t + "=0"
-		}
+//SetVerifyMaterializedBackup updates the verification state of a materialized backup
+func (s *sqlStore) SetVerifyMaterializedBackup(materializedID string, verifyStatus string, workflowID *string, checksum *string, verifyTime *time.Time) error {
+	logrus.Infof("Setting materialized backup %s verify status to %s", materializedID, verifyStatus)
+	_, err := s.exec("UPDATE materialized_backup SET verify_status=?, running_verify_workflow=?, verify_checksum=?, verify_time=? WHERE id=?", verifyStatus, workflowID, checksum, verifyTime, materializedID)
+	return err
+}
+
+//SetHoldMaterializedBackup places (or removes, if holdBy is nil) a legal hold on a materialized backup
+func (s *sqlStore) SetHoldMaterializedBackup(materializedID string, holdBy *string, reason *string, holdTime *time.Time, holdUntil *time.Time) error {
+	logrus.Infof("Setting materialized backup %s hold. holdBy=%v", materializedID, holdBy)
+	_, err := s.exec("UPDATE materialized_backup SET hold_by=?, hold_reason=?, hold_time=?, hold_until=? WHERE id=?", holdBy, reason, holdTime, holdUntil, materializedID)
+	return err
+}
+
+//CreateReplicaBackup inserts a replica of a materialized backup. Its id is the id of the replicate workflow
+func (s *sqlStore) CreateReplicaBackup(mb MaterializedBackup) error {
+	if mb.ID == "" || mb.Target == "" || mb.SourceID == nil {
+		return fmt.Errorf("'id', 'target' and 'sourceId' must be defined")
+	}
+	_, err := s.exec("INSERT INTO materialized_backup (id, backup_name, data_id, status, start_time, end_time, size, target, source_id, backup_type, parent_data_id) values(?,?,?,?,?,?,?,?,?,?,?)",
+		mb.ID, mb.BackupName, mb.DataID, mb.Status, mb.StartTime, mb.EndTime, mb.SizeMB, mb.Target, mb.SourceID, mb.BackupType, mb.ParentDataID)
+	return err
+}
+
+//UpdateReplicaBackup records the outcome of a replicate workflow
+func (s *sqlStore) UpdateReplicaBackup(id string, status string, dataID string, endTime time.Time, size float64) error {
+	logrus.Infof("Setting replica %s status to %s", id, status)
+	_, err := s.exec("UPDATE materialized_backup SET status=?, data_id=?, end_time=?, size=? WHERE id=? AND target<>''", status, dataID, endTime, size, id)
+	return err
+}
+
+//UpdateReplicaParents points the replicas of backupName in target that depend on oldDataID to newDataID
+func (s *sqlStore) UpdateReplicaParents(backupName string, target string, oldDataID string, newDataID string) error {
+	_, err := s.exec("UPDATE materialized_backup SET parent_data_id=? WHERE backup_name=? AND target=? AND parent_data_id=?", newDataID, backupName, target, oldDataID)
+	return err
+}
+
+//GetReplicaBackups lists replicas of a backup spec (of all specs if backupName is empty) in a replication target (all targets if empty), newest first
+func (s *sqlStore) GetReplicaBackups(backupName string, target string, status string) ([]MaterializedBackup, error) {
+	q := "SELECT " + materializedColumns + " FROM materialized_backup WHERE target<>''"
+	args := []interface{}{}
+	if backupName != "" {
+		q = q + " AND backup_name=?"
+		args = append(args, backupName)
+	}
+	if target != "" {
+		q = q + " AND target=?"
+		args = append(args, target)
+	}
+	if status != "" {
+		q = q + " AND status=?"
+		args = append(args, status)
+	}
+	q = q + " ORDER BY start_time DESC"
+	return s.queryMaterializedBackups(q, args...)
+}
+
+//GetVerifyingMaterializedBackups lists materialized backups with a running verify workflow (of all specs if backupName is empty)
+func (s *sqlStore) GetVerifyingMaterializedBackups(backupName string) ([]MaterializedBackup, error) {
+	q := "SELECT " + materializedColumns + " FROM materialized_backup WHERE verify_status=?"
+	args := []interface{}{"RUNNING"}
+	if backupName != "" {
+		q = q + " AND backup_name=?"
+		args = append(args, backupName)
+	}
+	return s.queryMaterializedBackups(q, args...)
+}
+
+//UpdateTagsMaterializedBackups replaces all tags of a backup spec's materialized backups (or replicas, if target is set) in one transaction
+func (s *sqlStore) UpdateTagsMaterializedBackups(backupName string, target string, backups []MaterializedBackup) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("Error begining db transaction. err=%s", err)
 	}
 
-	q := fmt.Sprintf("SELECT id,data_id,status,backup_name,start_time,end_time,running_delete_workflow,reference,minutely,hourly,daily,weekly,monthly,yearly FROM materialized_backup WHERE %s AND status='COMPLETED' ORDER BY start_time DESC LIMIT %d OFFSET %d", whereTags, limit, skipNewestCount)
-	logrus.Debugf("getExclusiveTagAvailableMaterializedBackups query=%s", q)
-	rows, err1 := db.Query(q)
-	if err1 != nil {
+	_, err = tx.Exec(s.dialect.rebind("DELETE FROM materialized_tag WHERE materialized_id IN (SELECT id FROM materialized_backup WHERE backup_name=? AND target=?)"), backupName, target)
+	if err != nil {
 		metricsSQLCounter.WithLabelValues("error").Inc()
-		return []MaterializedBackup{}, err1
+		tx.Rollback()
+		return fmt.Errorf("Error clearing tags. err=%s", err)
 	}
-	defer rows.Close()
 
-	var mbs = make([]MaterializedBackup, 0)
-	for rows.Next() {
-		m := MaterializedBackup{}
-		err2 := rows.Scan(&m.ID, &m.DataID, &m.Status, &m.BackupName, &m.StartTime, &m.EndTime, &m.RunningDeleteWorkflowID, &m.Reference, &m.Minutely, &m.Hourly, &m.Daily, &m.Weekly, &m.Monthly, &m.Yearly)
-		if err2 != nil {
-			metricsSQLCounter.WithLabelValues("error").Inc()
-			return []MaterializedBackup{}, err2
+	stmt, err := tx.Prepare(s.dialect.rebind("INSERT INTO materialized_tag (materialized_id, backup_name, tag, position) values(?,?,?,?)"))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for _, m := range backups {
+		if m.BackupName != backupName || m.Target != target {
+			continue
+		}
+		for i, tag := range m.Tags {
+			_, err = stmt.Exec(m.ID, backupName, tag, i)
+			if err != nil {
+				metricsSQLCounter.WithLabelValues("error").Inc()
+				tx.Rollback()
+				return fmt.Errorf("Error tagging materialized backup %s. err=%s", m.ID, err)
+			}
 		}
-		mbs = append(mbs, m)
 	}
-	err := rows.Err()
+
+	err = tx.Commit()
 	if err != nil {
 		metricsSQLCounter.WithLabelValues("error").Inc()
-		return []MaterializedBackup{}, err
+		return fmt.Errorf("Error commiting transation. err=%s", err)
 	}
 	metricsSQLCounter.WithLabelValues("success").Inc()
-	return mbs, nil
+	return nil
+}
+
+//InventoryStats aggregated materialized backups of a backup spec, as exported by the inventory metrics. Replicas are not included
+type InventoryStats struct {
+	//StatusCount backups in COMPLETED, deleting and delete-error status
+	StatusCount map[string]float64
+	//TagCount and TagSize COMPLETED backups per tag. "all" has all COMPLETED backups
+	TagCount map[string]float64
+	TagSize  map[string]float64
+	//VerifyCount COMPLETED backups per verify status. "never" for backups that were never verified
+	VerifyCount map[string]float64
+	//LastCompleted and LastVerified Unix time of the newest COMPLETED backup and of its newest finished verification. 0 if there is none
+	LastCompleted float64
+	LastVerified  float64
+	//QuotaSize and QuotaCount COMPLETED backups that are not on hold, as counted by the spec's quotas
+	QuotaSize  float64
+	QuotaCount int
 }
 
-func clearTagsAndReferenceMaterializedBackup(tx *sql.Tx) (sql.Result, error) {
-	stmt, err := db.Prepare("UPDATE materialized_backup SET reference=0, minutely=0, hourly=0, daily=0, weekly=0, monthly=0, yearly=0;")
+//GetInventoryStats aggregates the materialized backups of all backup specs by backup name
+func (s *sqlStore) GetInventoryStats(now time.Time) (map[string]*InventoryStats, error) {
+	stats := make(map[string]*InventoryStats)
+	statsOf := func(backupName string) *InventoryStats {
+		st, ok := stats[backupName]
+		if !ok {
+			st = &InventoryStats{StatusCount: map[string]float64{}, TagCount: map[string]float64{}, TagSize: map[string]float64{}, VerifyCount: map[string]float64{}}
+			stats[backupName] = st
+		}
+		return st
+	}
+
+	err := s.queryEach("SELECT backup_name, status, COUNT(*), COALESCE(SUM(size), 0), MAX("+s.dialect.unixTime("end_time")+") FROM materialized_backup"+
+		" WHERE target='' AND status IN ('COMPLETED', 'deleting', 'delete-error') GROUP BY backup_name, status", nil,
+		func(rows *sql.Rows) error {
+			var backupName, status string
+			var count, size float64
+			var last sql.NullFloat64
+			err := rows.Scan(&backupName, &status, &count, &size, &last)
+			if err != nil {
+				return err
+			}
+			st := statsOf(backupName)
+			st.StatusCount[status] = count
+			if status == "COMPLETED" {
+				st.TagCount["all"] = count
+				st.TagSize["all"] = size
+				st.LastCompleted = last.Float64
+			}
+			return nil
+		})
 	if err != nil {
 		return nil, err
 	}
-	res, err0 := tx.Stmt(stmt).Exec()
-	if err0 != nil {
-		metricsSQLCounter.WithLabelValues("error").Inc()
-	} else {
-		metricsSQLCounter.WithLabelValues("success").Inc()
-	}
-	return res, err0
-}
 
-func setAllTagsMaterializedBackup(tx *sql.Tx, backupID string) (sql.Result, error) {
-	stmt, err := db.Prepare("UPDATE materialized_backup SET minutely=1, hourly=1, daily=1, weekly=1, monthly=1, yearly=1 WHERE id=?;")
+	err = s.queryEach("SELECT m.backup_name, t.tag, COUNT(*), COALESCE(SUM(m.size), 0) FROM materialized_backup m JOIN materialized_tag t ON t.materialized_id=m.id"+
+		" WHERE m.target='' AND m.status='COMPLETED' GROUP BY m.backup_name, t.tag", nil,
+		func(rows *sql.Rows) error {
+			var backupName, tag string
+			var count, size float64
+			err := rows.Scan(&backupName, &tag, &count, &size)
+			if err != nil {
+				return err
+			}
+			st := statsOf(backupName)
+			st.TagCount[tag] = count
+			st.TagSize[tag] = size
+			return nil
+		})
 	if err != nil {
 		return nil, err
 	}
-	res, err0 := tx.Stmt(stmt).Exec(backupID)
-	if err0 != nil {
-		metricsSQLCounter.WithLabelValues("error").Inc()
-	} else {
-		metricsSQLCounter.WithLabelValues("success").Inc()
-	}
-	return res, err0
-}
 
-func markReferencesMinutelyMaterializedBackup(tx *sql.Tx, backupName string, secondReference string) (sql.Result, error) {
-	sql := `UPDATE materialized_backup set reference=1, minutely=1
-											WHERE id IN (
-												SELECT y.id AS id FROM 
-												(SELECT id, strftime('%Y-%m-%dT%H:%M:0.000', start_time) AS timeref, MIN(ABS(strftime('%S', start_time)-` + secondReference + `)) AS refdiff
-													FROM materialized_backup p
-													WHERE backup_name='` + backupName + `'
-													GROUP BY strftime('%Y-%m-%dT%H:%M:0.000', start_time)) y
-											)`
-	logrus.Debugf("sql=%s", sql)
-	stmt, err := db.Prepare(sql)
+	err = s.queryEach("SELECT backup_name, COALESCE(verify_status, 'never'), COUNT(*),"+
+		" MAX(CASE WHEN verify_status<>'RUNNING' AND verify_time IS NOT NULL THEN "+s.dialect.unixTime("verify_time")+" END) FROM materialized_backup"+
+		" WHERE target='' AND status='COMPLETED' GROUP BY backup_name, COALESCE(verify_status, 'never')", nil,
+		func(rows *sql.Rows) error {
+			var backupName, verifyStatus string
+			var count float64
+			var last sql.NullFloat64
+			err := rows.Scan(&backupName, &verifyStatus, &count, &last)
+			if err != nil {
+				return err
+			}
+			st := statsOf(backupName)
+			st.VerifyCount[verifyStatus] = count
+			if last.Float64 > st.LastVerified {
+				st.LastVerified = last.Float64
+			}
+			return nil
+		})
 	if err != nil {
 		return nil, err
 	}
-	res, err0 := tx.Stmt(stmt).Exec()
-	if err0 != nil {
-		metricsSQLCounter.WithLabelValues("error").Inc()
-	} else {
-		metricsSQLCounter.WithLabelValues("success").Inc()
-	}
-	return res, err0
-}
 
-func setStatusMaterializedBackup(materializedID string, status string, workflowID *string) (sql.Result, error) {
-	sql := `UPDATE materialized_backup SET status=?, running_delete_workflow=? WHERE id=?`
-	stmt, err := db.Prepare(sql)
-	logrus.Infof("%s %s %s", sql, materializedID, status)
+	//same rule as isHeld
+	err = s.queryEach("SELECT backup_name, COUNT(*), COALESCE(SUM(size), 0) FROM materialized_backup"+
+		" WHERE target='' AND status='COMPLETED' AND NOT (hold_by IS NOT NULL AND (hold_until IS NULL OR "+s.dialect.timeValue("hold_until")+">"+s.dialect.timeValue("?")+"))"+
+		" GROUP BY backup_name", []interface{}{now},
+		func(rows *sql.Rows) error {
+			var backupName string
+			var count int
+			var size float64
+			err := rows.Scan(&backupName, &count, &size)
+			if err != nil {
+				return err
+			}
+			st := statsOf(backupName)
+			st.QuotaCount = count
+			st.QuotaSize = size
+			return nil
+		})
 	if err != nil {
-		metricsSQLCounter.WithLabelValues("error").Inc()
 		return nil, err
 	}
-	metricsSQLCounter.WithLabelValues("success").Inc()
-	return stmt.Exec(status, workflowID, materializedID)
+	return stats, nil
 }
 
-func markTagMaterializedBackup(tx *sql.Tx, backupName string, tag string, previousTag string, groupByPattern string, diffPattern string, ref string) (sql.Result, error) {
-	sql := `UPDATE materialized_backup set ` + tag + `=1
-								WHERE id IN (
-									SELECT y.id AS id FROM 
-									(SELECT id, strftime('` + groupByPattern + `', start_time) AS timeref, MIN(ABS(strftime('` + diffPattern + `', start_time)-` + ref + `)) AS refdiff
-										FROM materialized_backup p
-										WHERE backup_name='` + backupName + `' AND reference=1 AND ` + previousTag + `=1
-										GROUP BY strftime('` + groupByPattern + `', start_time)) y
-								)`
-	logrus.Debugf("sql=%s", sql)
-	stmt, err := db.Prepare(sql)
+//queryEach runs a query and calls scan for each row
+func (s *sqlStore) queryEach(query string, args []interface{}, scan func(rows *sql.Rows) error) error {
+	rows, err := s.query(query, args...)
 	if err != nil {
-		metricsSQLCounter.WithLabelValues("error").Inc()
-		return nil, err
+		return err
 	}
-	res, err0 := tx.Stmt(stmt).Exec()
-	if err0 != nil {
-		metricsSQLCounter.WithLabelValues("error").Inc()
-	} else {
-		metricsSQLCounter.WithLabelValues("success").Inc()
+	defer rows.Close()
+	for rows.Next() {
+		err = scan(rows)
+		if err != nil {
+			return err
+		}
 	}
-	return res, err0
+	return rows.Err()
 }
 
-func getTags(backup MaterializedBackup) []string {
-	t := make([]string, 0)
-	if backup.Reference == 1 {
-		t = append(t, "reference")
-	}
-	if backup.Minutely == 1 {
-		t = append(t, "minutely")
-	}
-	if backup.Hourly == 1 {
-		t = append(t, "hourly")
-	}
-	if backup.Daily == 1 {
-		t = append(t, "daily")
-	}
-	if backup.Weekly == 1 {
-		t = append(t, "weekly")
-	}
-	if backup.Monthly == 1 {
-		t = append(t, "monthly")
-	}
-	if backup.Yearly == 1 {
-		t = append(t, "yearly")
+//DeleteMaterializedBackups deletes all materialized backup rows of a backup spec
+func (s *sqlStore) DeleteMaterializedBackups(backupName string) error {
+	_, err := s.exec("DELETE FROM materialized_tag WHERE backup_name=?", backupName)
+	if err != nil {
+		return err
 	}
+	_, err = s.exec("DELETE FROM materialized_backup WHERE backup_name=?", backupName)
+	return err
+}
+
+func getTags(backup MaterializedBackup) []string {
+	t := make([]string, len(backup.Tags))
+	copy(t, backup.Tags)
 	return t
 }
+
+//hasTag whether a materialized backup has a tag
+func hasTag(backup MaterializedBackup, tag string) bool {
+	for _, t := range backup.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
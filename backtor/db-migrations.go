@@ -0,0 +1,495 @@
+package backtor
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+//migration numbered schema change. Statements are keyed by database driver name
+type migration struct {
+	version     int
+	description string
+	up          map[string][]string
+	down        map[string][]string
+}
+
+//MigrationStatus a known migration and whether it was applied to the database
+type MigrationStatus struct {
+	Version     int
+	Description string
+	Applied     bool
+}
+
+//migrations all schema changes, in version order. Never change a released migration; add a new one instead
+var migrations = []migration{
+	{
+		version:     1,
+		description: "initial schema",
+		up: map[string][]string{
+			"sqlite3": {
+				"CREATE TABLE IF NOT EXISTS backup_spec (name TEXT, enabled INTEGER NOT NULL, worker_config TEXT, timeout_seconds INTEGER, running_create_workflow TEXT, from_date TIMESTAMP, to_date TIMESTAMP, last_update TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, backup_cron_string TEXT NOT NULL, retention_minutely VARCHAR NOT NULL DEFAULT '0@L', retention_hourly VARCHAR NOT NULL DEFAULT '0@L', retention_daily VARCHAR NOT NULL DEFAULT '4@L', retention_weekly VARCHAR NOT NULL DEFAULT '4@L', retention_monthly VARCHAR NOT NULL DEFAULT '3@L', retention_yearly VARCHAR NOT NULL DEFAULT '2@L', PRIMARY KEY(`name`))",
+				"CREATE TABLE IF NOT EXISTS materialized_backup (id TEXT NOT NULL, backup_name TEXT NOT NULL, data_id TEXT NOT NULL, status TEXT NOT NULL, running_delete_workflow TEXT, start_time TIMESTAMP NOT NULL, end_time TIMESTAMP NOT NULL, size REAL NOT NULL, minutely INTEGER NOT NULL DEFAULT 0, hourly INTEGER NOT NULL DEFAULT 0, daily INTEGER NOT NULL DEFAULT 0, weekly INTEGER NOT NULL DEFAULT 0, monthly INTEGER NOT NULL DEFAULT 0, yearly INTEGER NOT NULL DEFAULT 0, reference INTEGER NOT NULL DEFAULT 0, PRIMARY KEY(`id`))",
+			},
+			"postgres": {
+				"CREATE TABLE IF NOT EXISTS backup_spec (name TEXT NOT NULL, enabled INTEGER NOT NULL, worker_config TEXT, timeout_seconds INTEGER, running_create_workflow TEXT, from_date TIMESTAMPTZ, to_date TIMESTAMPTZ, last_update TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP, backup_cron_string TEXT NOT NULL, retention_minutely VARCHAR NOT NULL DEFAULT '0@L', retention_hourly VARCHAR NOT NULL DEFAULT '0@L', retention_daily VARCHAR NOT NULL DEFAULT '4@L', retention_weekly VARCHAR NOT NULL DEFAULT '4@L', retention_monthly VARCHAR NOT NULL DEFAULT '3@L', retention_yearly VARCHAR NOT NULL DEFAULT '2@L', PRIMARY KEY(name))",
+				"CREATE TABLE IF NOT EXISTS materialized_backup (id TEXT NOT NULL, backup_name TEXT NOT NULL, data_id TEXT NOT NULL, status TEXT NOT NULL, running_delete_workflow TEXT, start_time TIMESTAMPTZ NOT NULL, end_time TIMESTAMPTZ NOT NULL, size DOUBLE PRECISION NOT NULL, minutely INTEGER NOT NULL DEFAULT 0, hourly INTEGER NOT NULL DEFAULT 0, daily INTEGER NOT NULL DEFAULT 0, weekly INTEGER NOT NULL DEFAULT 0, monthly INTEGER NOT NULL DEFAULT 0, yearly INTEGER NOT NULL DEFAULT 0, reference INTEGER NOT NULL DEFAULT 0, PRIMARY KEY(id))",
+				"CREATE INDEX IF NOT EXISTS materialized_backup_name_idx ON materialized_backup (backup_name, start_time)",
+			},
+		},
+		down: allDrivers(
+			"DROP TABLE materialized_backup",
+			"DROP TABLE backup_spec",
+		),
+	},
+	{
+		version:     2,
+		description: "restore table",
+		up: map[string][]string{
+			"sqlite3": {
+				"CREATE TABLE IF NOT EXISTS restore (id TEXT NOT NULL, backup_name TEXT NOT NULL, materialized_id TEXT NOT NULL, data_id TEXT NOT NULL, status TEXT NOT NULL, target TEXT, start_time TIMESTAMP NOT NULL, end_time TIMESTAMP, PRIMARY KEY(`id`))",
+			},
+			"postgres": {
+				"CREATE TABLE IF NOT EXISTS restore (id TEXT NOT NULL, backup_name TEXT NOT NULL, materialized_id TEXT NOT NULL, data_id TEXT NOT NULL, status TEXT NOT NULL, target TEXT, start_time TIMESTAMPTZ NOT NULL, end_time TIMESTAMPTZ, PRIMARY KEY(id))",
+			},
+		},
+		down: allDrivers(
+			"DROP TABLE restore",
+		),
+	},
+	{
+		version:     3,
+		description: "backup spec purge state",
+		up: allDrivers(
+			"ALTER TABLE backup_spec ADD COLUMN purging INTEGER NOT NULL DEFAULT 0",
+		),
+		down: allDrivers(
+			"ALTER TABLE backup_spec DROP COLUMN purging",
+		),
+	},
+	{
+		version:     4,
+		description: "leader lease",
+		up: allDrivers(
+			"CREATE TABLE IF NOT EXISTS leader_lease (name TEXT NOT NULL, holder TEXT NOT NULL, address TEXT, expires_at BIGINT NOT NULL, PRIMARY KEY(name))",
+		),
+		down: allDrivers(
+			"DROP TABLE leader_lease",
+		),
+	},
+	{
+		version:     5,
+		description: "processed workflow events",
+		up: allDrivers(
+			"CREATE TABLE IF NOT EXISTS workflow_event (id TEXT NOT NULL, workflow_id TEXT NOT NULL, status TEXT NOT NULL, received_at BIGINT NOT NULL, PRIMARY KEY(id))",
+		),
+		down: allDrivers(
+			"DROP TABLE workflow_event",
+		),
+	},
+	{
+		version:     6,
+		description: "backup verification",
+		up: map[string][]string{
+			"sqlite3": {
+				"ALTER TABLE backup_spec ADD COLUMN verify_cron_string TEXT",
+				"ALTER TABLE backup_spec ADD COLUMN verify_sample_size INTEGER NOT NULL DEFAULT 1",
+				"ALTER TABLE materialized_backup ADD COLUMN running_verify_workflow TEXT",
+				"ALTER TABLE materialized_backup ADD COLUMN verify_status TEXT",
+				"ALTER TABLE materialized_backup ADD COLUMN verify_checksum TEXT",
+				"ALTER TABLE materialized_backup ADD COLUMN verify_time TIMESTAMP",
+				"ALTER TABLE materialized_backup ADD COLUMN checksum TEXT",
+			},
+			"postgres": {
+				"ALTER TABLE backup_spec ADD COLUMN verify_cron_string TEXT",
+				"ALTER TABLE backup_spec ADD COLUMN verify_sample_size INTEGER NOT NULL DEFAULT 1",
+				"ALTER TABLE materialized_backup ADD COLUMN running_verify_workflow TEXT",
+				"ALTER TABLE materialized_backup ADD COLUMN verify_status TEXT",
+				"ALTER TABLE materialized_backup ADD COLUMN verify_checksum TEXT",
+				"ALTER TABLE materialized_backup ADD COLUMN verify_time TIMESTAMPTZ",
+				"ALTER TABLE materialized_backup ADD COLUMN checksum TEXT",
+			},
+		},
+		down: allDrivers(
+			"ALTER TABLE materialized_backup DROP COLUMN checksum",
+			"ALTER TABLE materialized_backup DROP COLUMN verify_time",
+			"ALTER TABLE materialized_backup DROP COLUMN verify_checksum",
+			"ALTER TABLE materialized_backup DROP COLUMN verify_status",
+			"ALTER TABLE materialized_backup DROP COLUMN running_verify_workflow",
+			"ALTER TABLE backup_spec DROP COLUMN verify_sample_size",
+			"ALTER TABLE backup_spec DROP COLUMN verify_cron_string",
+		),
+	},
+	{
+		version:     7,
+		description: "backup spec managed by marker",
+		up: allDrivers(
+			"ALTER TABLE backup_spec ADD COLUMN managed_by TEXT NOT NULL DEFAULT ''",
+		),
+		down: allDrivers(
+			"ALTER TABLE backup_spec DROP COLUMN managed_by",
+		),
+	},
+	{
+		version:     8,
+		description: "backup replication",
+		up: allDrivers(
+			"ALTER TABLE backup_spec ADD COLUMN replication_targets TEXT",
+			"ALTER TABLE materialized_backup ADD COLUMN target TEXT NOT NULL DEFAULT ''",
+			"ALTER TABLE materialized_backup ADD COLUMN source_id TEXT",
+			"CREATE INDEX IF NOT EXISTS materialized_backup_target_idx ON materialized_backup (backup_name, target, start_time)",
+		),
+		down: allDrivers(
+			"DROP INDEX materialized_backup_target_idx",
+			"ALTER TABLE materialized_backup DROP COLUMN source_id",
+			"ALTER TABLE materialized_backup DROP COLUMN target",
+			"ALTER TABLE backup_spec DROP COLUMN replication_targets",
+		),
+	},
+	{
+		version:     9,
+		description: "incremental backup chains",
+		up: allDrivers(
+			"ALTER TABLE backup_spec ADD COLUMN incremental_cron_string TEXT",
+			"ALTER TABLE materialized_backup ADD COLUMN backup_type TEXT NOT NULL DEFAULT ''",
+			"ALTER TABLE materialized_backup ADD COLUMN parent_data_id TEXT",
+		),
+		down: allDrivers(
+			"ALTER TABLE materialized_backup DROP COLUMN parent_data_id",
+			"ALTER TABLE materialized_backup DROP COLUMN backup_type",
+			"ALTER TABLE backup_spec DROP COLUMN incremental_cron_string",
+		),
+	},
+	{
+		version:     10,
+		description: "materialized backup legal hold",
+		up: map[string][]string{
+			"sqlite3": {
+				"ALTER TABLE materialized_backup ADD COLUMN hold_by TEXT",
+				"ALTER TABLE materialized_backup ADD COLUMN hold_reason TEXT",
+				"ALTER TABLE materialized_backup ADD COLUMN hold_time TIMESTAMP",
+				"ALTER TABLE materialized_backup ADD COLUMN hold_until TIMESTAMP",
+			},
+			"postgres": {
+				"ALTER TABLE materialized_backup ADD COLUMN hold_by TEXT",
+				"ALTER TABLE materialized_backup ADD COLUMN hold_reason TEXT",
+				"ALTER TABLE materialized_backup ADD COLUMN hold_time TIMESTAMPTZ",
+				"ALTER TABLE materialized_backup ADD COLUMN hold_until TIMESTAMPTZ",
+			},
+		},
+		down: allDrivers(
+			"ALTER TABLE materialized_backup DROP COLUMN hold_until",
+			"ALTER TABLE materialized_backup DROP COLUMN hold_time",
+			"ALTER TABLE materialized_backup DROP COLUMN hold_reason",
+			"ALTER TABLE materialized_backup DROP COLUMN hold_by",
+		),
+	},
+	{
+		version:     11,
+		description: "backup spec notifications",
+		up: allDrivers(
+			"ALTER TABLE backup_spec ADD COLUMN notify TEXT",
+		),
+		down: allDrivers(
+			"ALTER TABLE backup_spec DROP COLUMN notify",
+		),
+	},
+	{
+		version:     12,
+		description: "missed schedule catch-up",
+		up: map[string][]string{
+			"sqlite3": {
+				"ALTER TABLE backup_spec ADD COLUMN misfire_policy TEXT NOT NULL DEFAULT 'skip'",
+				"ALTER TABLE backup_spec ADD COLUMN misfire_max_runs INTEGER NOT NULL DEFAULT 0",
+				"ALTER TABLE backup_spec ADD COLUMN last_scheduled_time TIMESTAMP",
+				"ALTER TABLE backup_spec ADD COLUMN catchup_pending INTEGER NOT NULL DEFAULT 0",
+				"CREATE TABLE IF NOT EXISTS catchup (id TEXT NOT NULL, backup_name TEXT NOT NULL, action TEXT NOT NULL, policy TEXT NOT NULL, missed_count INTEGER NOT NULL, first_missed TIMESTAMP, last_missed TIMESTAMP, workflow_id TEXT, time TIMESTAMP NOT NULL, PRIMARY KEY(`id`))",
+			},
+			"postgres": {
+				"ALTER TABLE backup_spec ADD COLUMN misfire_policy TEXT NOT NULL DEFAULT 'skip'",
+				"ALTER TABLE backup_spec ADD COLUMN misfire_max_runs INTEGER NOT NULL DEFAULT 0",
+				"ALTER TABLE backup_spec ADD COLUMN last_scheduled_time TIMESTAMPTZ",
+				"ALTER TABLE backup_spec ADD COLUMN catchup_pending INTEGER NOT NULL DEFAULT 0",
+				"CREATE TABLE IF NOT EXISTS catchup (id TEXT NOT NULL, backup_name TEXT NOT NULL, action TEXT NOT NULL, policy TEXT NOT NULL, missed_count INTEGER NOT NULL, first_missed TIMESTAMPTZ, last_missed TIMESTAMPTZ, workflow_id TEXT, time TIMESTAMPTZ NOT NULL, PRIMARY KEY(id))",
+			},
+		},
+		down: allDrivers(
+			"DROP TABLE catchup",
+			"ALTER TABLE backup_spec DROP COLUMN catchup_pending",
+			"ALTER TABLE backup_spec DROP COLUMN last_scheduled_time",
+			"ALTER TABLE backup_spec DROP COLUMN misfire_max_runs",
+			"ALTER TABLE backup_spec DROP COLUMN misfire_policy",
+		),
+	},
+	{
+		version:     13,
+		description: "backup spec timezone",
+		up: allDrivers(
+			"ALTER TABLE backup_spec ADD COLUMN timezone TEXT NOT NULL DEFAULT ''",
+		),
+		down: allDrivers(
+			"ALTER TABLE backup_spec DROP COLUMN timezone",
+		),
+	}, {
+		version:     14,
+		description: "materialized backup tags as rows and custom retention periods",
+		up: map[string][]string{
+			"sqlite3": {
+				"CREATE TABLE IF NOT EXISTS materialized_tag (materialized_id TEXT NOT NULL, backup_name TEXT NOT NULL, tag TEXT NOT NULL, position INTEGER NOT NULL, PRIMARY KEY(`materialized_id`, `tag`))",
+				"CREATE INDEX IF NOT EXISTS materialized_tag_name_idx ON materialized_tag (backup_name, tag)",
+				"INSERT INTO materialized_tag (materialized_id, backup_name, tag, position) SELECT id, backup_name, 'reference', 0 FROM materialized_backup WHERE reference=1",
+				"INSERT INTO materialized_tag (materialized_id, backup_name, tag, position) SELECT id, backup_name, 'minutely', 1 FROM materialized_backup WHERE minutely=1",
+				"INSERT INTO materialized_tag (materialized_id, backup_name, tag, position) SELECT id, backup_name, 'hourly', 2 FROM materialized_backup WHERE hourly=1",
+				"INSERT INTO materialized_tag (materialized_id, backup_name, tag, position) SELECT id, backup_name, 'daily', 3 FROM materialized_backup WHERE daily=1",
+				"INSERT INTO materialized_tag (materialized_id, backup_name, tag, position) SELECT id, backup_name, 'weekly', 4 FROM materialized_backup WHERE weekly=1",
+				"INSERT INTO materialized_tag (materialized_id, backup_name, tag, position) SELECT id, backup_name, 'monthly', 5 FROM materialized_backup WHERE monthly=1",
+				"INSERT INTO materialized_tag (materialized_id, backup_name, tag, position) SELECT id, backup_name, 'yearly', 6 FROM materialized_backup WHERE yearly=1",
+				"ALTER TABLE materialized_backup DROP COLUMN reference",
+				"ALTER TABLE materialized_backup DROP COLUMN minutely",
+				"ALTER TABLE materialized_backup DROP COLUMN hourly",
+				"ALTER TABLE materialized_backup DROP COLUMN daily",
+				"ALTER TABLE materialized_backup DROP COLUMN weekly",
+				"ALTER TABLE materialized_backup DROP COLUMN monthly",
+				"ALTER TABLE materialized_backup DROP COLUMN yearly",
+				"ALTER TABLE backup_spec ADD COLUMN periods TEXT",
+			},
+			"postgres": {
+				"CREATE TABLE IF NOT EXISTS materialized_tag (materialized_id TEXT NOT NULL, backup_name TEXT NOT NULL, tag TEXT NOT NULL, position INTEGER NOT NULL, PRIMARY KEY(materialized_id, tag))",
+				"CREATE INDEX IF NOT EXISTS materialized_tag_name_idx ON materialized_tag (backup_name, tag)",
+				"INSERT INTO materialized_tag (materialized_id, backup_name, tag, position) SELECT id, backup_name, 'reference', 0 FROM materialized_backup WHERE reference=1",
+				"INSERT INTO materialized_tag (materialized_id, backup_name, tag, position) SELECT id, backup_name, 'minutely', 1 FROM materialized_backup WHERE minutely=1",
+				"INSERT INTO materialized_tag (materialized_id, backup_name, tag, position) SELECT id, backup_name, 'hourly', 2 FROM materialized_backup WHERE hourly=1",
+				"INSERT INTO materialized_tag (materialized_id, backup_name, tag, position) SELECT id, backup_name, 'daily', 3 FROM materialized_backup WHERE daily=1",
+				"INSERT INTO materialized_tag (materialized_id, backup_name, tag, position) SELECT id, backup_name, 'weekly', 4 FROM materialized_backup WHERE weekly=1",
+				"INSERT INTO materialized_tag (materialized_id, backup_name, tag, position) SELECT id, backup_name, 'monthly', 5 FROM materialized_backup WHERE monthly=1",
+				"INSERT INTO materialized_tag (materialized_id, backup_name, tag, position) SELECT id, backup_name, 'yearly', 6 FROM materialized_backup WHERE yearly=1",
+				"ALTER TABLE materialized_backup DROP COLUMN reference",
+				"ALTER TABLE materialized_backup DROP COLUMN minutely",
+				"ALTER TABLE materialized_backup DROP COLUMN hourly",
+				"ALTER TABLE materialized_backup DROP COLUMN daily",
+				"ALTER TABLE materialized_backup DROP COLUMN weekly",
+				"ALTER TABLE materialized_backup DROP COLUMN monthly",
+				"ALTER TABLE materialized_backup DROP COLUMN yearly",
+				"ALTER TABLE backup_spec ADD COLUMN periods TEXT",
+			},
+		},
+		down: allDrivers(
+			"ALTER TABLE backup_spec DROP COLUMN periods",
+			"ALTER TABLE materialized_backup ADD COLUMN reference INTEGER NOT NULL DEFAULT 0",
+			"ALTER TABLE materialized_backup ADD COLUMN minutely INTEGER NOT NULL DEFAULT 0",
+			"ALTER TABLE materialized_backup ADD COLUMN hourly INTEGER NOT NULL DEFAULT 0",
+			"ALTER TABLE materialized_backup ADD COLUMN daily INTEGER NOT NULL DEFAULT 0",
+			"ALTER TABLE materialized_backup ADD COLUMN weekly INTEGER NOT NULL DEFAULT 0",
+			"ALTER TABLE materialized_backup ADD COLUMN monthly INTEGER NOT NULL DEFAULT 0",
+			"ALTER TABLE materialized_backup ADD COLUMN yearly INTEGER NOT NULL DEFAULT 0",
+			"UPDATE materialized_backup SET reference=1 WHERE id IN (SELECT materialized_id FROM materialized_tag WHERE tag='reference')",
+			"UPDATE materialized_backup SET minutely=1 WHERE id IN (SELECT materialized_id FROM materialized_tag WHERE tag='minutely')",
+			"UPDATE materialized_backup SET hourly=1 WHERE id IN (SELECT materialized_id FROM materialized_tag WHERE tag='hourly')",
+			"UPDATE materialized_backup SET daily=1 WHERE id IN (SELECT materialized_id FROM materialized_tag WHERE tag='daily')",
+			"UPDATE materialized_backup SET weekly=1 WHERE id IN (SELECT materialized_id FROM materialized_tag WHERE tag='weekly')",
+			"UPDATE materialized_backup SET monthly=1 WHERE id IN (SELECT materialized_id FROM materialized_tag WHERE tag='monthly')",
+			"UPDATE materialized_backup SET yearly=1 WHERE id IN (SELECT materialized_id FROM materialized_tag WHERE tag='yearly')",
+			"DROP TABLE materialized_tag",
+		),
+	},
+	{
+		version:     15,
+		description: "backup spec size and count quotas",
+		up: map[string][]string{
+			"sqlite3": {
+				"ALTER TABLE backup_spec ADD COLUMN max_total_size_mb REAL NOT NULL DEFAULT 0",
+				"ALTER TABLE backup_spec ADD COLUMN max_backup_count INTEGER NOT NULL DEFAULT 0",
+			},
+			"postgres": {
+				"ALTER TABLE backup_spec ADD COLUMN max_total_size_mb DOUBLE PRECISION NOT NULL DEFAULT 0",
+				"ALTER TABLE backup_spec ADD COLUMN max_backup_count INTEGER NOT NULL DEFAULT 0",
+			},
+		},
+		down: allDrivers(
+			"ALTER TABLE backup_spec DROP COLUMN max_backup_count",
+			"ALTER TABLE backup_spec DROP COLUMN max_total_size_mb",
+		),
+	},
+}
+
+//allDrivers same statements for all databases
+func allDrivers(statements ...string) map[string][]string {
+	return map[string][]string{
+		"sqlite3":  statements,
+		"postgres": statements,
+	}
+}
+
+//latestSchemaVersion newest schema this binary knows about
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+//schemaVersionTable creates the table that records applied migrations
+var schemaVersionTable = map[string]string{
+	"sqlite3":  "CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL, description TEXT NOT NULL, applied_at TIMESTAMP NOT NULL, PRIMARY KEY(version))",
+	"postgres": "CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL, description TEXT NOT NULL, applied_at TIMESTAMPTZ NOT NULL, PRIMARY KEY(version))",
+}
+
+func (s *sqlStore) ensureSchemaVersionTable() error {
+	_, err := s.db.Exec(schemaVersionTable[s.dialect.driverName()])
+	return err
+}
+
+//SchemaVersion latest migration applied to the database. 0 means an empty database
+func (s *sqlStore) SchemaVersion() (int, error) {
+	err := s.ensureSchemaVersionTable()
+	if err != nil {
+		return 0, err
+	}
+	var version int
+	err = s.db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+//MigrationsStatus all known migrations and whether each one was applied
+func (s *sqlStore) MigrationsStatus() ([]MigrationStatus, error) {
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	st := make([]MigrationStatus, 0)
+	for _, m := range migrations {
+		st = append(st, MigrationStatus{Version: m.version, Description: m.description, Applied: m.version <= version})
+	}
+	return st, nil
+}
+
+//MigrateUp applies all pending migrations, each one in its own transaction. Returns the versions applied.
+//Replicas that start together wait for each other, so each migration is applied only once
+func (s *sqlStore) MigrateUp() ([]int, error) {
+	err := s.inMigrationLock(func(conn *sql.Conn) error {
+		_, err := conn.ExecContext(context.Background(), schemaVersionTable[s.dialect.driverName()])
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	version, err := s.checkSchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	applied := make([]int, 0)
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		m := m
+		done := false
+		err := s.inMigrationLock(func(conn *sql.Conn) error {
+			current, err := lockedSchemaVersion(conn)
+			if err != nil || current >= m.version {
+				return err
+			}
+			logrus.Infof("Applying schema migration %d (%s)", m.version, m.description)
+			done = true
+			return s.runMigration(conn, m.up[s.dialect.driverName()], "INSERT INTO schema_version (version, description, applied_at) VALUES (?,?,?)", m.version, m.description, time.Now())
+		})
+		if err != nil {
+			return applied, fmt.Errorf("Schema migration %d failed. err=%s", m.version, err)
+		}
+		if done {
+			applied = append(applied, m.version)
+		}
+	}
+	return applied, nil
+}
+
+//MigrateDown reverts the latest applied migration. Returns the version reverted or 0 if nothing was applied
+func (s *sqlStore) MigrateDown() (int, error) {
+	version, err := s.checkSchemaVersion()
+	if err != nil {
+		return 0, err
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.version != version {
+			continue
+		}
+		reverted := 0
+		err := s.inMigrationLock(func(conn *sql.Conn) error {
+			current, err := lockedSchemaVersion(conn)
+			if err != nil || current != m.version {
+				return err
+			}
+			logrus.Infof("Reverting schema migration %d (%s)", m.version, m.description)
+			reverted = m.version
+			return s.runMigration(conn, m.down[s.dialect.driverName()], "DELETE FROM schema_version WHERE version=?", m.version)
+		})
+		if err != nil {
+			return 0, fmt.Errorf("Schema migration %d revert failed. err=%s", m.version, err)
+		}
+		return reverted, nil
+	}
+	return 0, nil
+}
+
+//checkSchemaVersion fails if the database was migrated by a newer backtor
+func (s *sqlStore) checkSchemaVersion() (int, error) {
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return 0, err
+	}
+	if version > latestSchemaVersion() {
+		return version, fmt.Errorf("Database schema version %d is newer than the latest version supported by this backtor (%d). Upgrade backtor", version, latestSchemaVersion())
+	}
+	return version, nil
+}
+
+//inMigrationLock runs f in a transaction that holds the migration lock, so that only one process migrates the schema at a time.
+//f must only use conn
+func (s *sqlStore) inMigrationLock(f func(conn *sql.Conn) error) error {
+	ctx := context.Background()
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for _, q := range s.dialect.lockMigrations() {
+		_, err = conn.ExecContext(ctx, q)
+		if err != nil {
+			conn.ExecContext(ctx, "ROLLBACK")
+			return fmt.Errorf("Couldn't take the migration lock. err=%s", err)
+		}
+	}
+	err = f(conn)
+	if err != nil {
+		conn.ExecContext(ctx, "ROLLBACK")
+		return err
+	}
+	_, err = conn.ExecContext(ctx, "COMMIT")
+	return err
+}
+
+//lockedSchemaVersion latest migration applied, read inside the migration lock
+func lockedSchemaVersion(conn *sql.Conn) (int, error) {
+	var version int
+	err := conn.QueryRowContext(context.Background(), "SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	return version, err
+}
+
+//runMigration executes the migration statements followed by the schema_version update in the transaction of the migration lock
+func (s *sqlStore) runMigration(conn *sql.Conn, statements []string, versionQuery string, args ...interface{}) error {
+	ctx := context.Background()
+	for _, q := range statements {
+		logrus.Debugf("migration sql=%s", q)
+		_, err := conn.ExecContext(ctx, q)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := conn.ExecContext(ctx, s.dialect.rebind(versionQuery), args...)
+	return err
+}
@@ -0,0 +1,169 @@
+package backtor
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openTestSQLStore(t *testing.T) (*sqlStore, func()) {
+	dir, err := ioutil.TempDir("", "backtor-migrations")
+	require.Nil(t, err)
+	s, err := openSQLStore(sqliteDialect{}, dir+"/sqlite.db")
+	require.Nil(t, err)
+	return s, func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestMigrateUpDown(t *testing.T) {
+	s, teardown := openTestSQLStore(t)
+	defer teardown()
+
+	applied, err := s.MigrateUp()
+	require.Nil(t, err)
+	assert.Equal(t, len(migrations), len(applied))
+	v, err := s.SchemaVersion()
+	require.Nil(t, err)
+	assert.Equal(t, latestSchemaVersion(), v)
+
+	applied, err = s.MigrateUp()
+	require.Nil(t, err)
+	assert.Equal(t, 0, len(applied))
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		reverted, err := s.MigrateDown()
+		require.Nil(t, err)
+		assert.Equal(t, migrations[i].version, reverted)
+	}
+	reverted, err := s.MigrateDown()
+	require.Nil(t, err)
+	assert.Equal(t, 0, reverted)
+
+	applied, err = s.MigrateUp()
+	require.Nil(t, err)
+	assert.Equal(t, len(migrations), len(applied))
+}
+
+func TestMigrateUpConcurrently(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backtor-migrations")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	//replicas starting together on the same database
+	results := make(chan []int, 3)
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			s, err := openSQLStore(sqliteDialect{}, dir+"/sqlite.db?_busy_timeout=10000")
+			if err != nil {
+				errs <- err
+				results <- nil
+				return
+			}
+			defer s.Close()
+			applied, err := s.MigrateUp()
+			errs <- err
+			results <- applied
+		}()
+	}
+	total := 0
+	for i := 0; i < 3; i++ {
+		require.Nil(t, <-errs)
+		total += len(<-results)
+	}
+	assert.Equal(t, len(migrations), total, "each migration must be applied once")
+}
+
+func TestMigrateRefusesNewerSchema(t *testing.T) {
+	s, teardown := openTestSQLStore(t)
+	defer teardown()
+
+	_, err := s.MigrateUp()
+	require.Nil(t, err)
+	_, err = s.db.Exec("INSERT INTO schema_version (version, description, applied_at) VALUES (?,?,CURRENT_TIMESTAMP)", latestSchemaVersion()+1, "from the future")
+	require.Nil(t, err)
+
+	_, err = s.MigrateUp()
+	assert.NotNil(t, err)
+	_, err = s.MigrateDown()
+	assert.NotNil(t, err)
+}
+
+func TestMigrateStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backtor-migrations")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	opt0 := Options{DataDir: dir}
+
+	out := &bytes.Buffer{}
+	require.Nil(t, Migrate(opt0, "status", out))
+	assert.Contains(t, out.String(), "Schema version: 0")
+
+	require.Nil(t, Migrate(opt0, "up", out))
+	out.Reset()
+	require.Nil(t, Migrate(opt0, "status", out))
+	assert.NotContains(t, out.String(), "pending")
+
+	assert.NotNil(t, Migrate(opt0, "sideways", out))
+}
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	s, teardown := openTestSQLStore(t)
+	defer teardown()
+
+	//tables created by backtor versions without schema_version
+	for _, q := range migrations[0].up["sqlite3"] {
+		_, err := s.db.Exec(q)
+		require.Nil(t, err)
+	}
+	_, err := s.db.Exec("INSERT INTO backup_spec (name, enabled, backup_cron_string) VALUES ('legacy', 1, '0 0 * * * *')")
+	require.Nil(t, err)
+
+	_, err = s.MigrateUp()
+	require.Nil(t, err)
+	bs, err := s.GetBackupSpec("legacy")
+	require.Nil(t, err)
+	assert.Equal(t, 0, bs.Purging)
+}
+
+func TestMigrateTagColumnsToRows(t *testing.T) {
+	s, teardown := openTestSQLStore(t)
+	defer teardown()
+
+	//reverts migrations down to the one that moved tags to rows
+	downTo14 := func() {
+		for {
+			reverted, err := s.MigrateDown()
+			require.Nil(t, err)
+			if reverted <= 14 {
+				return
+			}
+		}
+	}
+	_, err := s.MigrateUp()
+	require.Nil(t, err)
+	downTo14()
+
+	_, err = s.db.Exec("INSERT INTO materialized_backup (id, backup_name, data_id, status, start_time, end_time, size, reference, daily, yearly) VALUES ('m1', 'test', 'data1', 'COMPLETED', CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, 1, 1, 1, 1)")
+	require.Nil(t, err)
+
+	_, err = s.MigrateUp()
+	require.Nil(t, err)
+	mb, err := s.GetMaterializedBackup("m1")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"reference", "daily", "yearly"}, mb.Tags)
+	mbs, err := s.GetMaterializedBackups("test", 0, "daily", "", false)
+	require.Nil(t, err)
+	assert.Equal(t, 1, len(mbs))
+
+	downTo14()
+	var daily int
+	require.Nil(t, s.db.QueryRow("SELECT daily FROM materialized_backup WHERE id='m1'").Scan(&daily))
+	assert.Equal(t, 1, daily)
+}
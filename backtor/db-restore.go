@@ -0,0 +1,81 @@
+package backtor
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+//Restore restore of a materialized backup
+type Restore struct {
+	ID             string                 `json:"id"`
+	BackupName     string                 `json:"backupName"`
+	MaterializedID string                 `json:"materializedId"`
+	DataID         string                 `json:"dataId"`
+	Status         string                 `json:"status"`
+	Target         map[string]interface{} `json:"target,omitempty"`
+	StartTime      time.Time              `json:"startTime"`
+	EndTime        *time.Time             `json:"endTime,omitempty"`
+}
+
+//CreateRestore inserts a new restore record
+func (s *sqlStore) CreateRestore(r Restore) error {
+	if r.ID == "" {
+		return fmt.Errorf("'id' must be defined")
+	}
+	target, err := json.Marshal(r.Target)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec("INSERT INTO restore (id, backup_name, materialized_id, data_id, status, target, start_time) values(?,?,?,?,?,?,?)", r.ID, r.BackupName, r.MaterializedID, r.DataID, r.Status, string(target), r.StartTime)
+	return err
+}
+
+//GetRestores lists restores of a backup spec (of all specs if backupName is empty), newest first
+func (s *sqlStore) GetRestores(backupName string, status string) ([]Restore, error) {
+	q := "SELECT id,backup_name,materialized_id,data_id,status,target,start_time,end_time FROM restore WHERE 1=1"
+	args := []interface{}{}
+	if backupName != "" {
+		q = q + " AND backup_name=?"
+		args = append(args, backupName)
+	}
+	if status != "" {
+		q = q + " AND status=?"
+		args = append(args, status)
+	}
+	q = q + " ORDER BY start_time DESC"
+	rows, err1 := s.query(q, args...)
+	if err1 != nil {
+		return []Restore{}, err1
+	}
+	defer rows.Close()
+
+	var restores = make([]Restore, 0)
+	for rows.Next() {
+		r := Restore{}
+		var target string
+		err2 := rows.Scan(&r.ID, &r.BackupName, &r.MaterializedID, &r.DataID, &r.Status, &target, &r.StartTime, &r.EndTime)
+		if err2 != nil {
+			return []Restore{}, err2
+		}
+		json.Unmarshal([]byte(target), &r.Target)
+		restores = append(restores, r)
+	}
+	err := rows.Err()
+	if err != nil {
+		return []Restore{}, err
+	}
+	return restores, nil
+}
+
+//SetStatusRestore updates status and end time of a restore
+func (s *sqlStore) SetStatusRestore(restoreID string, status string, endTime *time.Time) error {
+	_, err := s.exec("UPDATE restore SET status=?, end_time=? WHERE id=?", status, endTime, restoreID)
+	return err
+}
+
+//DeleteRestores deletes all restore records of a backup spec
+func (s *sqlStore) DeleteRestores(backupName string) error {
+	_, err := s.exec("DELETE FROM restore WHERE backup_name=?", backupName)
+	return err
+}
@@ -0,0 +1,60 @@
+package backtor
+
+import (
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type sqliteDialect struct{}
+
+//NewSQLiteStore opens (and creates if needed) a SQLite database file
+func NewSQLiteStore(path string) (Store, error) {
+	if !strings.Contains(path, "?") {
+		//wait for locks instead of failing when the reconciler writes from several goroutines
+		path = path + "?_busy_timeout=5000"
+	}
+	s, err := openSQLStore(sqliteDialect{}, path)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (sqliteDialect) driverName() string {
+	return "sqlite3"
+}
+
+func (sqliteDialect) rebind(query string) string {
+	return query
+}
+
+//timeValue timestamps are stored as text with the offset of the time written, so they are compared as julian days
+func (sqliteDialect) timeValue(expr string) string {
+	return "julianday(" + expr + ")"
+}
+
+func (sqliteDialect) unixTime(expr string) string {
+	return "ROUND((julianday(" + expr + ") - 2440587.5) * 86400)"
+}
+
+//lockMigrations the write lock of the database file is taken right away instead of on the first write
+func (sqliteDialect) lockMigrations() []string {
+	return []string{"BEGIN IMMEDIATE"}
+}
+
+//NewMemoryStore opens an empty in-memory SQLite database with the latest schema. Used for simulations
+func NewMemoryStore() (Store, error) {
+	s, err := openSQLStore(sqliteDialect{}, ":memory:")
+	if err != nil {
+		return nil, err
+	}
+	//each connection would see its own empty database
+	s.db.SetMaxOpenConns(1)
+	_, err = s.MigrateUp()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
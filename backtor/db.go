@@ -4,38 +4,204 @@ import (
 	"database/sql"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
-func InitDB() (*sql.DB, error) {
-	// prometheus.MustRegister(metricsSQLCounter)
+//BackupSpecRepository persistence of backup specs
+type BackupSpecRepository interface {
+	CreateBackupSpec(bs BackupSpec) error
+	UpdateBackupSpec(bs BackupSpec) error
+	GetBackupSpec(backupName string) (BackupSpec, error)
+	ListBackupSpecs(enabled *int) ([]BackupSpec, error)
+	DeleteBackupSpec(backupName string) error
+	SetBackupSpecPurging(backupName string) error
+	UpdateBackupSpecRunningCreateWorkflowID(backupName string, runningCreateWorkflowID *string) error
+	//ClearBackupSpecRunningCreateWorkflowID clears the running create workflow only if it is still workflowID. Returns whether it was cleared
+	ClearBackupSpecRunningCreateWorkflowID(backupName string, workflowID string) (bool, error)
+	UpdateBackupSpecLastScheduledTime(backupName string, lastScheduledTime time.Time) error
+	UpdateBackupSpecCatchupPending(backupName string, catchupPending int) error
+}
+
+//MaterializedBackupRepository persistence of materialized backups
+type MaterializedBackupRepository interface {
+	CreateMaterializedBackup(id string, backupName string, dataID *string, status string, startDate time.Time, endDate time.Time, size *float64, backupType string, parentDataID *string, checksum *string) error
+	//CreateMaterializedBackups inserts COMPLETED materialized backups in one transaction
+	CreateMaterializedBackups(backupName string, backups []MaterializedBackup) error
+	//GetMaterializedBackup loads a materialized backup or replica. Returns sql.ErrNoRows if it doesn't exist
+	GetMaterializedBackup(id string) (MaterializedBackup, error)
+	//GetMaterializedBackups lists materialized backups of a backup spec (of all specs if backupName is empty), newest first. Replicas are not included
+	GetMaterializedBackups(backupName string, limit int, tag string, status string, randomOrder bool) ([]MaterializedBackup, error)
+	//ListMaterializedBackups lists a page of the materialized backups matching q and the number of backups matching q in all pages. Replicas are not included
+	ListMaterializedBackups(q MaterializedQuery) ([]MaterializedBackup, int, error)
+	//GetInventoryStats aggregates the materialized backups of all backup specs by backup name. Replicas are not included
+	GetInventoryStats(now time.Time) (map[string]*InventoryStats, error)
+	SetStatusMaterializedBackup(materializedID string, status string, workflowID *string) error
+	//UpdateTagsMaterializedBackups replaces the tags of all materialized backups of backupName in target ("" for the backups created by the spec) by the ones in backups
+	UpdateTagsMaterializedBackups(backupName string, target string, backups []MaterializedBackup) error
+	DeleteMaterializedBackups(backupName string) error
+	SetVerifyMaterializedBackup(materializedID string, verifyStatus string, workflowID *string, checksum *string, verifyTime *time.Time) error
+	GetVerifyingMaterializedBackups(backupName string) ([]MaterializedBackup, error)
+	SetHoldMaterializedBackup(materializedID string, holdBy *string, reason *string, holdTime *time.Time, holdUntil *time.Time) error
+	CreateReplicaBackup(mb MaterializedBackup) error
+	UpdateReplicaBackup(id string, status string, dataID string, endTime time.Time, size float64) error
+	//UpdateReplicaParents points the replicas of backupName in target that depend on oldDataID to newDataID
+	UpdateReplicaParents(backupName string, target string, oldDataID string, newDataID string) error
+	//GetReplicaBackups lists replicas of a backup spec (all specs if empty) in a replication target (all targets if empty), newest first
+	GetReplicaBackups(backupName string, target string, status string) ([]MaterializedBackup, error)
+}
+
+//RestoreRepository persistence of restores
+type RestoreRepository interface {
+	CreateRestore(r Restore) error
+	GetRestores(backupName string, status string) ([]Restore, error)
+	SetStatusRestore(restoreID string, status string, endTime *time.Time) error
+	DeleteRestores(backupName string) error
+}
+
+//CatchupRepository persistence of missed schedule detections and catch-up backups
+type CatchupRepository interface {
+	CreateCatchup(c Catchup) error
+	//GetCatchups lists catch-up records of a backup spec (of all specs if backupName is empty), newest first
+	GetCatchups(backupName string) ([]Catchup, error)
+	DeleteCatchups(backupName string) error
+}
+
+//LeaseRepository persistence of the leader election lease
+type LeaseRepository interface {
+	AcquireLease(name string, holder string, address *string, now time.Time, ttl time.Duration) (bool, error)
+	ReleaseLease(name string, holder string) error
+	GetLease(name string) (Lease, error)
+}
+
+//WorkflowEventRepository ids of workflow events already processed, for deduplication
+type WorkflowEventRepository interface {
+	//SaveWorkflowEvent records an event as processed. Returns false if it was already recorded
+	SaveWorkflowEvent(id string, workflowID string, status string, receivedAt time.Time) (bool, error)
+	IsWorkflowEventProcessed(id string) (bool, error)
+	DeleteWorkflowEventsBefore(t time.Time) error
+}
+
+//Migrator versioned schema management
+type Migrator interface {
+	SchemaVersion() (int, error)
+	MigrationsStatus() ([]MigrationStatus, error)
+	MigrateUp() ([]int, error)
+	MigrateDown() (int, error)
+}
+
+//Store all backtor state
+type Store interface {
+	BackupSpecRepository
+	MaterializedBackupRepository
+	RestoreRepository
+	CatchupRepository
+	LeaseRepository
+	WorkflowEventRepository
+	Migrator
+	Close() error
+}
 
-	db0, err := sql.Open("sqlite3", fmt.Sprintf("%s/sqlite.db", opt.DataDir))
+//sqlDialect SQL differences between supported databases
+type sqlDialect interface {
+	//driverName database/sql driver. Also used as the key of migration statements
+	driverName() string
+	//rebind converts '?' placeholders to the database placeholder style
+	rebind(query string) string
+	//timeValue expression that compares and sorts a timestamp column or placeholder in time order
+	timeValue(expr string) string
+	//unixTime expression of a timestamp column as Unix seconds
+	unixTime(expr string) string
+	//lockMigrations statements that begin a transaction holding a lock that only one process migrating the schema can take
+	lockMigrations() []string
+}
+
+//sqlStore Store backed by database/sql. All queries are written with '?' placeholders and rebound by the dialect
+type sqlStore struct {
+	db      *sql.DB
+	dialect sqlDialect
+}
+
+//InitStore opens the store and applies pending schema migrations
+func InitStore() (Store, error) {
+	s, err := OpenStore(opt)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := s.MigrateUp()
 	if err != nil {
+		s.Close()
 		return nil, err
 	}
+	if len(applied) > 0 {
+		logrus.Infof("Schema migrations applied: %v", applied)
+	}
+	return s, nil
+}
 
-	statement, err1 := db0.Prepare("CREATE TABLE IF NOT EXISTS backup_spec (name TEXT, enabled INTEGER NOT NULL, worker_config TEXT, timeout_seconds INTEGER, running_create_workflow TEXT, from_date TIMESTAMP, to_date TIMESTAMP, last_update TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, backup_cron_string TEXT NOT NULL, retention_minutely VARCHAR NOT NULL DEFAULT '0@L', retention_hourly VARCHAR NOT NULL DEFAULT '0@L', retention_daily VARCHAR NOT NULL DEFAULT '4@L', retention_weekly VARCHAR NOT NULL DEFAULT '4@L', retention_monthly VARCHAR NOT NULL DEFAULT '3@L', retention_yearly VARCHAR NOT NULL DEFAULT '2@L', PRIMARY KEY(`name`))")
-	if err1 != nil {
-		return nil, err1
+//OpenStore opens the store configured by --db-url, defaulting to SQLite at <data-dir>/sqlite.db. Schema is not touched
+func OpenStore(opt Options) (Store, error) {
+	if opt.DBURL == "" {
+		os.MkdirAll(opt.DataDir, os.ModePerm)
+		return NewSQLiteStore(fmt.Sprintf("%s/sqlite.db", opt.DataDir))
+	}
+	if strings.HasPrefix(opt.DBURL, "postgres://") || strings.HasPrefix(opt.DBURL, "postgresql://") {
+		return NewPostgresStore(opt.DBURL)
 	}
-	_, err1 = statement.Exec()
-	if err1 != nil {
-		return nil, err1
+	if strings.HasPrefix(opt.DBURL, "sqlite3://") {
+		return NewSQLiteStore(strings.TrimPrefix(opt.DBURL, "sqlite3://"))
 	}
+	return nil, fmt.Errorf("Unsupported database url. Use postgres://... or sqlite3://...")
+}
 
-	statement, err1 = db0.Prepare("CREATE TABLE IF NOT EXISTS materialized_backup (id TEXT NOT NULL, backup_name TEXT NOT NULL, data_id TEXT NOT NULL, status TEXT NOT NULL, running_delete_workflow TEXT, start_time TIMESTAMP NOT NULL, end_time TIMESTAMP NOT NULL, size REAL NOT NULL, minutely INTEGER NOT NULL DEFAULT 0, hourly INTEGER NOT NULL DEFAULT 0, daily INTEGER NOT NULL DEFAULT 0, weekly INTEGER NOT NULL DEFAULT 0, monthly INTEGER NOT NULL DEFAULT 0, yearly INTEGER NOT NULL DEFAULT 0, reference INTEGER NOT NULL DEFAULT 0, PRIMARY KEY(`id`))")
-	if err1 != nil {
-		return nil, err1
+func openSQLStore(dialect sqlDialect, dataSourceName string) (*sqlStore, error) {
+	db0, err := sql.Open(dialect.driverName(), dataSourceName)
+	if err != nil {
+		return nil, err
 	}
-	_, err1 = statement.Exec()
-	if err1 != nil {
-		return nil, err1
+	logrus.Debugf("Database opened. driver=%s", dialect.driverName())
+	return &sqlStore{db: db0, dialect: dialect}, nil
+}
+
+//Close closes the underlying database
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqlStore) exec(query string, args ...interface{}) (sql.Result, error) {
+	res, err := s.db.Exec(s.dialect.rebind(query), args...)
+	if err != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return nil, err
 	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return res, nil
+}
 
-	os.MkdirAll(opt.DataDir, os.ModePerm)
+func (s *sqlStore) query(query string, args ...interface{}) (*sql.Rows, error) {
+	logrus.Debugf("query=%s", query)
+	rows, err := s.db.Query(s.dialect.rebind(query), args...)
+	if err != nil {
+		metricsSQLCounter.WithLabelValues("error").Inc()
+		return nil, err
+	}
+	metricsSQLCounter.WithLabelValues("success").Inc()
+	return rows, nil
+}
 
-	logrus.Debug("Database initialized")
-	return db0, nil
+//rebindNumbered converts '?' placeholders to $1, $2...
+func rebindNumbered(query string) string {
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString(fmt.Sprintf("$%d", n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
 }
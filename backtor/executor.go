@@ -0,0 +1,113 @@
+package backtor
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+//Executor runs backup workflows on a workflow engine (Conductor, shell, etc)
+type Executor interface {
+	//LaunchWorkflow starts a new instance of workflowType with the given input and returns its id
+	LaunchWorkflow(workflowType string, input map[string]interface{}) (workflowID string, err error)
+	//GetWorkflow returns the current state of a workflow instance. Status is set to "NOT_FOUND" if the engine doesn't know the instance
+	GetWorkflow(workflowID string) (WorkflowInstance, error)
+	//TerminateWorkflow stops a running workflow instance
+	TerminateWorkflow(workflowID string, reason string) error
+	//FindWorkflows searches for the most recent workflow instances launched for a backup spec
+	FindWorkflows(backupName string, running bool) ([]WorkflowInstance, error)
+	//GetWorkflowsStatus returns status, start and end time of several workflow instances at once. Unknown instances are absent from the result
+	GetWorkflowsStatus(workflowIDs []string) (map[string]WorkflowInstance, error)
+}
+
+//WorkflowInstance state of a workflow instance as reported by an Executor
+type WorkflowInstance struct {
+	WorkflowID string
+	Status     string
+	DataID     *string
+	DataSizeMB *float64
+	Checksum   *string
+	//BackupType and ParentDataID are reported by create workflows of full/incremental chains
+	BackupType   *string
+	ParentDataID *string
+	StartTime    time.Time
+	EndTime      time.Time
+}
+
+var workflowCreate = "create_backup"
+var workflowRemove = "remove_backup"
+var workflowReplicate = "replicate_backup"
+
+//backup types of full/incremental chains, sent to create workflows and reported back by them
+const backupTypeFull = "full"
+const backupTypeIncremental = "incremental"
+
+//workflowVerify workflow launched for checking that a materialized backup is readable. Set by --verify-workflow-name
+var workflowVerify = "verify_backup"
+
+//launchCreateBackupWorkflow launches the create workflow of a backup. backupType and parentDataID are only sent for specs with incremental backups
+func launchCreateBackupWorkflow(backupName string, timeoutSeconds *int, workerConfig *string, backupType string, parentDataID string) (workflowID string, err error) {
+	logrus.Debugf("startWorkflow backupName=%s", backupName)
+
+	logrus.Debugf("Loading backup definition from DB")
+	bs, err := store.GetBackupSpec(backupName)
+	if err != nil {
+		return "", err
+	}
+
+	if bs.Enabled == 0 {
+		return "", fmt.Errorf("Backup %s cannot be launched because it is not enabled", bs.Name)
+	}
+
+	mi := make(map[string]interface{})
+	mi["backupName"] = bs.Name
+	if timeoutSeconds != nil {
+		mi["timeoutSeconds"] = *timeoutSeconds
+	}
+	if workerConfig != nil {
+		mi["workerConfig"] = *workerConfig
+	}
+	if backupType != "" {
+		mi["backupType"] = backupType
+	}
+	if parentDataID != "" {
+		mi["parentDataId"] = parentDataID
+	}
+
+	workflowID, err = executor.LaunchWorkflow(workflowCreate, mi)
+	if err != nil {
+		return "", err
+	}
+	logrus.Infof("Workflow %s launched for creating backup %s. workflowId=%s", workflowCreate, backupName, workflowID)
+	return workflowID, nil
+}
+
+//launchRemoveBackupWorkflow launches the remove workflow of a backup. target is the replication target of replicas and empty otherwise
+func launchRemoveBackupWorkflow(backupName string, dataID string, target string, timeoutSeconds *int, workerConfig *string) (workflowID string, err error) {
+	logrus.Debugf("removeBackupWorkflow backupName=%s dataID=%s target=%s", backupName, dataID, target)
+
+	mi := make(map[string]interface{})
+	mi["backupName"] = backupName
+	mi["dataId"] = dataID
+	if target != "" {
+		mi["target"] = target
+	}
+	if timeoutSeconds != nil {
+		mi["timeoutSeconds"] = *timeoutSeconds
+	}
+	if workerConfig != nil {
+		mi["workerConfig"] = *workerConfig
+	}
+
+	workflowID, err = executor.LaunchWorkflow(workflowRemove, mi)
+	if err != nil {
+		return "", err
+	}
+	logrus.Infof("Workflow %s launched for removing dataID %s. workflowId=%s", workflowRemove, dataID, workflowID)
+	return workflowID, nil
+}
+
+func getWorkflowInstance(workflowID string) (WorkflowInstance, error) {
+	return executor.GetWorkflow(workflowID)
+}
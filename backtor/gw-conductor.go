@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -25,55 +26,31 @@ var invocationHist = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 	"status",
 })
 
-type WorkflowInstance struct {
-	workflowID string
-	status     string
-	dataID     *string
-	dataSizeMB *float64
-	startTime  time.Time
-	endTime    time.Time
+//ConductorExecutor Executor implementation that launches workflows on Netflix Conductor
+type ConductorExecutor struct {
+	apiURL string
 }
 
-var workflowCreate = "create_backup"
-var workflowRemove = "remove_backup"
+//NewConductorExecutor creates an Executor that calls the Conductor API at apiURL
+func NewConductorExecutor(apiURL string) *ConductorExecutor {
+	return &ConductorExecutor{apiURL: apiURL}
+}
 
 func InitConductor() {
 	prometheus.MustRegister(invocationHist)
 }
 
-func launchCreateBackupWorkflow(backupName string, timeoutSeconds *int, workerConfig *string) (workflowID string, err error) {
-	logrus.Debugf("startWorkflow backupName=%s", backupName)
-
-	logrus.Debugf("Loading backup definition from DB")
-	bs, err := getBackupSpec(backupName)
-	if err != nil {
-		return "", err
-	}
-
-	if bs.Enabled == 0 {
-		return "", fmt.Errorf("Backup %s cannot be launched because it is not enabled", bs.Name)
-	}
-
+//LaunchWorkflow POST /workflow
+func (c *ConductorExecutor) LaunchWorkflow(workflowType string, input map[string]interface{}) (workflowID string, err error) {
 	wf := make(map[string]interface{})
-	wf["name"] = workflowCreate
+	wf["name"] = workflowType
 	// wf["version"] = "1.0"
-	mi := make(map[string]interface{})
-	mi["backupName"] = bs.Name
-	if timeoutSeconds != nil {
-		mi["timeoutSeconds"] = *timeoutSeconds
-	}
-	if timeoutSeconds != nil {
-		mi["timeoutSeconds"] = *timeoutSeconds
-	}
-	if workerConfig != nil {
-		mi["workerConfig"] = *workerConfig
-	}
-	wf["input"] = mi
+	wf["input"] = input
 	wfb, _ := json.Marshal(wf)
 
 	logrus.Debugf("Launching Workflow %s", wf)
-	url := fmt.Sprintf("%s/workflow", opt.ConductorAPIURL)
-	resp, data, err := postHTTP(url, wfb, "backup_create")
+	url := fmt.Sprintf("%s/workflow", c.apiURL)
+	resp, data, err := postHTTP(url, wfb, "launch_"+workflowType)
 	if err != nil {
 		logrus.Errorf("Call to Conductor POST /workflow failed. err=%s", err)
 		return "", err
@@ -82,55 +59,19 @@ func launchCreateBackupWorkflow(backupName string, timeoutSeconds *int, workerCo
 		logrus.Warnf("POST /workflow call status!=200. resp=%v", resp)
 		return "", fmt.Errorf("Failed to create new workflow instance. status=%d", resp.StatusCode)
 	}
-	logrus.Infof("Workflow %s launched for creating backup %s. workflowId=%s", workflowCreate, backupName, string(data))
 	return string(data), nil
 }
 
-func launchRemoveBackupWorkflow(backupName string, dataID string, timeoutSeconds *int, workerConfig *string) (workflowID string, err error) {
-	logrus.Debugf("removeBackupWorkflow backupName=%s dataID=%s", backupName, dataID)
-
-	wf := make(map[string]interface{})
-	wf["name"] = workflowRemove
-	// wf["version"] = "1.0"
-	mi := make(map[string]interface{})
-	mi["backupName"] = backupName
-	mi["dataId"] = dataID
-	if timeoutSeconds != nil {
-		mi["timeoutSeconds"] = *timeoutSeconds
-	}
-	if workerConfig != nil {
-		mi["workerConfig"] = *workerConfig
-	}
-	wf["input"] = mi
-	wfb, _ := json.Marshal(wf)
-
-	logrus.Debugf("Launching Workflow %s", wf)
-	url := fmt.Sprintf("%s/workflow", opt.ConductorAPIURL)
-	resp, data, err := postHTTP(url, wfb, "backup_remove")
-	if err != nil {
-		logrus.Errorf("Call to Conductor POST /workflow failed. err=%s", err)
-		return "", err
-	}
-	if resp.StatusCode != 200 {
-		logrus.Warnf("POST /workflow call status!=200. resp=%v", resp)
-		return "", fmt.Errorf("Failed to create new workflow instance. status=%d", resp.StatusCode)
-	}
-
-	workflowID = string(data)
-	logrus.Infof("Workflow %s launched for removing dataID %s. workflowId=%s", workflowRemove, dataID, workflowID)
-
-	return workflowID, nil
-}
-
-func getWorkflowInstance(workflowID string) (WorkflowInstance, error) {
+//GetWorkflow GET /workflow/{workflowId}
+func (c *ConductorExecutor) GetWorkflow(workflowID string) (WorkflowInstance, error) {
 	logrus.Debugf("getWorkflowInstance %s", workflowID)
 	wi := WorkflowInstance{}
-	resp, data, err := getHTTP(fmt.Sprintf("%s/workflow/%s?includeTasks=false", opt.ConductorAPIURL, workflowID), "get_workflow")
+	resp, data, err := getHTTP(fmt.Sprintf("%s/workflow/%s?includeTasks=false", c.apiURL, workflowID), "get_workflow")
 	if err != nil {
-		return wi, fmt.Errorf("GET /workflow/%s?includeTasks=false failed. err=%s", err, workflowID)
+		return wi, fmt.Errorf("GET /workflow/%s?includeTasks=false failed. err=%s", workflowID, err)
 	}
 	if resp.StatusCode == 404 {
-		wi.status = "NOT_FOUND"
+		wi.Status = "NOT_FOUND"
 		return wi, fmt.Errorf("Workflow not found. workflowId=%s. status=%d", workflowID, resp.StatusCode)
 	}
 	if resp.StatusCode != 200 {
@@ -143,23 +84,44 @@ func getWorkflowInstance(workflowID string) (WorkflowInstance, error) {
 		logrus.Errorf("Error parsing json. err=%s", err)
 		return WorkflowInstance{}, err
 	}
-	wi.workflowID = wfdata["workflowId"].(string)
-	wi.status = wfdata["status"].(string)
+	wi.WorkflowID = wfdata["workflowId"].(string)
+	wi.Status = wfdata["status"].(string)
 	out, exists := wfdata["output"]
-	if exists {
+	if exists && out != nil {
 		wfoutput := out.(map[string]interface{})
 		did, ex := wfoutput["dataId"]
 		if ex {
 			if did != nil {
 				a := did.(string)
-				wi.dataID = &a
+				wi.DataID = &a
 			}
 		}
 		did1, ex1 := wfoutput["dataSizeMB"]
 		if ex1 {
 			if did1 != nil {
 				a := did1.(float64)
-				wi.dataSizeMB = &a
+				wi.DataSizeMB = &a
+			}
+		}
+		cs, ex2 := wfoutput["checksum"]
+		if ex2 {
+			if cs != nil {
+				a := fmt.Sprintf("%v", cs)
+				wi.Checksum = &a
+			}
+		}
+		bt, ex3 := wfoutput["backupType"]
+		if ex3 {
+			if bt != nil {
+				a := fmt.Sprintf("%v", bt)
+				wi.BackupType = &a
+			}
+		}
+		pd, ex4 := wfoutput["parentDataId"]
+		if ex4 {
+			if pd != nil {
+				a := fmt.Sprintf("%v", pd)
+				wi.ParentDataID = &a
 			}
 		}
 	}
@@ -168,7 +130,7 @@ func getWorkflowInstance(workflowID string) (WorkflowInstance, error) {
 	if ex1 {
 		t := int64(et.(float64) / 1000)
 		if t > 0 {
-			wi.startTime = time.Unix(t, 0)
+			wi.StartTime = time.Unix(t, 0)
 		}
 	}
 
@@ -176,13 +138,27 @@ func getWorkflowInstance(workflowID string) (WorkflowInstance, error) {
 	if ex1 {
 		t := int64(et.(float64) / 1000)
 		if t > 0 {
-			wi.endTime = time.Unix(t, 0)
+			wi.EndTime = time.Unix(t, 0)
 		}
 	}
 	return wi, nil
 }
 
-func findWorkflows(backupName string, running bool) (hits int, result map[string]interface{}, err error) {
+//TerminateWorkflow DELETE /workflow/{workflowId}
+func (c *ConductorExecutor) TerminateWorkflow(workflowID string, reason string) error {
+	logrus.Debugf("terminateWorkflow %s", workflowID)
+	resp, _, err := deleteHTTP(fmt.Sprintf("%s/workflow/%s?reason=%s", c.apiURL, workflowID, url.QueryEscape(reason)), "terminate_workflow")
+	if err != nil {
+		return fmt.Errorf("DELETE /workflow/%s failed. err=%s", workflowID, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Couldn't terminate workflow. workflowId=%s. status=%d", workflowID, resp.StatusCode)
+	}
+	return nil
+}
+
+//FindWorkflows GET /workflow/search
+func (c *ConductorExecutor) FindWorkflows(backupName string, running bool) ([]WorkflowInstance, error) {
 	logrus.Debugf("findWorkflows %s", backupName)
 	runstr := ""
 	if running {
@@ -191,23 +167,60 @@ func findWorkflows(backupName string, running bool) (hits int, result map[string
 		runstr = " AND NOT status=RUNNING"
 	}
 	freeText := fmt.Sprintf("backupName=%s%s", backupName, runstr)
-	sr := fmt.Sprintf("%s/workflow/search?freeText=%s&sort=endTime:DESC&size=5", opt.ConductorAPIURL, url.QueryEscape(freeText))
+	return c.searchWorkflows(fmt.Sprintf("freeText=%s&sort=endTime:DESC&size=5", url.QueryEscape(freeText)), "list_workflows")
+}
+
+//GetWorkflowsStatus looks up the status of several workflow instances with a single search request.
+//Instances not indexed by Conductor yet are absent from the result
+func (c *ConductorExecutor) GetWorkflowsStatus(workflowIDs []string) (map[string]WorkflowInstance, error) {
+	logrus.Debugf("getWorkflowsStatus %v", workflowIDs)
+	result := make(map[string]WorkflowInstance)
+	if len(workflowIDs) == 0 {
+		return result, nil
+	}
+	query := fmt.Sprintf("workflowId IN (%s)", strings.Join(workflowIDs, ","))
+	wis, err := c.searchWorkflows(fmt.Sprintf("query=%s&freeText=*&size=%d", url.QueryEscape(query), len(workflowIDs)), "get_workflows_status")
+	if err != nil {
+		return nil, err
+	}
+	for _, wi := range wis {
+		result[wi.WorkflowID] = wi
+	}
+	return result, nil
+}
+
+func (c *ConductorExecutor) searchWorkflows(params string, metricsInfo string) ([]WorkflowInstance, error) {
+	sr := fmt.Sprintf("%s/workflow/search?%s", c.apiURL, params)
 	// logrus.Debugf("WORKFLOW SEARCH URL=%s", sr)
-	resp, data, err := getHTTP(sr, "list_workflows")
+	resp, data, err := getHTTP(sr, metricsInfo)
 	if err != nil {
-		return 0, nil, fmt.Errorf("GET /workflow/search failed. err=%s", err)
+		return nil, fmt.Errorf("GET /workflow/search failed. err=%s", err)
 	}
 	if resp.StatusCode != 200 {
-		return 0, nil, fmt.Errorf("GET /workflow/search failed. status=%d. err=%s", resp.StatusCode, err)
+		return nil, fmt.Errorf("GET /workflow/search failed. status=%d", resp.StatusCode)
 	}
-	var wfdata map[string]interface{}
-	err = json.Unmarshal(data, &wfdata)
+	var sresult struct {
+		TotalHits int `json:"totalHits"`
+		Results   []struct {
+			WorkflowID string `json:"workflowId"`
+			Status     string `json:"status"`
+			StartTime  string `json:"startTime"`
+			EndTime    string `json:"endTime"`
+		} `json:"results"`
+	}
+	err = json.Unmarshal(data, &sresult)
 	if err != nil {
 		logrus.Errorf("Error parsing json. err=%s", err)
-		return 0, nil, err
+		return nil, err
+	}
+	wis := make([]WorkflowInstance, 0)
+	for _, r := range sresult.Results {
+		wi := WorkflowInstance{WorkflowID: r.WorkflowID, Status: r.Status}
+		wi.StartTime, _ = time.Parse(time.RFC3339, r.StartTime)
+		wi.EndTime, _ = time.Parse(time.RFC3339, r.EndTime)
+		wis = append(wis, wi)
 	}
-	hits = int(wfdata["totalHits"].(float64))
-	return hits, wfdata, nil
+	return wis, nil
 }
 
 func postHTTP(url string, data []byte, metricsInfo string) (http.Response, []byte, error) {
@@ -271,3 +284,30 @@ func getHTTP(url0 string, metricsInfo string) (http.Response, []byte, error) {
 
 	return *response, datar, nil
 }
+
+func deleteHTTP(url0 string, metricsInfo string) (http.Response, []byte, error) {
+	startTime := time.Now()
+	req, err := http.NewRequest("DELETE", url0, nil)
+	if err != nil {
+		logrus.Errorf("HTTP request creation failed. err=%s", err)
+		return http.Response{}, []byte{}, err
+	}
+
+	client := &http.Client{
+		Timeout: time.Second * 10,
+	}
+	logrus.Debugf("DELETE request=%v", req)
+	response, err1 := client.Do(req)
+	if err1 != nil {
+		logrus.Errorf("HTTP request invocation failed. err=%s", err1)
+		invocationHist.WithLabelValues(metricsInfo, "error").Observe(float64(time.Since(startTime).Seconds()))
+		return http.Response{}, []byte{}, err1
+	}
+
+	datar, _ := ioutil.ReadAll(response.Body)
+	logrus.Debugf("Response body: %s", datar)
+
+	invocationHist.WithLabelValues(metricsInfo, fmt.Sprintf("%d", response.StatusCode)).Observe(float64(time.Since(startTime).Seconds()))
+
+	return *response, datar, nil
+}
@@ -0,0 +1,192 @@
+package backtor
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+//leaseName single lease shared by all replicas using the same database
+const leaseName = "backtor"
+
+//forwardedHeader marks requests proxied from a follower so that they are never proxied twice
+const forwardedHeader = "X-Backtor-Forwarded-By"
+
+var (
+	leaderMutex     sync.Mutex
+	transitionMutex sync.Mutex
+	//leaderUntil local deadline of the lease. Leadership is lost when it passes without a renewal
+	leaderUntil time.Time
+	//leading whether the leader duties (timers, purge) are currently running in this replica
+	leading bool
+
+	leaderGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "backtor_leader",
+		Help: "1 if this replica is the leader running schedules and retention, 0 otherwise",
+	})
+	leaderTransitionsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "backtor_leader_transitions_total",
+		Help: "Times this replica gained or lost leadership",
+	}, []string{
+		"transition",
+	})
+)
+
+//InitLeaderElection registers metrics and fills default election options
+func InitLeaderElection() {
+	prometheus.MustRegister(leaderGauge)
+	prometheus.MustRegister(leaderTransitionsCounter)
+	if opt.NodeID == "" {
+		opt.NodeID = defaultNodeID()
+	}
+	if opt.LeaseTimeout == 0 {
+		opt.LeaseTimeout = 30 * time.Second
+	}
+}
+
+func defaultNodeID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "backtor"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+//launchLeaderElection tries to acquire the lease right away and then keeps renewing it (or waiting for it) in background
+func launchLeaderElection() {
+	runLeaderElection()
+	go func() {
+		for {
+			time.Sleep(opt.LeaseTimeout / 3)
+			runLeaderElection()
+		}
+	}()
+}
+
+//isLeader whether this replica currently holds a valid lease
+func isLeader() bool {
+	leaderMutex.Lock()
+	defer leaderMutex.Unlock()
+	return time.Now().Before(leaderUntil)
+}
+
+//runLeaderElection one round of lease acquisition/renewal. Starts or stops leader duties on transitions
+func runLeaderElection() {
+	var address *string
+	if opt.AdvertiseURL != "" {
+		address = &opt.AdvertiseURL
+	}
+
+	start := time.Now()
+	acquired, err := store.AcquireLease(leaseName, opt.NodeID, address, start, opt.LeaseTimeout)
+
+	leaderMutex.Lock()
+	if err != nil {
+		//keep the current deadline. If renewals keep failing, leadership is lost when it passes
+		logrus.Warnf("Couldn't acquire leader lease. err=%s", err)
+	} else if acquired {
+		leaderUntil = start.Add(opt.LeaseTimeout)
+	} else {
+		leaderUntil = time.Time{}
+	}
+	leaderMutex.Unlock()
+
+	updateLeadership()
+}
+
+//stepDown stops leader duties and releases the lease so that another replica can take over immediately
+func stepDown() {
+	leaderMutex.Lock()
+	leaderUntil = time.Time{}
+	leaderMutex.Unlock()
+	updateLeadership()
+
+	err := store.ReleaseLease(leaseName, opt.NodeID)
+	if err != nil {
+		logrus.Warnf("Couldn't release leader lease. err=%s", err)
+	}
+}
+
+func updateLeadership() {
+	transitionMutex.Lock()
+	defer transitionMutex.Unlock()
+	leader := isLeader()
+	if leader == leading {
+		return
+	}
+	leading = leader
+
+	if leader {
+		logrus.Infof("This replica (%s) is now the leader. Starting schedules", opt.NodeID)
+		leaderGauge.Set(1)
+		leaderTransitionsCounter.WithLabelValues("acquired").Inc()
+		err := prepareTimers()
+		if err != nil {
+			logrus.Errorf("Error preparing timers after becoming leader. err=%s", err)
+		}
+		startPurgeRoutine()
+		return
+	}
+
+	logrus.Infof("This replica (%s) is not the leader anymore. Stopping schedules", opt.NodeID)
+	leaderGauge.Set(0)
+	leaderTransitionsCounter.WithLabelValues("lost").Inc()
+	stopTimers()
+	stopPurgeRoutine()
+}
+
+//leaderOnly lets read requests through on all replicas. Mutating requests received by a follower
+//are proxied to the leader when it advertises an address and rejected with 503 otherwise
+func leaderOnly() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead || c.Request.Method == http.MethodOptions || isLeader() {
+			c.Next()
+			return
+		}
+
+		l, err := store.GetLease(leaseName)
+		if err != nil && err != sql.ErrNoRows {
+			logrus.Warnf("Couldn't load leader lease. err=%s", err)
+		}
+		if err != nil || l.Address == nil || *l.Address == "" || c.GetHeader(forwardedHeader) != "" || time.Now().After(l.ExpiresAt) {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"message": "This replica is not the leader and the leader address is unknown. Try again later", "leader": l.Holder})
+			return
+		}
+
+		target, err := url.Parse(*l.Address)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"message": fmt.Sprintf("Invalid leader address %s", *l.Address), "leader": l.Holder})
+			return
+		}
+		logrus.Debugf("Proxying %s %s to leader %s at %s", c.Request.Method, c.Request.URL.Path, l.Holder, *l.Address)
+		c.Request.Header.Set(forwardedHeader, opt.NodeID)
+		httputil.NewSingleHostReverseProxy(target).ServeHTTP(c.Writer, c.Request)
+		c.Abort()
+	}
+}
+
+func (h *HTTPServer) setupLeaderHandlers() {
+	h.router.GET("/leader", getLeader())
+}
+
+func getLeader() func(*gin.Context) {
+	return func(c *gin.Context) {
+		l, err := store.GetLease(leaseName)
+		if err != nil && err != sql.ErrNoRows {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Error loading leader lease"})
+			apiInvocationsCounter.WithLabelValues("leader", "error").Inc()
+			return
+		}
+		apiInvocationsCounter.WithLabelValues("leader", "success").Inc()
+		c.JSON(http.StatusOK, gin.H{"nodeId": opt.NodeID, "leader": isLeader(), "lease": l})
+	}
+}
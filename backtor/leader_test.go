@@ -0,0 +1,112 @@
+package backtor
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcquireLease(t *testing.T) {
+	_, teardown := setupTest(t)
+	defer teardown()
+
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	ok, err := store.AcquireLease("l", "a", nil, t0, 10*time.Second)
+	require.Nil(t, err)
+	assert.True(t, ok)
+
+	ok, err = store.AcquireLease("l", "b", nil, t0.Add(1*time.Second), 10*time.Second)
+	require.Nil(t, err)
+	assert.False(t, ok, "lease is held by a")
+
+	ok, err = store.AcquireLease("l", "a", nil, t0.Add(5*time.Second), 10*time.Second)
+	require.Nil(t, err)
+	assert.True(t, ok, "holder renews")
+
+	ok, err = store.AcquireLease("l", "b", nil, t0.Add(14*time.Second), 10*time.Second)
+	require.Nil(t, err)
+	assert.False(t, ok, "renewed lease is still valid")
+
+	ok, err = store.AcquireLease("l", "b", nil, t0.Add(16*time.Second), 10*time.Second)
+	require.Nil(t, err)
+	assert.True(t, ok, "expired lease is taken over")
+
+	l, err := store.GetLease("l")
+	require.Nil(t, err)
+	assert.Equal(t, "b", l.Holder)
+
+	require.Nil(t, store.ReleaseLease("l", "b"))
+	ok, err = store.AcquireLease("l", "a", nil, t0.Add(17*time.Second), 10*time.Second)
+	require.Nil(t, err)
+	assert.True(t, ok, "released lease is free")
+}
+
+func TestLeadershipStartsAndStopsTimers(t *testing.T) {
+	_, teardown := setupTest(t)
+	defer teardown()
+
+	createTestBackupSpec(t, BackupSpec{Name: "test"})
+
+	opt.NodeID = "a"
+	opt.LeaseTimeout = time.Minute
+	runLeaderElection()
+	assert.True(t, isLeader())
+	assert.Equal(t, 1, len(scheduledRoutineHashes))
+
+	//another replica takes over after this one released the lease
+	require.Nil(t, store.ReleaseLease(leaseName, "a"))
+	ok, err := store.AcquireLease(leaseName, "b", nil, time.Now(), time.Minute)
+	require.Nil(t, err)
+	require.True(t, ok)
+
+	runLeaderElection()
+	assert.False(t, isLeader())
+	assert.Equal(t, 0, len(scheduledRoutineHashes))
+	assert.Nil(t, prepareTimers())
+	assert.Equal(t, 0, len(scheduledRoutineHashes), "followers never schedule backups")
+}
+
+func TestFollowerProxiesMutatingCalls(t *testing.T) {
+	_, teardown := setupTest(t)
+	defer teardown()
+
+	var forwardedBy string
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedBy = r.Header.Get(forwardedHeader)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer leader.Close()
+
+	opt.NodeID = "follower"
+	router := gin.New()
+	router.Use(leaderOnly())
+	router.GET("/backup", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.POST("/backup", func(c *gin.Context) { c.Status(http.StatusTeapot) })
+
+	follower := httptest.NewServer(router)
+	defer follower.Close()
+
+	//no leader
+	resp, err := http.Post(follower.URL+"/backup", "application/json", nil)
+	require.Nil(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	address := leader.URL
+	ok, err := store.AcquireLease(leaseName, "leader", &address, time.Now(), time.Minute)
+	require.Nil(t, err)
+	require.True(t, ok)
+
+	resp, err = http.Get(follower.URL + "/backup")
+	require.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "reads are served by followers")
+
+	resp, err = http.Post(follower.URL+"/backup", "application/json", nil)
+	require.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "follower", forwardedBy)
+}
@@ -0,0 +1,172 @@
+package backtor
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+//METRICS
+//inventory gauges are recalculated from the database on each scrape so that removed specs disappear
+var backupLastCompletedGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "backtor_backup_last_completed_timestamp_seconds",
+	Help: "Unix end time of the newest COMPLETED materialized backup",
+}, []string{
+	"backup",
+})
+
+var backupMaterializedCountGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "backtor_backup_materialized_count",
+	Help: "COMPLETED materialized backups per tag",
+}, []string{
+	"backup",
+	"tag",
+})
+
+var backupMaterializedSizeGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "backtor_backup_materialized_size_mbytes",
+	Help: "Total size of COMPLETED materialized backups per tag",
+}, []string{
+	"backup",
+	"tag",
+})
+
+var backupMaterializedStatusGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "backtor_backup_materialized_status_count",
+	Help: "Materialized backups in deleting or delete-error status",
+}, []string{
+	"backup",
+	"status",
+})
+
+var backupCreateRunningGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "backtor_backup_create_running",
+	Help: "1 if a create workflow is currently running for the backup spec",
+}, []string{
+	"backup",
+})
+
+var backupLastVerifiedGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "backtor_backup_last_verified_timestamp_seconds",
+	Help: "Unix time of the newest finished verification of a COMPLETED materialized backup",
+}, []string{
+	"backup",
+})
+
+var backupVerifyStatusGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "backtor_backup_verify_status_count",
+	Help: "COMPLETED materialized backups per verify status (never, RUNNING, passed, failed)",
+}, []string{
+	"backup",
+	"status",
+})
+
+var backupQuotaLimitGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "backtor_backup_quota_limit",
+	Help: "Quota of the backup spec. 'size' in megabytes (maxTotalSizeMB) or 'count' (maxBackupCount). Only set when the quota is defined",
+}, []string{
+	"backup",
+	"quota",
+})
+
+var backupQuotaUtilizationGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "backtor_backup_quota_utilization_ratio",
+	Help: "Size or count of the retained backups divided by the spec's quota. Above 1 while retention hasn't caught up",
+}, []string{
+	"backup",
+	"quota",
+})
+
+var inventoryMutex sync.Mutex
+
+//InitMetrics registers inventory and database metrics
+func InitMetrics() {
+	prometheus.MustRegister(metricsSQLCounter)
+	prometheus.MustRegister(backupLastCompletedGauge)
+	prometheus.MustRegister(backupMaterializedCountGauge)
+	prometheus.MustRegister(backupMaterializedSizeGauge)
+	prometheus.MustRegister(backupMaterializedStatusGauge)
+	prometheus.MustRegister(backupCreateRunningGauge)
+	prometheus.MustRegister(backupLastVerifiedGauge)
+	prometheus.MustRegister(backupVerifyStatusGauge)
+	prometheus.MustRegister(backupQuotaLimitGauge)
+	prometheus.MustRegister(backupQuotaUtilizationGauge)
+}
+
+func (h *HTTPServer) setupMetricsHandlers() {
+	ph := promhttp.Handler()
+	h.router.GET("/metrics", func(c *gin.Context) {
+		//held until the gauges are gathered so that concurrent scrapes don't see them half reset
+		inventoryMutex.Lock()
+		defer inventoryMutex.Unlock()
+		err := updateInventoryMetrics()
+		if err != nil {
+			logrus.Warnf("Couldn't update inventory metrics. err=%s", err)
+		}
+		ph.ServeHTTP(c.Writer, c.Request)
+	})
+}
+
+//updateInventoryMetrics recalculates the per spec inventory gauges from the database. Callers must hold inventoryMutex
+func updateInventoryMetrics() error {
+	bss, err := store.ListBackupSpecs(nil)
+	if err != nil {
+		return err
+	}
+	stats, err := store.GetInventoryStats(time.Now())
+	if err != nil {
+		return err
+	}
+
+	backupLastCompletedGauge.Reset()
+	backupMaterializedCountGauge.Reset()
+	backupMaterializedSizeGauge.Reset()
+	backupMaterializedStatusGauge.Reset()
+	backupCreateRunningGauge.Reset()
+	backupLastVerifiedGauge.Reset()
+	backupVerifyStatusGauge.Reset()
+	backupQuotaLimitGauge.Reset()
+	backupQuotaUtilizationGauge.Reset()
+
+	for _, bs := range bss {
+		running := 0.0
+		if bs.RunningCreateWorkflowID != nil {
+			running = 1
+		}
+		backupCreateRunningGauge.WithLabelValues(bs.Name).Set(running)
+
+		st, ok := stats[bs.Name]
+		if !ok {
+			st = &InventoryStats{}
+		}
+		if st.LastCompleted > 0 {
+			backupLastCompletedGauge.WithLabelValues(bs.Name).Set(st.LastCompleted)
+		}
+		if st.LastVerified > 0 {
+			backupLastVerifiedGauge.WithLabelValues(bs.Name).Set(st.LastVerified)
+		}
+		for _, vs := range []string{"never", "RUNNING", "passed", "failed"} {
+			backupVerifyStatusGauge.WithLabelValues(bs.Name, vs).Set(st.VerifyCount[vs])
+		}
+		for _, tag := range append([]string{"all"}, retentionTiers(bs)...) {
+			backupMaterializedCountGauge.WithLabelValues(bs.Name, tag).Set(st.TagCount[tag])
+			backupMaterializedSizeGauge.WithLabelValues(bs.Name, tag).Set(st.TagSize[tag])
+		}
+		for _, status := range []string{"deleting", "delete-error"} {
+			backupMaterializedStatusGauge.WithLabelValues(bs.Name, status).Set(st.StatusCount[status])
+		}
+		if bs.MaxTotalSizeMB > 0 {
+			backupQuotaLimitGauge.WithLabelValues(bs.Name, "size").Set(bs.MaxTotalSizeMB)
+			backupQuotaUtilizationGauge.WithLabelValues(bs.Name, "size").Set(st.QuotaSize / bs.MaxTotalSizeMB)
+		}
+		if bs.MaxBackupCount > 0 {
+			backupQuotaLimitGauge.WithLabelValues(bs.Name, "count").Set(float64(bs.MaxBackupCount))
+			backupQuotaUtilizationGauge.WithLabelValues(bs.Name, "count").Set(float64(st.QuotaCount) / float64(bs.MaxBackupCount))
+		}
+	}
+	return nil
+}
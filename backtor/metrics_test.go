@@ -0,0 +1,60 @@
+package backtor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInventoryMetrics(t *testing.T) {
+	_, teardown := setupTest(t)
+	defer teardown()
+
+	createTestBackupSpec(t, BackupSpec{Name: "test", MaxTotalSizeMB: 40})
+	end := time.Date(2020, 1, 10, 23, 0, 0, 0, time.UTC)
+	size := 10.0
+	for i, status := range []string{"COMPLETED", "COMPLETED", "deleting", "delete-error"} {
+		id := string('a' + rune(i))
+		start := end.Add(time.Duration(-24*i) * time.Hour)
+		require.Nil(t, store.CreateMaterializedBackup(id, "test", &id, status, start, start, &size, "", nil, nil))
+	}
+	require.Nil(t, tagAllBackups("test"))
+	_, err := triggerNewBackup("test")
+	require.Nil(t, err)
+
+	require.Nil(t, updateInventoryMetrics())
+	assert.Equal(t, float64(end.Unix()), testutil.ToFloat64(backupLastCompletedGauge.WithLabelValues("test")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(backupMaterializedCountGauge.WithLabelValues("test", "all")))
+	assert.Equal(t, 20.0, testutil.ToFloat64(backupMaterializedSizeGauge.WithLabelValues("test", "all")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(backupMaterializedCountGauge.WithLabelValues("test", "daily")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(backupMaterializedStatusGauge.WithLabelValues("test", "deleting")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(backupMaterializedStatusGauge.WithLabelValues("test", "delete-error")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(backupCreateRunningGauge.WithLabelValues("test")))
+	assert.Equal(t, 40.0, testutil.ToFloat64(backupQuotaLimitGauge.WithLabelValues("test", "size")))
+	assert.Equal(t, 0.5, testutil.ToFloat64(backupQuotaUtilizationGauge.WithLabelValues("test", "size")))
+
+	//held backups don't count toward the quota and deleted ones are not counted at all
+	verified := end.Add(time.Hour)
+	require.Nil(t, store.SetVerifyMaterializedBackup("a", "passed", nil, nil, &verified))
+	holdBy := "legal"
+	require.Nil(t, store.SetHoldMaterializedBackup("b", &holdBy, nil, &end, nil))
+	deleted := "e"
+	require.Nil(t, store.CreateMaterializedBackup(deleted, "test", &deleted, "deleted", end, end, &size, "", nil, nil))
+	require.Nil(t, updateInventoryMetrics())
+	assert.Equal(t, 2.0, testutil.ToFloat64(backupMaterializedCountGauge.WithLabelValues("test", "all")))
+	assert.Equal(t, 0.25, testutil.ToFloat64(backupQuotaUtilizationGauge.WithLabelValues("test", "size")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(backupVerifyStatusGauge.WithLabelValues("test", "passed")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(backupVerifyStatusGauge.WithLabelValues("test", "never")))
+	assert.Equal(t, float64(verified.Unix()), testutil.ToFloat64(backupLastVerifiedGauge.WithLabelValues("test")))
+
+	require.Nil(t, store.DeleteBackupSpec("test"))
+	require.Nil(t, updateInventoryMetrics())
+	ch := make(chan prometheus.Metric, 10)
+	backupCreateRunningGauge.Collect(ch)
+	close(ch)
+	assert.Equal(t, 0, len(ch), "removed specs must not be exported")
+}
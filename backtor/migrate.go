@@ -0,0 +1,62 @@
+package backtor
+
+import (
+	"fmt"
+	"io"
+)
+
+//Migrate runs a schema migration command (up, down or status) against the database configured in opt0 and writes its report to out
+func Migrate(opt0 Options, action string, out io.Writer) error {
+	s, err := OpenStore(opt0)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	switch action {
+	case "up":
+		applied, err := s.MigrateUp()
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Fprintf(out, "Schema is up to date\n")
+		}
+		for _, v := range applied {
+			fmt.Fprintf(out, "Applied migration %d\n", v)
+		}
+	case "down":
+		reverted, err := s.MigrateDown()
+		if err != nil {
+			return err
+		}
+		if reverted == 0 {
+			fmt.Fprintf(out, "No migrations to revert\n")
+		} else {
+			fmt.Fprintf(out, "Reverted migration %d\n", reverted)
+		}
+	case "status":
+		version, err := s.SchemaVersion()
+		if err != nil {
+			return err
+		}
+		st, err := s.MigrationsStatus()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Schema version: %d (latest known: %d)\n", version, latestSchemaVersion())
+		for _, m := range st {
+			applied := "pending"
+			if m.Applied {
+				applied = "applied"
+			}
+			fmt.Fprintf(out, "%4d %-8s %s\n", m.Version, applied, m.Description)
+		}
+		if version > latestSchemaVersion() {
+			return fmt.Errorf("Database schema version %d is newer than the latest version supported by this backtor (%d)", version, latestSchemaVersion())
+		}
+	default:
+		return fmt.Errorf("Invalid migrate action '%s'. Use up, down or status", action)
+	}
+	return nil
+}
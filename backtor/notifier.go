@@ -0,0 +1,416 @@
+package backtor
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+//notification events
+const (
+	notifyCreateFailed  = "create-failed"
+	notifyMissingOutput = "missing-output"
+	notifyDeleteError   = "delete-error"
+	notifyBackupSkipped = "backup-skipped"
+	notifyMissedBackup  = "missed-backup"
+)
+
+var notifyEvents = []string{notifyCreateFailed, notifyMissingOutput, notifyDeleteError, notifyBackupSkipped, notifyMissedBackup}
+
+//defaultNotifyThrottle min time between two notifications of the same event for the same backup spec
+const defaultNotifyThrottle = 1 * time.Hour
+
+//missedBackupCheckInterval time between checks for backup specs without a recent backup
+const missedBackupCheckInterval = 1 * time.Minute
+
+//smtpTimeout max time for connecting to the SMTP server and sending one email
+var smtpTimeout = 10 * time.Second
+
+const defaultEmailTemplate = `Backup: {{.BackupName}}
+Event: {{.Event}}
+Time: {{.Time.Format "2006-01-02T15:04:05Z07:00"}}
+{{if .WorkflowID}}Workflow: {{.WorkflowID}}
+{{end}}{{if .MaterializedID}}Materialized backup: {{.MaterializedID}}
+{{end}}
+{{.Message}}
+{{if .Suppressed}}
+{{.Suppressed}} notifications of this event were suppressed since the last one.
+{{end}}`
+
+var notificationsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "backtor_notifications_total",
+	Help: "Total notifications sent, failed, throttled or dropped",
+}, []string{
+	"event",
+	"channel",
+	"status",
+})
+
+//NotifyConfig notification channels of a backup spec. Channels set by the global --notify-* flags receive all events of all specs too
+type NotifyConfig struct {
+	WebhookURL string `json:"webhookUrl,omitempty"`
+	//WebhookTemplate text/template of the webhook request body. Defaults to the notification as JSON
+	WebhookTemplate string   `json:"webhookTemplate,omitempty"`
+	EmailTo         []string `json:"emailTo,omitempty"`
+	//EmailTemplate text/template of the email body
+	EmailTemplate string `json:"emailTemplate,omitempty"`
+	//Events sent to the channels of this spec. All events if empty
+	Events []string `json:"events,omitempty"`
+	//MaxBackupAgeSeconds sends 'missed-backup' when the newest COMPLETED backup is older than this. Disabled if 0
+	MaxBackupAgeSeconds int `json:"maxBackupAgeSeconds,omitempty"`
+}
+
+//Notification data available to notification templates
+type Notification struct {
+	Event          string    `json:"event"`
+	BackupName     string    `json:"backupName"`
+	Message        string    `json:"message"`
+	WorkflowID     string    `json:"workflowId,omitempty"`
+	MaterializedID string    `json:"materializedId,omitempty"`
+	Time           time.Time `json:"time"`
+	//Suppressed notifications of the same event and backup spec throttled since the last one sent
+	Suppressed int `json:"suppressed"`
+}
+
+//notifyQueueSize max notifications waiting to be sent. Notifications are dropped when the queue is full
+const notifyQueueSize = 100
+
+var (
+	//notifyQueue notifications are sent by a background worker so that slow channels don't block the tasks that raise them
+	notifyQueue   = make(chan func(), notifyQueueSize)
+	notifyWorker  sync.Once
+	notifyPending sync.WaitGroup
+)
+
+var (
+	notifyMutex sync.Mutex
+	//notifyLast when each event was last sent for each backup spec and how many were suppressed since then
+	notifyLast       = make(map[string]time.Time)
+	notifySuppressed = make(map[string]int)
+)
+
+//InitNotifier registers notification metrics
+func InitNotifier() {
+	prometheus.MustRegister(notificationsCounter)
+}
+
+//notify queues a notification to the global channels and to the channels of the backup spec.
+//Repeated notifications of the same event for the same spec are throttled
+func notify(n Notification) {
+	if n.Time.IsZero() {
+		n.Time = time.Now()
+	}
+	throttle := opt.NotifyThrottle
+	if throttle == 0 {
+		throttle = defaultNotifyThrottle
+	}
+
+	key := n.Event + "|" + n.BackupName
+	notifyMutex.Lock()
+	last, ok := notifyLast[key]
+	if ok && n.Time.Sub(last) < throttle {
+		notifySuppressed[key]++
+		notifyMutex.Unlock()
+		logrus.Debugf("Notification %s for %s throttled", n.Event, n.BackupName)
+		notificationsCounter.WithLabelValues(n.Event, "", "throttled").Inc()
+		return
+	}
+	n.Suppressed = notifySuppressed[key]
+	notifyLast[key] = n.Time
+	notifySuppressed[key] = 0
+	notifyMutex.Unlock()
+
+	logrus.Infof("Sending notification %s for backup %s. message=%s", n.Event, n.BackupName, n.Message)
+	webhookURL, webhookTemplate, emailTo := opt.NotifyWebhookURL, opt.NotifyWebhookTemplate, opt.NotifyEmailTo
+	if webhookURL != "" {
+		enqueueNotification(n, "webhook", func() error {
+			return sendWebhook(webhookURL, webhookTemplate, n)
+		})
+	}
+	if opt.NotifySMTPAddr != "" && len(emailTo) > 0 {
+		enqueueNotification(n, "email", func() error {
+			return sendEmail(emailTo, "", n)
+		})
+	}
+
+	bs, err := store.GetBackupSpec(n.BackupName)
+	if err != nil || bs.Notify == nil || !notifyEventEnabled(*bs.Notify, n.Event) {
+		return
+	}
+	if bs.Notify.WebhookURL != "" {
+		enqueueNotification(n, "webhook", func() error {
+			return sendWebhook(bs.Notify.WebhookURL, bs.Notify.WebhookTemplate, n)
+		})
+	}
+	if len(bs.Notify.EmailTo) > 0 {
+		if opt.NotifySMTPAddr == "" {
+			logrus.Warnf("Backup spec %s has 'emailTo' set but --notify-smtp-addr is not set", n.BackupName)
+			return
+		}
+		enqueueNotification(n, "email", func() error {
+			return sendEmail(bs.Notify.EmailTo, bs.Notify.EmailTemplate, n)
+		})
+	}
+}
+
+//enqueueNotification queues a notification to be sent to one channel by the notification worker
+func enqueueNotification(n Notification, channel string, send func() error) {
+	notifyWorker.Do(func() {
+		go func() {
+			for f := range notifyQueue {
+				f()
+			}
+		}()
+	})
+	notifyPending.Add(1)
+	select {
+	case notifyQueue <- func() {
+		defer notifyPending.Done()
+		sendNotification(n, channel, send)
+	}:
+	default:
+		notifyPending.Done()
+		logrus.Warnf("Notification queue is full. Dropping %s notification %s for %s", channel, n.Event, n.BackupName)
+		notificationsCounter.WithLabelValues(n.Event, channel, "dropped").Inc()
+	}
+}
+
+func sendNotification(n Notification, channel string, send func() error) {
+	err := send()
+	if err != nil {
+		logrus.Warnf("Couldn't send %s notification %s for %s. err=%s", channel, n.Event, n.BackupName, err)
+		notificationsCounter.WithLabelValues(n.Event, channel, "error").Inc()
+		return
+	}
+	notificationsCounter.WithLabelValues(n.Event, channel, "sent").Inc()
+}
+
+func notifyEventEnabled(nc NotifyConfig, event string) bool {
+	if len(nc.Events) == 0 {
+		return true
+	}
+	for _, e := range nc.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func sendWebhook(webhookURL string, tmpl string, n Notification) error {
+	var body []byte
+	if tmpl == "" {
+		data, err := json.Marshal(n)
+		if err != nil {
+			return err
+		}
+		body = data
+	} else {
+		data, err := renderNotification(tmpl, n)
+		if err != nil {
+			return err
+		}
+		body = []byte(data)
+	}
+
+	client := &http.Client{
+		Timeout: time.Second * 10,
+	}
+	resp, err := client.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func sendEmail(to []string, tmpl string, n Notification) error {
+	if tmpl == "" {
+		tmpl = defaultEmailTemplate
+	}
+	body, err := renderNotification(tmpl, n)
+	if err != nil {
+		return err
+	}
+	from := opt.NotifyEmailFrom
+	if from == "" {
+		from = "backtor@localhost"
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: [backtor] %s %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s", from, strings.Join(to, ", "), n.Event, n.BackupName, body)
+
+	for _, addr := range append([]string{from}, to...) {
+		if strings.ContainsAny(addr, "\r\n") {
+			return fmt.Errorf("Invalid email address %q", addr)
+		}
+	}
+
+	//same steps as smtp.SendMail, but with a deadline so that a stuck SMTP server doesn't block the notifier
+	conn, err := net.DialTimeout("tcp", opt.NotifySMTPAddr, smtpTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = conn.SetDeadline(time.Now().Add(smtpTimeout))
+	if err != nil {
+		return err
+	}
+	host := strings.Split(opt.NotifySMTPAddr, ":")[0]
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		err = c.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return err
+		}
+	}
+	if opt.NotifySMTPUser != "" {
+		err = c.Auth(smtp.PlainAuth("", opt.NotifySMTPUser, opt.NotifySMTPPassword, host))
+		if err != nil {
+			return err
+		}
+	}
+	err = c.Mail(from)
+	if err != nil {
+		return err
+	}
+	for _, addr := range to {
+		err = c.Rcpt(addr)
+		if err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write([]byte(msg))
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func renderNotification(tmpl string, n Notification) (string, error) {
+	t, err := parseNotifyTemplate(tmpl)
+	if err != nil {
+		return "", err
+	}
+	buf := &bytes.Buffer{}
+	err = t.Execute(buf, n)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't render notification template. err=%s", err)
+	}
+	return buf.String(), nil
+}
+
+//parseNotifyTemplate parses a notification template. The 'json' function quotes values for JSON payloads. Ex.: {"text": {{json .Message}}}
+func parseNotifyTemplate(tmpl string) (*template.Template, error) {
+	return template.New("notification").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			data, err := json.Marshal(v)
+			return string(data), err
+		},
+	}).Parse(tmpl)
+}
+
+//checkNotifyConfig checks the notification settings of a backup spec
+func checkNotifyConfig(bs BackupSpec) error {
+	if bs.Notify == nil {
+		return nil
+	}
+	nc := bs.Notify
+	if nc.WebhookURL != "" {
+		u, err := url.Parse(nc.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("'webhookUrl' must be an http or https url")
+		}
+	}
+	for _, t := range []string{nc.WebhookTemplate, nc.EmailTemplate} {
+		_, err := parseNotifyTemplate(t)
+		if err != nil {
+			return fmt.Errorf("Invalid template. err=%s", err)
+		}
+	}
+	for _, e := range nc.Events {
+		known := false
+		for _, ke := range notifyEvents {
+			if e == ke {
+				known = true
+			}
+		}
+		if !known {
+			return fmt.Errorf("Unknown event %s. Events are %s", e, strings.Join(notifyEvents, ", "))
+		}
+	}
+	if nc.MaxBackupAgeSeconds < 0 {
+		return fmt.Errorf("'maxBackupAgeSeconds' must not be negative")
+	}
+	return nil
+}
+
+//launchMissedBackupCheck periodically looks for backup specs without a recent COMPLETED backup. Only the leader checks
+func launchMissedBackupCheck() {
+	go func() {
+		for {
+			time.Sleep(missedBackupCheckInterval)
+			if isLeader() {
+				checkMissedBackups(time.Now())
+			}
+		}
+	}()
+}
+
+//checkMissedBackups sends 'missed-backup' for enabled specs whose newest COMPLETED backup is older than their 'maxBackupAgeSeconds'
+func checkMissedBackups(now time.Time) {
+	a := 1
+	bss, err := store.ListBackupSpecs(&a)
+	if err != nil {
+		logrus.Warnf("Couldn't list backup specs for checking missed backups. err=%s", err)
+		return
+	}
+	for _, bs := range bss {
+		if bs.Notify == nil || bs.Notify.MaxBackupAgeSeconds == 0 || bs.Purging == 1 {
+			continue
+		}
+		if (bs.FromDate != nil && now.Before(*bs.FromDate)) || (bs.ToDate != nil && now.After(*bs.ToDate)) {
+			continue
+		}
+		mbs, err := store.GetMaterializedBackups(bs.Name, 1, "", "COMPLETED", false)
+		if err != nil {
+			logrus.Warnf("Couldn't load last backup of %s. err=%s", bs.Name, err)
+			continue
+		}
+		//specs that were just created or changed get a full window
+		last := bs.LastUpdate
+		if len(mbs) > 0 && mbs[0].EndTime.After(last) {
+			last = mbs[0].EndTime
+		}
+		maxAge := time.Duration(bs.Notify.MaxBackupAgeSeconds) * time.Second
+		if now.Sub(last) > maxAge {
+			notify(Notification{Event: notifyMissedBackup, BackupName: bs.Name, Time: now,
+				Message: fmt.Sprintf("No successful backup of %s since %s (expected every %s)", bs.Name, last.UTC().Format(time.RFC3339), maxAge)})
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package backtor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flaviostutz/backtor/backtor/backtortest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+//webhookRecorder http server that keeps the bodies it receives
+type webhookRecorder struct {
+	*httptest.Server
+	mu     sync.Mutex
+	bodies []string
+}
+
+func newWebhookRecorder() *webhookRecorder {
+	r := &webhookRecorder{}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		data, _ := ioutil.ReadAll(req.Body)
+		r.mu.Lock()
+		r.bodies = append(r.bodies, string(data))
+		r.mu.Unlock()
+	}))
+	return r
+}
+
+func (r *webhookRecorder) received() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.bodies...)
+}
+
+func TestNotifications(t *testing.T) {
+	conductor, teardown := setupTest(t)
+	defer teardown()
+
+	global := newWebhookRecorder()
+	defer global.Close()
+	spec := newWebhookRecorder()
+	defer spec.Close()
+	opt.NotifyWebhookURL = global.URL
+
+	createTestBackupSpec(t, BackupSpec{Name: "test", Notify: &NotifyConfig{
+		WebhookURL:          spec.URL,
+		WebhookTemplate:     `{"text": {{json .Message}}, "event": "{{.Event}}", "suppressed": {{.Suppressed}}}`,
+		Events:              []string{notifyCreateFailed, notifyMissedBackup},
+		MaxBackupAgeSeconds: 3600,
+	}})
+	conductor.Script("create_backup", backtortest.Failed(), backtortest.Failed(), backtortest.Completed("", 0))
+
+	runBackupCycle(t, "test")
+	notifyPending.Wait()
+	require.Equal(t, 1, len(global.received()))
+	n := Notification{}
+	require.Nil(t, json.Unmarshal([]byte(global.received()[0]), &n))
+	assert.Equal(t, notifyCreateFailed, n.Event)
+	assert.Equal(t, "test", n.BackupName)
+	assert.NotEmpty(t, n.WorkflowID)
+
+	require.Equal(t, 1, len(spec.received()))
+	body := make(map[string]interface{})
+	require.Nil(t, json.Unmarshal([]byte(spec.received()[0]), &body))
+	assert.Equal(t, notifyCreateFailed, body["event"])
+	assert.Contains(t, body["text"], "FAILED")
+
+	//repeated failures are throttled
+	runBackupCycle(t, "test")
+	notifyPending.Wait()
+	assert.Equal(t, 1, len(global.received()))
+	assert.Equal(t, 1, len(spec.received()))
+
+	//events not enabled for the spec only go to the global channels
+	runBackupCycle(t, "test")
+	notifyPending.Wait()
+	require.Equal(t, 2, len(global.received()))
+	require.Nil(t, json.Unmarshal([]byte(global.received()[1]), &n))
+	assert.Equal(t, notifyMissingOutput, n.Event)
+	assert.Equal(t, 1, len(spec.received()))
+
+	//the next notification after the throttle window tells how many were suppressed
+	notify(Notification{Event: notifyCreateFailed, BackupName: "test", Message: "failed again", Time: time.Now().Add(2 * time.Hour)})
+	notifyPending.Wait()
+	require.Equal(t, 2, len(spec.received()))
+	require.Nil(t, json.Unmarshal([]byte(spec.received()[1]), &body))
+	assert.Equal(t, 1.0, body["suppressed"])
+
+	checkMissedBackups(time.Now())
+	notifyPending.Wait()
+	assert.Equal(t, 2, len(spec.received()))
+	checkMissedBackups(time.Now().Add(2 * time.Hour))
+	notifyPending.Wait()
+	require.Equal(t, 3, len(spec.received()))
+	require.Nil(t, json.Unmarshal([]byte(spec.received()[2]), &body))
+	assert.Equal(t, notifyMissedBackup, body["event"])
+}
+
+func TestCheckNotifyConfig(t *testing.T) {
+	assert.Nil(t, checkNotifyConfig(BackupSpec{}))
+	assert.Nil(t, checkNotifyConfig(BackupSpec{Notify: &NotifyConfig{WebhookURL: "https://hooks.example.com/x", EmailTemplate: "{{.Message}}"}}))
+	assert.NotNil(t, checkNotifyConfig(BackupSpec{Notify: &NotifyConfig{WebhookURL: "ftp://x"}}))
+	assert.NotNil(t, checkNotifyConfig(BackupSpec{Notify: &NotifyConfig{WebhookTemplate: "{{.Message"}}))
+	assert.NotNil(t, checkNotifyConfig(BackupSpec{Notify: &NotifyConfig{Events: []string{"exploded"}}}))
+}
+
+func TestSendEmailTimeout(t *testing.T) {
+	//accepts connections but never answers the SMTP greeting
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	prevAddr, prevTimeout := opt.NotifySMTPAddr, smtpTimeout
+	defer func() { opt.NotifySMTPAddr, smtpTimeout = prevAddr, prevTimeout }()
+	opt.NotifySMTPAddr = l.Addr().String()
+	smtpTimeout = 200 * time.Millisecond
+
+	start := time.Now()
+	err = sendEmail([]string{"ops@example.com"}, "", Notification{BackupName: "test", Event: notifyCreateFailed})
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < 5*time.Second, "sendEmail must give up after smtpTimeout")
+	assert.NotNil(t, sendEmail([]string{"ops@example.com\r\nRCPT TO:<x@example.com>"}, "", Notification{BackupName: "test"}))
+}
+
+func TestNotifyDoesNotWaitForChannels(t *testing.T) {
+	_, teardown := setupTest(t)
+	defer teardown()
+
+	release := make(chan bool)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	opt.NotifyWebhookURL = slow.URL
+	defer func() { opt.NotifyWebhookURL = "" }()
+
+	start := time.Now()
+	notify(Notification{Event: notifyCreateFailed, BackupName: "test", Message: "failed"})
+	assert.True(t, time.Since(start) < time.Second, "notify must not wait for the webhook")
+	close(release)
+	notifyPending.Wait()
+}
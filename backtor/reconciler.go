@@ -0,0 +1,319 @@
+package backtor
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+//METRICS
+var reconcilerRunsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "backtor_reconciler_runs_total",
+	Help: "Total reconciler runs",
+}, []string{
+	"status",
+})
+
+var reconcilerErrorsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "backtor_reconciler_errors_total",
+	Help: "Total errors found while reconciling workflows",
+}, []string{
+	"kind",
+})
+
+var reconcilerDurationHist = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Name:    "backtor_reconciler_duration_seconds",
+	Help:    "Reconciler run duration",
+	Buckets: []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300},
+})
+
+var reconcilerLastRunGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "backtor_reconciler_last_run_timestamp_seconds",
+	Help: "Unix time of the end of the last reconciler run",
+})
+
+var reconcilerLagGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "backtor_reconciler_lag_seconds",
+	Help: "Highest time between a workflow finishing and the reconciler recording it, in the last run",
+})
+
+var reconcilerPendingGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "backtor_reconciler_pending",
+	Help: "Workflows still running after the last reconciler run",
+}, []string{
+	"kind",
+})
+
+//ReconcilerStatus outcome of the last reconciler run
+type ReconcilerStatus struct {
+	Running         bool           `json:"running"`
+	LastRunStart    *time.Time     `json:"lastRunStart,omitempty"`
+	LastRunEnd      *time.Time     `json:"lastRunEnd,omitempty"`
+	DurationSeconds float64        `json:"durationSeconds"`
+	LagSeconds      float64        `json:"lagSeconds"`
+	Pending         map[string]int `json:"pending"`
+	//Checked workflows checked one by one because they had finished or were missing from the status lookup
+	Checked map[string]int `json:"checked"`
+	Errors  []string       `json:"errors"`
+}
+
+//reconcileItem a tracked workflow (create, delete or restore) and the check that records its outcome
+type reconcileItem struct {
+	kind       string
+	backupName string
+	workflowID string
+	check      func() error
+}
+
+var (
+	reconcilerMutex sync.Mutex
+	//reconcilerRunMutex avoids overlapping runs
+	reconcilerRunMutex sync.Mutex
+	reconcilerStatus   = ReconcilerStatus{Pending: map[string]int{}, Checked: map[string]int{}, Errors: []string{}}
+)
+
+//InitReconciler registers metrics and fills default reconciler options
+func InitReconciler() {
+	prometheus.MustRegister(reconcilerRunsCounter)
+	prometheus.MustRegister(reconcilerErrorsCounter)
+	prometheus.MustRegister(reconcilerDurationHist)
+	prometheus.MustRegister(reconcilerLastRunGauge)
+	prometheus.MustRegister(reconcilerLagGauge)
+	prometheus.MustRegister(reconcilerPendingGauge)
+	if opt.ReconcileInterval == 0 {
+		opt.ReconcileInterval = 1 * time.Minute
+	}
+	if opt.ReconcileConcurrency == 0 {
+		opt.ReconcileConcurrency = 4
+	}
+	if opt.ReconcileBatchSize == 0 {
+		opt.ReconcileBatchSize = 50
+	}
+}
+
+//launchReconciler runs the reconciler every ReconcileInterval on the leader replica
+func launchReconciler() {
+	go func() {
+		for {
+			time.Sleep(opt.ReconcileInterval)
+			if !isLeader() {
+				continue
+			}
+			runReconciler()
+		}
+	}()
+}
+
+//runReconciler scans all running create workflows, materialized backups in 'deleting' status, running restores, verifications and replications
+//and records the outcome of the ones whose workflows have finished
+func runReconciler() ReconcilerStatus {
+	reconcilerRunMutex.Lock()
+	defer reconcilerRunMutex.Unlock()
+
+	start := time.Now()
+	reconcilerMutex.Lock()
+	reconcilerStatus.Running = true
+	reconcilerMutex.Unlock()
+	logrus.Debugf("Reconciler run started")
+
+	st := ReconcilerStatus{LastRunStart: &start, Pending: map[string]int{}, Checked: map[string]int{}, Errors: []string{}}
+	var stMutex sync.Mutex
+	addError := func(kind string, err error) {
+		stMutex.Lock()
+		defer stMutex.Unlock()
+		logrus.Warnf("Reconciler error. kind=%s err=%s", kind, err)
+		reconcilerErrorsCounter.WithLabelValues(kind).Inc()
+		st.Errors = append(st.Errors, fmt.Sprintf("%s: %s", kind, err))
+	}
+
+	items := reconcileItems(addError)
+
+	//one search request per batch instead of one request per workflow
+	statuses := make(map[string]WorkflowInstance)
+	ids := make([]string, 0)
+	for _, it := range items {
+		if it.workflowID != "" {
+			ids = append(ids, it.workflowID)
+		}
+	}
+	for i := 0; i < len(ids); i += opt.ReconcileBatchSize {
+		end := i + opt.ReconcileBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		wis, err := executor.GetWorkflowsStatus(ids[i:end])
+		if err != nil {
+			//workflows of this batch are checked one by one
+			addError("status", err)
+			continue
+		}
+		for id, wi := range wis {
+			statuses[id] = wi
+		}
+	}
+
+	sem := make(chan bool, opt.ReconcileConcurrency)
+	var wg sync.WaitGroup
+	for _, it := range items {
+		wi, found := statuses[it.workflowID]
+		if found && wi.Status == "RUNNING" {
+			st.Pending[it.kind]++
+			continue
+		}
+		if found && !wi.EndTime.IsZero() {
+			lag := time.Since(wi.EndTime).Seconds()
+			if lag > st.LagSeconds {
+				st.LagSeconds = lag
+			}
+		}
+
+		wg.Add(1)
+		sem <- true
+		go func(it reconcileItem) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			err := it.check()
+			if err != nil {
+				addError(it.kind, fmt.Errorf("backup=%s workflowId=%s err=%s", it.backupName, it.workflowID, err))
+				return
+			}
+			stMutex.Lock()
+			st.Checked[it.kind]++
+			stMutex.Unlock()
+		}(it)
+	}
+	wg.Wait()
+
+	end := time.Now()
+	st.LastRunEnd = &end
+	st.DurationSeconds = end.Sub(start).Seconds()
+
+	for _, kind := range []string{"create", "delete", "restore", "verify", "replicate"} {
+		reconcilerPendingGauge.WithLabelValues(kind).Set(float64(st.Pending[kind]))
+	}
+	reconcilerDurationHist.Observe(st.DurationSeconds)
+	reconcilerLastRunGauge.Set(float64(end.Unix()))
+	reconcilerLagGauge.Set(st.LagSeconds)
+	if len(st.Errors) > 0 {
+		reconcilerRunsCounter.WithLabelValues("error").Inc()
+	} else {
+		reconcilerRunsCounter.WithLabelValues("success").Inc()
+	}
+
+	reconcilerMutex.Lock()
+	reconcilerStatus = st
+	reconcilerMutex.Unlock()
+	logrus.Debugf("Reconciler run done. items=%d pending=%v checked=%v errors=%d elapsed=%s", len(items), st.Pending, st.Checked, len(st.Errors), end.Sub(start))
+	return st
+}
+
+func reconcileItems(addError func(string, error)) []reconcileItem {
+	items := make([]reconcileItem, 0)
+
+	bss, err := store.ListBackupSpecs(nil)
+	if err != nil {
+		addError("create", fmt.Errorf("Couldn't list backup specs. err=%s", err))
+	}
+	for _, bs := range bss {
+		if bs.RunningCreateWorkflowID == nil {
+			continue
+		}
+		name := bs.Name
+		items = append(items, reconcileItem{kind: "create", backupName: name, workflowID: *bs.RunningCreateWorkflowID, check: func() error {
+			return checkBackupWorkflow(name)
+		}})
+	}
+
+	mbs, err := store.GetMaterializedBackups("", 0, "", "deleting", false)
+	if err != nil {
+		addError("delete", fmt.Errorf("Couldn't list materialized backups in 'deleting' status. err=%s", err))
+	}
+	rmbs, err := store.GetReplicaBackups("", "", "deleting")
+	if err != nil {
+		addError("delete", fmt.Errorf("Couldn't list replicas in 'deleting' status. err=%s", err))
+	}
+	mbs = append(mbs, rmbs...)
+	for _, mb := range mbs {
+		mb0 := mb
+		wid := ""
+		if mb.RunningDeleteWorkflowID != nil {
+			wid = *mb.RunningDeleteWorkflowID
+		}
+		items = append(items, reconcileItem{kind: "delete", backupName: mb.BackupName, workflowID: wid, check: func() error {
+			return checkBackupRemoveWorkflow(mb0)
+		}})
+	}
+
+	rs, err := store.GetRestores("", "RUNNING")
+	if err != nil {
+		addError("restore", fmt.Errorf("Couldn't list running restores. err=%s", err))
+	}
+	for _, r := range rs {
+		r0 := r
+		items = append(items, reconcileItem{kind: "restore", backupName: r.BackupName, workflowID: r.ID, check: func() error {
+			return checkRestoreWorkflow(r0)
+		}})
+	}
+
+	vmbs, err := store.GetVerifyingMaterializedBackups("")
+	if err != nil {
+		addError("verify", fmt.Errorf("Couldn't list materialized backups being verified. err=%s", err))
+	}
+	for _, mb := range vmbs {
+		mb0 := mb
+		wid := ""
+		if mb.RunningVerifyWorkflowID != nil {
+			wid = *mb.RunningVerifyWorkflowID
+		}
+		items = append(items, reconcileItem{kind: "verify", backupName: mb.BackupName, workflowID: wid, check: func() error {
+			return checkVerifyWorkflow(mb0)
+		}})
+	}
+
+	reps, err := store.GetReplicaBackups("", "", "replicating")
+	if err != nil {
+		addError("replicate", fmt.Errorf("Couldn't list replicas being created. err=%s", err))
+	}
+	for _, mb := range reps {
+		mb0 := mb
+		items = append(items, reconcileItem{kind: "replicate", backupName: mb.BackupName, workflowID: mb.ID, check: func() error {
+			return checkReplicateWorkflow(mb0)
+		}})
+	}
+	return items
+}
+
+func (h *HTTPServer) setupReconcilerHandlers() {
+	h.router.GET("/reconciler", GetReconcilerStatus())
+}
+
+//GetReconcilerStatus shows the outcome of the last reconciler run
+func GetReconcilerStatus() func(*gin.Context) {
+	return func(c *gin.Context) {
+		reconcilerMutex.Lock()
+		st := reconcilerStatus
+		reconcilerMutex.Unlock()
+		apiInvocationsCounter.WithLabelValues("reconciler", "success").Inc()
+		c.JSON(http.StatusOK, gin.H{
+			"leader":            isLeader(),
+			"intervalSeconds":   opt.ReconcileInterval.Seconds(),
+			"lastRun":           st,
+			"lastRunAgeSeconds": lastRunAge(st),
+			"concurrency":       opt.ReconcileConcurrency,
+			"statusBatchSize":   opt.ReconcileBatchSize,
+		})
+	}
+}
+
+func lastRunAge(st ReconcilerStatus) *float64 {
+	if st.LastRunEnd == nil {
+		return nil
+	}
+	age := time.Since(*st.LastRunEnd).Seconds()
+	return &age
+}
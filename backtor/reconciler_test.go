@@ -0,0 +1,61 @@
+package backtor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/flaviostutz/backtor/backtor/backtortest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReconcilerBatchesStatusLookups(t *testing.T) {
+	conductor, teardown := setupTest(t)
+	defer teardown()
+	opt.ReconcileConcurrency = 2
+	opt.ReconcileBatchSize = 50
+
+	createTestBackupSpec(t, BackupSpec{Name: "a"})
+	createTestBackupSpec(t, BackupSpec{Name: "b"})
+
+	wa, err := triggerNewBackup("a")
+	require.Nil(t, err)
+	require.Nil(t, conductor.Finish(wa, backtortest.Completed("a1", 1)))
+	_, err = triggerNewBackup("b")
+	require.Nil(t, err)
+
+	now := time.Now()
+	size := 1.0
+	for _, id := range []string{"old1", "old2"} {
+		dataID := id
+		require.Nil(t, store.CreateMaterializedBackup(id, "a", &dataID, "COMPLETED", now, now, &size, "", nil, nil))
+		require.Nil(t, triggerBackupDelete(id))
+	}
+	removes := conductor.Workflows("remove_backup")
+	require.Equal(t, 2, len(removes))
+	require.Nil(t, conductor.Finish(removes[0].WorkflowID, backtortest.Completed("", 0)))
+
+	searches := conductor.Requests("search")
+	st := runReconciler()
+	assert.Equal(t, searches+1, conductor.Requests("search"), "all statuses must be looked up in a single request")
+	assert.Equal(t, 0, len(st.Errors))
+	assert.Equal(t, map[string]int{"create": 1, "delete": 1}, st.Pending)
+	assert.Equal(t, map[string]int{"create": 1, "delete": 1}, st.Checked)
+
+	mb, err := store.GetMaterializedBackup(wa)
+	require.Nil(t, err)
+	assert.Equal(t, "COMPLETED", mb.Status)
+	mb, err = store.GetMaterializedBackup("old1")
+	require.Nil(t, err)
+	assert.Equal(t, "deleted", mb.Status)
+	mb, err = store.GetMaterializedBackup("old2")
+	require.Nil(t, err)
+	assert.Equal(t, "deleting", mb.Status)
+
+	//2 workflows still tracked, 1 per request
+	opt.ReconcileBatchSize = 1
+	searches = conductor.Requests("search")
+	st = runReconciler()
+	assert.Equal(t, searches+2, conductor.Requests("search"))
+	assert.Equal(t, map[string]int{"create": 1, "delete": 1}, st.Pending)
+}
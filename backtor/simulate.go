@@ -0,0 +1,247 @@
+package backtor
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron"
+)
+
+//SimulationConfig parameters of an offline retention simulation
+type SimulationConfig struct {
+	Spec BackupSpec
+	From time.Time
+	To   time.Time
+	//SuccessRate probability (0 to 1) of a create workflow completing. Ignored if FailurePattern is set
+	SuccessRate float64
+	//FailurePattern outcome of consecutive create workflows, repeated until the end. 'S' is success and 'F' is failure. Ex.: "SSSSSSF"
+	FailurePattern string
+	//Seed for the random success rate outcomes
+	Seed int64
+}
+
+//simExecutor completes workflows as soon as they are launched, at the simulated time
+type simExecutor struct {
+	now       time.Time
+	seq       int
+	workflows map[string]WorkflowInstance
+	createOK  func() bool
+}
+
+func (e *simExecutor) LaunchWorkflow(workflowType string, input map[string]interface{}) (string, error) {
+	e.seq++
+	wid := fmt.Sprintf("sim-%06d", e.seq)
+	wi := WorkflowInstance{WorkflowID: wid, Status: "COMPLETED", StartTime: e.now, EndTime: e.now}
+	if workflowType == workflowCreate {
+		if e.createOK() {
+			dataID := fmt.Sprintf("data-%06d", e.seq)
+			size := 1.0
+			wi.DataID = &dataID
+			wi.DataSizeMB = &size
+		} else {
+			wi.Status = "FAILED"
+		}
+	}
+	if workflowType == workflowReplicate {
+		dataID := fmt.Sprintf("replica-%06d", e.seq)
+		size := 1.0
+		wi.DataID = &dataID
+		wi.DataSizeMB = &size
+	}
+	e.workflows[wid] = wi
+	return wid, nil
+}
+
+func (e *simExecutor) GetWorkflow(workflowID string) (WorkflowInstance, error) {
+	wi, ok := e.workflows[workflowID]
+	if !ok {
+		return WorkflowInstance{WorkflowID: workflowID, Status: "NOT_FOUND"}, fmt.Errorf("Workflow %s not found", workflowID)
+	}
+	return wi, nil
+}
+
+func (e *simExecutor) TerminateWorkflow(workflowID string, reason string) error {
+	return nil
+}
+
+func (e *simExecutor) FindWorkflows(backupName string, running bool) ([]WorkflowInstance, error) {
+	return []WorkflowInstance{}, nil
+}
+
+func (e *simExecutor) GetWorkflowsStatus(workflowIDs []string) (map[string]WorkflowInstance, error) {
+	wis := make(map[string]WorkflowInstance)
+	for _, id := range workflowIDs {
+		if wi, ok := e.workflows[id]; ok {
+			wis[id] = wi
+		}
+	}
+	return wis, nil
+}
+
+//Simulate steps through the backup cron schedule of a spec between From and To, running the same backup, tagging and retention
+//steps of the backup timer against an in-memory database, and writes the timeline of created, tagged and deleted backups to out
+func Simulate(cfg SimulationConfig, out io.Writer) error {
+	bs := cfg.Spec
+	if bs.Name == "" {
+		bs.Name = "simulation"
+	}
+	bs.Enabled = 1
+	bs.RunningCreateWorkflowID = nil
+	bs.FromDate = nil
+	bs.ToDate = nil
+	bs.Notify = nil
+	setBackupSpecDefaultValues(&bs)
+	bs.LastUpdate = cfg.From
+
+	schedule, err := cron.Parse(*bs.BackupCronString)
+	if err != nil {
+		return fmt.Errorf("Invalid backup cron string '%s'. err=%s", *bs.BackupCronString, err)
+	}
+	if !cfg.To.After(cfg.From) {
+		return fmt.Errorf("End date must be after start date")
+	}
+	createOK, err := simOutcomes(cfg)
+	if err != nil {
+		return err
+	}
+
+	s, err := NewMemoryStore()
+	if err != nil {
+		return fmt.Errorf("Couldn't open in-memory database. err=%s", err)
+	}
+	defer s.Close()
+
+	//the simulation uses the same code as the timers, so it replaces the package store and executor while it runs
+	store0, executor0 := store, executor
+	defer func() {
+		store, executor = store0, executor0
+	}()
+	sim := &simExecutor{workflows: make(map[string]WorkflowInstance), createOK: createOK}
+	store, executor = s, sim
+	//simulated failures must not be notified
+	opt0 := opt
+	defer func() {
+		opt = opt0
+	}()
+	opt.NotifyWebhookURL = ""
+	opt.NotifySMTPAddr = ""
+
+	err = store.CreateBackupSpec(bs)
+	if err != nil {
+		return fmt.Errorf("Couldn't create backup spec. err=%s", err)
+	}
+
+	fmt.Fprintf(out, "Simulating backup %s from %s to %s. cron=%s\n", bs.Name, cfg.From.Format(time.RFC3339), cfg.To.Format(time.RFC3339), *bs.BackupCronString)
+	fmt.Fprintf(out, "Retention: minutely=%s hourly=%s daily=%s weekly=%s monthly=%s yearly=%s\n\n", bs.RetentionMinutely, bs.RetentionHourly, bs.RetentionDaily, bs.RetentionWeekly, bs.RetentionMonthly, bs.RetentionYearly)
+	for _, p := range bs.Periods {
+		fmt.Fprintf(out, "Period %s: every %d %s(s), offset=%d keep=%d\n", p.Name, p.Every, p.Unit, p.Offset, p.Keep)
+	}
+	if bs.MaxTotalSizeMB > 0 || bs.MaxBackupCount > 0 {
+		fmt.Fprintf(out, "Quota: maxTotalSizeMB=%.1f maxBackupCount=%d\n", bs.MaxTotalSizeMB, bs.MaxBackupCount)
+	}
+
+	//times are shown in the spec's timezone, or in UTC if it is not set
+	loc := tagLocation(bs)
+	from := cfg.From
+	if specTimezone(bs) != nil {
+		from = from.In(loc)
+	}
+	runs, created, failed, deleted := 0, 0, 0, 0
+	tags := make(map[string]string)
+	for t := schedule.Next(from.Add(-time.Second)); t.Before(cfg.To); t = schedule.Next(t) {
+		sim.now = t
+		runs++
+		ts := t.In(loc).Format(time.RFC3339)
+
+		wid, err := triggerNewBackup(bs.Name)
+		if err != nil {
+			return fmt.Errorf("Couldn't trigger backup at %s. err=%s", ts, err)
+		}
+		checkBackupWorkflow(bs.Name)
+		checkReplicateWorkflows(bs.Name)
+		if sim.workflows[wid].Status != "COMPLETED" {
+			failed++
+			fmt.Fprintf(out, "%s  failed   %s\n", ts, wid)
+		}
+
+		//reasons are calculated before retention because deleted backups are not tagged anymore
+		mbs, err := store.GetMaterializedBackups(bs.Name, 0, "", "COMPLETED", false)
+		if err != nil {
+			return err
+		}
+		reasons := electForDeletion(mbs, bs)
+
+		RunRetentionTask(bs.Name)
+		checkWorkflowBackupRemove(bs.Name)
+
+		all, err := store.GetMaterializedBackups(bs.Name, 0, "", "", false)
+		if err != nil {
+			return err
+		}
+		//oldest first
+		sort.SliceStable(all, func(i, j int) bool {
+			return all[i].StartTime.Before(all[j].StartTime)
+		})
+		for _, mb := range all {
+			if mb.Status == "deleted" {
+				if _, ok := tags[mb.ID]; ok {
+					deleted++
+					fmt.Fprintf(out, "%s  deleted  %s  started=%s  reason=%s\n", ts, mb.ID, mb.StartTime.In(loc).Format(time.RFC3339), reasons[mb.ID])
+					delete(tags, mb.ID)
+				}
+				continue
+			}
+			if mb.Status != "COMPLETED" {
+				continue
+			}
+			tl := strings.Join(getTags(mb), ",")
+			previous, ok := tags[mb.ID]
+			if !ok {
+				created++
+				fmt.Fprintf(out, "%s  created  %s  tags=%s\n", ts, mb.ID, tl)
+			} else if previous != tl {
+				fmt.Fprintf(out, "%s  tagged   %s  started=%s  tags=%s (was %s)\n", ts, mb.ID, mb.StartTime.In(loc).Format(time.RFC3339), tl, previous)
+			}
+			tags[mb.ID] = tl
+		}
+	}
+
+	survivors, err := store.GetMaterializedBackups(bs.Name, 0, "", "COMPLETED", false)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "\nRuns: %d. Created: %d. Failed: %d. Deleted: %d. Surviving: %d\n", runs, created, failed, deleted, len(survivors))
+	for _, mb := range survivors {
+		fmt.Fprintf(out, "  %s  started=%s  tags=%s\n", mb.ID, mb.StartTime.In(loc).Format(time.RFC3339), strings.Join(getTags(mb), ","))
+	}
+	return nil
+}
+
+//simOutcomes returns a function that tells whether the next create workflow of a simulation succeeds
+func simOutcomes(cfg SimulationConfig) (func() bool, error) {
+	if cfg.FailurePattern != "" {
+		p := strings.ToUpper(cfg.FailurePattern)
+		for _, c := range p {
+			if c != 'S' && c != 'F' {
+				return nil, fmt.Errorf("Failure pattern must contain only 'S' (success) and 'F' (failure). pattern=%s", cfg.FailurePattern)
+			}
+		}
+		i := 0
+		return func() bool {
+			ok := p[i%len(p)] == 'S'
+			i++
+			return ok
+		}, nil
+	}
+	if cfg.SuccessRate < 0 || cfg.SuccessRate > 1 {
+		return nil, fmt.Errorf("Success rate must be between 0 and 1. rate=%f", cfg.SuccessRate)
+	}
+	r := rand.New(rand.NewSource(cfg.Seed))
+	return func() bool {
+		return r.Float64() < cfg.SuccessRate
+	}, nil
+}
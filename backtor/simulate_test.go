@@ -0,0 +1,33 @@
+package backtor
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSimulate(t *testing.T) {
+	out := bytes.Buffer{}
+	cfg := SimulationConfig{
+		Spec:           BackupSpec{Name: "sim", RetentionDaily: "3@L", RetentionWeekly: "0@L", RetentionMonthly: "0@L", RetentionYearly: "1@L"},
+		From:           time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		To:             time.Date(2020, 1, 11, 0, 0, 0, 0, time.UTC),
+		FailurePattern: "SSSSF",
+	}
+	err := Simulate(cfg, &out)
+	require.Nil(t, err)
+
+	s := out.String()
+	assert.Equal(t, 2, strings.Count(s, " failed "))
+	assert.Equal(t, 8, strings.Count(s, " created "))
+	//3 daily backups plus the newest one
+	assert.Contains(t, s, "Runs: 10. Created: 8. Failed: 2. Deleted: 4. Surviving: 4")
+	assert.Contains(t, s, "reason=daily retention is 3")
+
+	cfg.FailurePattern = "SX"
+	assert.NotNil(t, Simulate(cfg, &out))
+}
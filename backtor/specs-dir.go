@@ -0,0 +1,341 @@
+package backtor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+//managedByFile marks backup specs loaded from --specs-dir
+const managedByFile = "file"
+
+//specsDirPollInterval time between checks for changed files in --specs-dir
+const specsDirPollInterval = 10 * time.Second
+
+var (
+	specsDirMutex sync.Mutex
+	//specsDirFingerprint names, sizes and modification times of the files last synced
+	specsDirFingerprint string
+)
+
+//launchSpecsDirWatcher syncs backup specs from the files in --specs-dir right away and whenever they change.
+//Only the leader writes them to the database
+func launchSpecsDirWatcher() {
+	if opt.SpecsDir == "" {
+		return
+	}
+	logrus.Infof("Backup specs will be loaded from %s", opt.SpecsDir)
+	go func() {
+		for {
+			if isLeader() {
+				err := syncSpecsDirIfChanged()
+				if err != nil {
+					logrus.Errorf("Couldn't sync backup specs from %s. Database was not changed. err=%s", opt.SpecsDir, err)
+				}
+			}
+			time.Sleep(specsDirPollInterval)
+		}
+	}()
+}
+
+func syncSpecsDirIfChanged() error {
+	specsDirMutex.Lock()
+	defer specsDirMutex.Unlock()
+
+	fp, err := specsDirFiles(opt.SpecsDir)
+	if err != nil {
+		return err
+	}
+	if fp == specsDirFingerprint {
+		return nil
+	}
+	err = syncSpecsDir(opt.SpecsDir)
+	if err != nil {
+		return err
+	}
+	specsDirFingerprint = fp
+	return nil
+}
+
+//specsDirFiles fingerprint of the spec files in dir
+func specsDirFiles(dir string) (string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	fp := ""
+	for _, f := range files {
+		if f.IsDir() || !isSpecFile(f.Name()) {
+			continue
+		}
+		fp = fp + fmt.Sprintf("%s|%d|%d;", f.Name(), f.Size(), f.ModTime().UnixNano())
+	}
+	return fp, nil
+}
+
+func isSpecFile(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext == ".yaml" || ext == ".yml" || ext == ".json"
+}
+
+//syncSpecsDir creates or updates a backup spec for each spec found in the files of dir and disables file managed specs
+//whose files were removed. Nothing is changed if any file is invalid
+func syncSpecsDir(dir string) error {
+	specs, err := loadSpecsDir(dir)
+	if err != nil {
+		return err
+	}
+
+	current, err := store.ListBackupSpecs(nil)
+	if err != nil {
+		return fmt.Errorf("Couldn't list backup specs. err=%s", err)
+	}
+	currentByName := make(map[string]BackupSpec)
+	for _, bs := range current {
+		currentByName[bs.Name] = bs
+	}
+
+	names := make(map[string]bool)
+	for _, bs := range specs {
+		names[bs.Name] = true
+		cur, exists := currentByName[bs.Name]
+		if !exists {
+			bs.LastUpdate = time.Now()
+			err := store.CreateBackupSpec(bs)
+			if err != nil {
+				return fmt.Errorf("Couldn't create backup spec %s. err=%s", bs.Name, err)
+			}
+			logrus.Infof("Backup spec %s created from %s", bs.Name, opt.SpecsDir)
+			continue
+		}
+		if cur.Purging == 1 {
+			logrus.Warnf("Backup spec %s is being purged. Ignoring its file", bs.Name)
+			continue
+		}
+		if cur.ManagedBy != managedByFile {
+			logrus.Warnf("Backup spec %s was created through the API and is now managed by its file", bs.Name)
+		}
+		if sameBackupSpec(cur, bs) {
+			continue
+		}
+		bs.LastUpdate = time.Now()
+		err := store.UpdateBackupSpec(bs)
+		if err != nil {
+			return fmt.Errorf("Couldn't update backup spec %s. err=%s", bs.Name, err)
+		}
+		logrus.Infof("Backup spec %s updated from %s", bs.Name, opt.SpecsDir)
+	}
+
+	//keep data of specs whose files were removed. They are disabled and can be managed through the API again
+	for _, cur := range current {
+		if cur.ManagedBy != managedByFile || names[cur.Name] {
+			continue
+		}
+		cur.Enabled = 0
+		cur.ManagedBy = ""
+		cur.LastUpdate = time.Now()
+		err := store.UpdateBackupSpec(cur)
+		if err != nil {
+			return fmt.Errorf("Couldn't disable backup spec %s. err=%s", cur.Name, err)
+		}
+		logrus.Warnf("Backup spec %s was disabled because its file was removed from %s", cur.Name, opt.SpecsDir)
+	}
+
+	return prepareTimers()
+}
+
+//loadSpecsDir reads all .yaml, .yml and .json files of dir. Each file has a backup spec or a list of backup specs
+func loadSpecsDir(dir string) ([]BackupSpec, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() < files[j].Name()
+	})
+
+	specs := make([]BackupSpec, 0)
+	sources := make(map[string]string)
+	for _, f := range files {
+		if f.IsDir() || !isSpecFile(f.Name()) {
+			continue
+		}
+		path := filepath.Join(dir, f.Name())
+		fspecs, err := loadSpecFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid spec file %s. err=%s", path, err)
+		}
+		for _, bs := range fspecs {
+			if src, ok := sources[bs.Name]; ok {
+				return nil, fmt.Errorf("Backup spec %s is declared in %s and %s", bs.Name, src, path)
+			}
+			sources[bs.Name] = path
+			specs = append(specs, bs)
+		}
+	}
+	return specs, nil
+}
+
+func loadSpecFile(path string) ([]BackupSpec, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if strings.ToLower(filepath.Ext(path)) != ".json" {
+		data, err = yamlToJSON(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	raws := make([]json.RawMessage, 0)
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "[") {
+		err = json.Unmarshal(data, &raws)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		raws = append(raws, json.RawMessage(data))
+	}
+
+	specs := make([]BackupSpec, 0)
+	for _, raw := range raws {
+		bs := BackupSpec{}
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		//catch typos in field names
+		dec.DisallowUnknownFields()
+		err := dec.Decode(&bs)
+		if err != nil {
+			return nil, err
+		}
+		//specs in files are enabled unless stated otherwise
+		fields := make(map[string]interface{})
+		json.Unmarshal(raw, &fields)
+		if _, ok := fields["enabled"]; !ok {
+			bs.Enabled = 1
+		}
+
+		if bs.Name == "" {
+			return nil, fmt.Errorf("'name' is required")
+		}
+		bs.ManagedBy = managedByFile
+		bs.Purging = 0
+		bs.RunningCreateWorkflowID = nil
+		bs.LastScheduledTime = nil
+		bs.CatchupPending = 0
+		setBackupSpecDefaultValues(&bs)
+		err = checkBackupSpecFile(bs)
+		if err != nil {
+			return nil, fmt.Errorf("Backup spec %s: %s", bs.Name, err)
+		}
+		specs = append(specs, bs)
+	}
+	return specs, nil
+}
+
+func checkBackupSpecFile(bs BackupSpec) error {
+	errs := validateBackupSpec(bs)
+	if len(errs) == 0 {
+		return nil
+	}
+	msgs := make([]string, 0)
+	for _, e := range errs {
+		msgs = append(msgs, fmt.Sprintf("Invalid '%s'. %s", e.Field, e.Message))
+	}
+	return fmt.Errorf("%s", strings.Join(msgs, "; "))
+}
+
+//sameBackupSpec whether two specs have the same definition, ignoring runtime state
+func sameBackupSpec(a BackupSpec, b BackupSpec) bool {
+	normalize := func(bs BackupSpec) string {
+		bs.LastUpdate = time.Time{}
+		bs.RunningCreateWorkflowID = nil
+		bs.LastScheduledTime = nil
+		bs.CatchupPending = 0
+		if bs.FromDate != nil {
+			t := bs.FromDate.UTC()
+			bs.FromDate = &t
+		}
+		if bs.ToDate != nil {
+			t := bs.ToDate.UTC()
+			bs.ToDate = &t
+		}
+		data, _ := json.Marshal(bs)
+		return string(data)
+	}
+	return normalize(a) == normalize(b)
+}
+
+//yamlToJSON converts a YAML document to JSON so that specs are decoded with the same field names used by the API
+func yamlToJSON(data []byte) ([]byte, error) {
+	var v interface{}
+	err := yaml.Unmarshal(data, &v)
+	if err != nil {
+		return nil, err
+	}
+	v, err = jsonCompatible(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+func jsonCompatible(v interface{}) (interface{}, error) {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{})
+		for k, val := range t {
+			ks, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("Invalid key %v", k)
+			}
+			cv, err := jsonCompatible(val)
+			if err != nil {
+				return nil, err
+			}
+			m[ks] = cv
+		}
+		return m, nil
+	case []interface{}:
+		l := make([]interface{}, len(t))
+		for i, val := range t {
+			cv, err := jsonCompatible(val)
+			if err != nil {
+				return nil, err
+			}
+			l[i] = cv
+		}
+		return l, nil
+	}
+	return v, nil
+}
+
+//checkManagedBy rejects API changes to specs managed by files in --specs-dir
+func checkManagedBy(bs BackupSpec) error {
+	if bs.ManagedBy == managedByFile {
+		return fmt.Errorf("Backup spec %s is managed by a file in the specs dir and can only be changed there", bs.Name)
+	}
+	return nil
+}
+
+//specsDirExists checks --specs-dir at startup
+func specsDirExists(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	return nil
+}
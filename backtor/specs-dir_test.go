@@ -0,0 +1,80 @@
+package backtor
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncSpecsDir(t *testing.T) {
+	_, teardown := setupTest(t)
+	defer teardown()
+
+	dir, err := ioutil.TempDir("", "backtor-specs")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	opt.SpecsDir = dir
+
+	yamlSpec := "name: db1\nretentionDaily: 7@L\nworkerConfig: '{\"host\": \"db1\"}'\n"
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "db1.yaml"), []byte(yamlSpec), 0644))
+	jsonSpecs := `[{"name": "db2", "enabled": 0}, {"name": "db3", "backupCronString": "0 0 * * * *"}]`
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "others.json"), []byte(jsonSpecs), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "README.md"), []byte("not a spec"), 0644))
+
+	require.Nil(t, syncSpecsDir(dir))
+	bs, err := store.GetBackupSpec("db1")
+	require.Nil(t, err)
+	assert.Equal(t, 1, bs.Enabled)
+	assert.Equal(t, "7@L", bs.RetentionDaily)
+	assert.Equal(t, `{"host": "db1"}`, *bs.WorkerConfig)
+	assert.Equal(t, managedByFile, bs.ManagedBy)
+	bs, err = store.GetBackupSpec("db2")
+	require.Nil(t, err)
+	assert.Equal(t, 0, bs.Enabled)
+	bs, err = store.GetBackupSpec("db3")
+	require.Nil(t, err)
+	assert.Equal(t, "0 0 * * * *", *bs.BackupCronString)
+
+	//file managed specs can't be changed through the API
+	router := gin.New()
+	router.PUT("/backup/:name", UpdateBackupSpec())
+	router.DELETE("/backup/:name", DeleteBackupSpec())
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/backup/db1", bytes.NewReader([]byte(`{"enabled": 0}`))))
+	assert.Equal(t, http.StatusConflict, w.Code)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/backup/db1?mode=orphan", nil))
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	//invalid files don't change anything
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "db1.yaml"), []byte("name: db1\nretentionDaily: 7@L\nretentionDialy: 3\n"), 0644))
+	assert.NotNil(t, syncSpecsDir(dir))
+	bs, err = store.GetBackupSpec("db1")
+	require.Nil(t, err)
+	assert.Equal(t, "7@L", bs.RetentionDaily)
+
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "db1.yaml"), []byte("name: db1\nretentionDaily: 3@L\n"), 0644))
+	require.Nil(t, syncSpecsDir(dir))
+	bs, err = store.GetBackupSpec("db1")
+	require.Nil(t, err)
+	assert.Equal(t, "3@L", bs.RetentionDaily)
+
+	//removed files disable their specs and hand them back to the API
+	require.Nil(t, os.Remove(filepath.Join(dir, "others.json")))
+	require.Nil(t, syncSpecsDir(dir))
+	bs, err = store.GetBackupSpec("db3")
+	require.Nil(t, err)
+	assert.Equal(t, 0, bs.Enabled)
+	assert.Equal(t, "", bs.ManagedBy)
+	bs, err = store.GetBackupSpec("db1")
+	require.Nil(t, err)
+	assert.Equal(t, 1, bs.Enabled)
+}
@@ -1,7 +1,11 @@
 package backtor
 
 import (
+	"database/sql"
 	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -10,6 +14,7 @@ import (
 
 var (
 	metricsInitialized = false
+	periodNamePattern  = regexp.MustCompile("^[a-z0-9-]+$")
 )
 
 //METRICS
@@ -71,20 +76,27 @@ func InitTaskBackup() {
 	prometheus.MustRegister(backupLastSizeGauge)
 	prometheus.MustRegister(backupLastTimeGauge)
 	prometheus.MustRegister(backupTasksCounter)
+	prometheus.MustRegister(backupTriggerCounter)
 	prometheus.MustRegister(backupMaterializedCounter)
 	prometheus.MustRegister(backupTagCounter)
 	prometheus.MustRegister(overallBackupWarnCounter)
 }
 
 func triggerNewBackup(backupName string) (workflowID string, err3 error) {
+	return triggerNewBackupOfType(backupName, "")
+}
+
+//triggerNewBackupOfType launches a create workflow. For specs with 'incrementalCronString', backupType "incremental" asks for
+//an incremental backup on top of the newest backup of the chain and any other value asks for a full backup
+func triggerNewBackupOfType(backupName string, backupType string) (workflowID string, err3 error) {
 	logrus.Info("")
-	logrus.Infof(">>>> TRIGGER NEW BACKUP %s", backupName)
+	logrus.Infof(">>>> TRIGGER NEW BACKUP %s %s", backupName, backupType)
 
 	start := time.Now()
 
 	logrus.Debugf("Checking if there is another backup running. name=%s", backupName)
 
-	bs, err := getBackupSpec(backupName)
+	bs, err := store.GetBackupSpec(backupName)
 	if err != nil {
 		return "", fmt.Errorf("Couldn't load backup spec. err=%s", err)
 	}
@@ -93,26 +105,44 @@ func triggerNewBackup(backupName string) (workflowID string, err3 error) {
 		wf, err := getWorkflowInstance(*bs.RunningCreateWorkflowID)
 		logrus.Debugf("Workflow %v", wf)
 		if err != nil {
-			if wf.status != "NOT_FOUND" {
+			if wf.Status != "NOT_FOUND" {
 				return "", fmt.Errorf("Couldn't get workflow id %s for checking if it is running. backup name %s. err=%s", *bs.RunningCreateWorkflowID, backupName, err)
 			}
 			logrus.Warnf("Workflow %s is set to backup spec, but was not found in Conductor. Proceeding to create a new workflow instance. backup=%s", backupName, *bs.RunningCreateWorkflowID)
 		}
-		if wf.status == "RUNNING" {
+		if wf.Status == "RUNNING" {
 			overallBackupWarnCounter.WithLabelValues(backupName, "warning").Inc()
-			return "", fmt.Errorf("Another backup workflow for backup %s is running (%s)", backupName, wf.workflowID)
+			notify(Notification{Event: notifyBackupSkipped, BackupName: backupName, WorkflowID: wf.WorkflowID,
+				Message: fmt.Sprintf("Backup of %s was skipped because its previous backup workflow is still running", backupName)})
+			return "", fmt.Errorf("Another backup workflow for backup %s is running (%s)", backupName, wf.WorkflowID)
+		}
+	}
+
+	parentDataID := ""
+	if bs.IncrementalCronString == nil || *bs.IncrementalCronString == "" {
+		backupType = ""
+	} else if backupType == backupTypeIncremental {
+		parentDataID, err = chainHead(backupName)
+		if err != nil {
+			return "", err
+		}
+		if parentDataID == "" {
+			logrus.Infof("No full backup found for backup %s. Launching a full backup instead of an incremental one", backupName)
+			backupType = backupTypeFull
 		}
+	} else {
+		backupType = backupTypeFull
 	}
 
 	logrus.Debugf("Launching workflow for backup creation. api=%s", opt.ConductorAPIURL)
-	workflowID, err1 := launchCreateBackupWorkflow(backupName, bs.TimeoutSeconds, bs.WorkerConfig)
+	workflowID, err1 := launchCreateBackupWorkflow(backupName, bs.TimeoutSeconds, bs.WorkerConfig, backupType, parentDataID)
 	if err1 != nil {
 		overallBackupWarnCounter.WithLabelValues(backupName, "error").Inc()
 		return "", fmt.Errorf("Couldn't invoke Conductor workflow for backup creation. err=%s", err1)
 	}
 
 	logrus.Infof("Workflow launched successfuly. workflowID=%s", workflowID)
-	err4 := updateBackupSpecRunningCreateWorkflowID(backupName, &workflowID)
+	err4 := store.UpdateBackupSpecRunningCreateWorkflowID(backupName, &workflowID)
 	if err4 != nil {
 		return "", err4
 	}
@@ -122,197 +152,385 @@ func triggerNewBackup(backupName string) (workflowID string, err3 error) {
 	return workflowID, nil
 }
 
-func checkBackupWorkflow(backupName string) {
+func checkBackupWorkflow(backupName string) error {
 	logrus.Debugf("checkBackupTask %s", backupName)
 
-	bs, err := getBackupSpec(backupName)
+	bs, err := store.GetBackupSpec(backupName)
 	if err != nil {
 		logrus.Debugf("Couldn't get backup spec %s. err=%s", backupName, err)
 		overallBackupWarnCounter.WithLabelValues(backupName, "error").Inc()
+		return fmt.Errorf("Couldn't get backup spec %s. err=%s", backupName, err)
 	}
 	if bs.RunningCreateWorkflowID == nil {
 		logrus.Debugf("Backup Spec %s has no running workflow set", backupName)
-		return
+		return nil
 	}
 	wf, err0 := getWorkflowInstance(*bs.RunningCreateWorkflowID)
 	if err0 != nil {
 		logrus.Debugf("Couldn't get workflow instance %s. err=%s", *bs.RunningCreateWorkflowID, err0)
 		overallBackupWarnCounter.WithLabelValues(backupName, "error").Inc()
-		return
+		return fmt.Errorf("Couldn't get workflow instance %s. err=%s", *bs.RunningCreateWorkflowID, err0)
 	}
 
-	if wf.status == "RUNNING" {
-		logrus.Debugf("Workflow %s was launched for backup %s and is still running", wf.workflowID, backupName)
-		return
+	if wf.Status == "RUNNING" {
+		logrus.Debugf("Workflow %s was launched for backup %s and is still running", wf.WorkflowID, backupName)
+		return nil
 	}
 
-	logrus.Infof("Conductor workflow id %s finish detected. status=%s. backup=%s", wf.workflowID, wf.status, backupName)
+	logrus.Infof("Conductor workflow id %s finish detected. status=%s. backup=%s", wf.WorkflowID, wf.Status, backupName)
+
+	validOutput := wf.DataID != nil && wf.DataSizeMB != nil && *wf.DataSizeMB != 0
+	backupType := ""
+	if wf.BackupType != nil {
+		backupType = *wf.BackupType
+	}
 
-	err2 := updateBackupSpecRunningCreateWorkflowID(backupName, nil)
+	//avoid doing retention until the newly created backup is tagged to avoid
+	//it to be elected for removal (because it will have no tags)
+	retentionLock(backupName).Lock()
+	defer retentionLock(backupName).Unlock()
+
+	//the backup is recorded and tagged before the workflow is cleared, so that a failure is retried on the next check.
+	//The materialized backup id is the workflow id, so concurrent checks record it only once
+	if wf.Status == "COMPLETED" && validOutput {
+		err1 := createMaterializedBackupOnce(backupName, wf, backupType)
+		if err1 != nil {
+			logrus.Errorf("Couldn't create materialized backup on database. err=%s", err1)
+			overallBackupWarnCounter.WithLabelValues(backupName, "error").Inc()
+			return fmt.Errorf("Couldn't create materialized backup on database. err=%s", err1)
+		}
+		err = tagAllBackups(backupName)
+		if err != nil {
+			logrus.Errorf("Error tagging backups. err=%s", err)
+			overallBackupWarnCounter.WithLabelValues(backupName, "error").Inc()
+			return fmt.Errorf("Error tagging backups. err=%s", err)
+		}
+	}
+
+	//timers, the reconciler and workflow events may check the same workflow concurrently. Only the one that clears it notifies
+	//and replicates the backup, and a newer workflow launched meanwhile is never cleared
+	cleared, err2 := store.ClearBackupSpecRunningCreateWorkflowID(backupName, *bs.RunningCreateWorkflowID)
 	if err2 != nil {
 		logrus.Errorf("Couldn't set backup spec running create workflowid to nil. err=%s", err2)
 		overallBackupWarnCounter.WithLabelValues(backupName, "error").Inc()
-		return
+		return fmt.Errorf("Couldn't set backup spec running create workflowid to nil. err=%s", err2)
+	}
+	if !cleared {
+		logrus.Debugf("Workflow %s of backup %s was already handled", wf.WorkflowID, backupName)
+		return nil
 	}
 
-	if wf.status != "COMPLETED" {
-		logrus.Warnf("Workflow %s completed with status!=COMPLETED. backupName=%s. status=%s", wf.workflowID, backupName, wf.status)
+	if wf.Status != "COMPLETED" {
+		logrus.Warnf("Workflow %s completed with status!=COMPLETED. backupName=%s. status=%s", wf.WorkflowID, backupName, wf.Status)
 		overallBackupWarnCounter.WithLabelValues(backupName, "warning").Inc()
-		return
+		notify(Notification{Event: notifyCreateFailed, BackupName: backupName, WorkflowID: wf.WorkflowID,
+			Message: fmt.Sprintf("Create workflow of %s finished with status %s", backupName, wf.Status)})
+		return nil
 	}
 
-	if wf.dataID == nil || wf.dataSizeMB == nil || *wf.dataSizeMB == 0 {
-		logrus.Warnf("Workflow %s has completed but didn't return dataID and dataSizeMB. Check worker. Backup will be ignored. workflow=%v", wf.workflowID, wf)
+	if !validOutput {
+		logrus.Warnf("Workflow %s has completed but didn't return dataID and dataSizeMB. Check worker. Backup will be ignored. workflow=%v", wf.WorkflowID, wf)
 		overallBackupWarnCounter.WithLabelValues(backupName, "warning").Inc()
-		return
+		notify(Notification{Event: notifyMissingOutput, BackupName: backupName, WorkflowID: wf.WorkflowID,
+			Message: fmt.Sprintf("Create workflow of %s completed without 'dataId' and 'dataSizeMB' in its output. The backup was ignored", backupName)})
+		return nil
 	}
 
-	//avoid doing retention until the newly created backup is tagged to avoid
-	//it to be elected for removal (because it will have no tags)
-	retentionLock(backupName).Lock()
-	defer retentionLock(backupName).Unlock()
-	err1 := createMaterializedBackup(wf.workflowID, backupName, wf.dataID, wf.status, wf.startTime, wf.endTime, wf.dataSizeMB)
-	if err1 != nil {
-		logrus.Errorf("Couldn't create materialized backup on database. err=%s", err1)
-		overallBackupWarnCounter.WithLabelValues(backupName, "error").Inc()
-		return
+	if backupType == backupTypeIncremental && wf.ParentDataID == nil {
+		logrus.Warnf("Workflow %s created an incremental backup but didn't return parentDataId. It will be handled as a standalone backup by retention", wf.WorkflowID)
+		overallBackupWarnCounter.WithLabelValues(backupName, "warning").Inc()
 	}
 
-	logrus.Debugf("Materialized backup saved to database successfuly. id=%s", wf.workflowID)
+	logrus.Debugf("Materialized backup saved to database successfuly. id=%s", wf.WorkflowID)
 	backupMaterializedCounter.WithLabelValues(backupName, "success").Inc()
-	backupLastSizeGauge.WithLabelValues(backupName).Set(*wf.dataSizeMB)
-	backupLastTimeGauge.WithLabelValues(backupName).Set(float64(wf.endTime.Sub(wf.startTime).Seconds()))
+	backupLastSizeGauge.WithLabelValues(backupName).Set(*wf.DataSizeMB)
+	backupLastTimeGauge.WithLabelValues(backupName).Set(float64(wf.EndTime.Sub(wf.StartTime).Seconds()))
+
+	triggerReplications(bs, MaterializedBackup{ID: wf.WorkflowID, BackupName: backupName, DataID: *wf.DataID, StartTime: wf.StartTime, EndTime: wf.EndTime,
+		BackupType: backupType, ParentDataID: wf.ParentDataID})
+	return nil
+}
 
-	err = tagAllBackups(backupName)
+//createMaterializedBackupOnce records the backup created by a COMPLETED create workflow, unless it was already recorded
+func createMaterializedBackupOnce(backupName string, wf WorkflowInstance, backupType string) error {
+	_, err := store.GetMaterializedBackup(wf.WorkflowID)
+	if err == nil {
+		return nil
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+	err = store.CreateMaterializedBackup(wf.WorkflowID, backupName, wf.DataID, wf.Status, wf.StartTime, wf.EndTime, wf.DataSizeMB, backupType, wf.ParentDataID, wf.Checksum)
 	if err != nil {
-		logrus.Errorf("Error tagging backups. err=%s", err)
-		overallBackupWarnCounter.WithLabelValues(backupName, "error").Inc()
+		//recorded by a concurrent check of the same workflow
+		if _, err1 := store.GetMaterializedBackup(wf.WorkflowID); err1 == nil {
+			return nil
+		}
+		return err
 	}
+	return nil
+}
+
+//chainHead dataId of the newest COMPLETED full or incremental backup of a spec, on top of which the next incremental backup is taken.
+//Empty if there is none
+func chainHead(backupName string) (string, error) {
+	mbs, err := store.GetMaterializedBackups(backupName, 0, "", "COMPLETED", false)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't load materialized backups of %s. err=%s", backupName, err)
+	}
+	for _, mb := range mbs {
+		if mb.BackupType == backupTypeFull || mb.BackupType == backupTypeIncremental {
+			return mb.DataID, nil
+		}
+	}
+	return "", nil
 }
 
 func tagAllBackups(backupName string) error {
 	logrus.Debugf("Tagging backups")
 
-	bs, err := getBackupSpec(backupName)
+	bs, err := store.GetBackupSpec(backupName)
 	if err != nil {
 		return fmt.Errorf("Couldn't load backup spec. err=%s", err)
 	}
 
-	//begin transaction
-	logrus.Debug("Begining db transaction")
-	tx, err := db.Begin()
-	if err != nil {
-		return fmt.Errorf("Error begining db transaction. err=%s", err)
-	}
-
 	//check last backup
 	logrus.Debug("Checking for backups available")
-	backups, err1 := getMaterializedBackups(bs.Name, 1, "", "COMPLETED", false)
+	backups, err1 := store.GetMaterializedBackups(bs.Name, 1, "", "COMPLETED", false)
 	if err1 != nil {
-		tx.Rollback()
-		return fmt.Errorf("Error getting last backup. err=%s", err)
+		return fmt.Errorf("Error getting last backup. err=%s", err1)
 	} else if len(backups) == 0 {
 		logrus.Warnf("No backups found. Skipping tagging.")
-		tx.Rollback()
 		return nil
 	}
 	lastBackup := backups[0]
 
-	logrus.Debug("Clearing all backup tags")
-	res, err0 := clearTagsAndReferenceMaterializedBackup(tx)
-	if err0 != nil {
-		tx.Rollback()
-		return fmt.Errorf("Error clearing tags. err=%s", err0)
-	}
-	logrus.Debugf("%d rows affected", mu(res.RowsAffected())[0])
-
-	//minutely
-	logrus.Debugf("Marking reference + minutely tags")
-	res, err = markReferencesMinutelyMaterializedBackup(tx, bs.Name, bs.MinutelyParams()[1])
+	all, err := store.GetMaterializedBackups(bs.Name, 0, "", "", false)
 	if err != nil {
-		tx.Rollback()
-		return fmt.Errorf("Error marking reference+minutely tags. err=%s", err)
+		backupTagCounter.WithLabelValues(bs.Name, "error").Inc()
+		return fmt.Errorf("Error getting backups for tagging. err=%s", err)
 	}
-	logrus.Debugf("%d rows affected", mu(res.RowsAffected())[0])
 
-	//hourly
-	logrus.Debugf("Marking hourly tags")
-	res, err = markTagMaterializedBackup(tx, bs.Name, "hourly", "minutely", "%Y-%m-%dT%H:0:0.000", "%M", bs.HourlyParams()[1])
-	if err != nil {
-		tx.Rollback()
-		return fmt.Errorf("Error marking hourly tags. err=%s", err)
-	}
-	logrus.Debugf("%d rows affected", mu(res.RowsAffected())[0])
+	calculateTags(all, bs, lastBackup.ID)
 
-	//daily
-	logrus.Debugf("Marking daily tags")
-	res, err = markTagMaterializedBackup(tx, bs.Name, "daily", "hourly", "%Y-%m-%w-%dT0:0:0.000", "%H", bs.DailyParams()[1])
+	err = store.UpdateTagsMaterializedBackups(bs.Name, "", all)
 	if err != nil {
-		tx.Rollback()
 		backupTagCounter.WithLabelValues(bs.Name, "error").Inc()
-		return fmt.Errorf("Error marking daily tags. err=%s", err)
+		return fmt.Errorf("Error saving tags. err=%s", err)
 	}
-	tc, _ := res.RowsAffected()
-	logrus.Debugf("%d rows affected", tc)
+	backupTagCounter.WithLabelValues(bs.Name, "success").Inc()
+	return nil
+}
 
-	//weekly
-	logrus.Debugf("Marking weekly tags")
-	res, err = markTagMaterializedBackup(tx, bs.Name, "weekly", "daily", "%Y-%m-%W-0T0:0:0.000", "%w", bs.WeeklyParams()[1])
-	if err != nil {
-		tx.Rollback()
-		backupTagCounter.WithLabelValues(bs.Name, "error").Inc()
-		return fmt.Errorf("Error marking weekly tags. err=%s", err)
-	}
-	tc, _ = res.RowsAffected()
-	logrus.Debugf("%d rows affected", tc)
+//tagRule elects, among backups already marked with previousTag, the one whose time unit is closest
+//to the reference in each period (ex.: for "daily", the backup taken nearest the reference hour of each day).
+//Rules without unit elect the newest backup of each period
+type tagRule struct {
+	tag         string
+	previousTag string
+	period      func(t time.Time) string
+	unit        func(t time.Time) int
+	ref         string
+	//length approximate duration of the periods. Rules are applied from the shortest to the longest
+	length time.Duration
+}
+
+//periodUnits approximate duration of each unit of custom retention periods
+var periodUnits = map[string]time.Duration{
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    24 * time.Hour,
+	"week":   7 * 24 * time.Hour,
+	"month":  365 * 24 * time.Hour / 12,
+	"year":   365 * 24 * time.Hour,
+}
 
-	//monthly
-	logrus.Debugf("Marking monthly tags")
-	ref := bs.MonthlyParams()[1]
-	if ref == "L" {
-		ref = "31"
+//tagRules built-in and custom tagging rules of a backup spec, from the shortest to the longest period
+func tagRules(bs BackupSpec) []tagRule {
+	monthlyRef := bs.MonthlyParams()[1]
+	if monthlyRef == "L" {
+		monthlyRef = "31"
 	}
-	res, err = markTagMaterializedBackup(tx, bs.Name, "monthly", "daily", "%Y-%m-0T0:0:0.000", "%d", ref)
-	if err != nil {
-		tx.Rollback()
-		backupTagCounter.WithLabelValues(bs.Name, "error").Inc()
-		return fmt.Errorf("Error marking monthly tags. err=%s", err)
+	rules := []tagRule{
+		{tag: "minutely", previousTag: "", length: periodUnits["minute"],
+			period: func(t time.Time) string { return t.Format("2006-01-02T15:04") },
+			unit:   func(t time.Time) int { return t.Second() },
+			ref:    bs.MinutelyParams()[1]},
+		{tag: "hourly", previousTag: "minutely", length: periodUnits["hour"],
+			period: func(t time.Time) string { return t.Format("2006-01-02T15") },
+			unit:   func(t time.Time) int { return t.Minute() },
+			ref:    bs.HourlyParams()[1]},
+		{tag: "daily", previousTag: "hourly", length: periodUnits["day"],
+			period: func(t time.Time) string { return t.Format("2006-01-02") },
+			unit:   func(t time.Time) int { return t.Hour() },
+			ref:    bs.DailyParams()[1]},
+		{tag: "weekly", previousTag: "daily", length: periodUnits["week"],
+			period: func(t time.Time) string { return fmt.Sprintf("%s-%02d", t.Format("2006-01"), mondayWeekOfYear(t)) },
+			unit:   func(t time.Time) int { return int(t.Weekday()) },
+			ref:    bs.WeeklyParams()[1]},
+		{tag: "monthly", previousTag: "daily", length: periodUnits["month"],
+			period: func(t time.Time) string { return t.Format("2006-01") },
+			unit:   func(t time.Time) int { return t.Day() },
+			ref:    monthlyRef},
+		{tag: "yearly", previousTag: "monthly", length: periodUnits["year"],
+			period: func(t time.Time) string { return t.Format("2006") },
+			unit:   func(t time.Time) int { return int(t.Month()) },
+			ref:    bs.YearlyParams()[1]},
 	}
-	tc, _ = res.RowsAffected()
-	logrus.Debugf("%d rows affected", tc)
+	for _, p := range bs.Periods {
+		p0 := p
+		if p0.Every == 0 {
+			p0.Every = 1
+		}
+		rules = append(rules, tagRule{tag: p0.Name, previousTag: "reference", length: periodUnits[p0.Unit] * time.Duration(p0.Every),
+			period: func(t time.Time) string {
+				return strconv.Itoa(floorDiv(periodIndex(p0.Unit, t)-p0.Offset, p0.Every))
+			}})
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].length < rules[j].length
+	})
+	return rules
+}
 
-	//yearly
-	logrus.Debugf("Marking yearly tags")
-	res, err = markTagMaterializedBackup(tx, bs.Name, "yearly", "monthly", "%Y-0-0T0:0:0.000", "%m", bs.YearlyParams()[1])
-	if err != nil {
-		tx.Rollback()
-		backupTagCounter.WithLabelValues(bs.Name, "error").Inc()
-		return fmt.Errorf("Error marking yearly tags. err=%s", err)
+//periodTags tags of the retention periods of a backup spec, from the shortest to the longest period
+func periodTags(bs BackupSpec) []string {
+	tags := make([]string, 0)
+	for _, r := range tagRules(bs) {
+		tags = append(tags, r.tag)
 	}
-	tc, _ = res.RowsAffected()
-	logrus.Debugf("%d rows affected", tc)
+	return tags
+}
 
-	logrus.Debug("Tagging last backup with all tags")
-	res, err = setAllTagsMaterializedBackup(tx, lastBackup.ID)
-	if err != nil {
-		tx.Rollback()
-		backupTagCounter.WithLabelValues(bs.Name, "error").Inc()
-		return fmt.Errorf("Error tagging last backup. err=%s", err)
+//periodIndex sequential number of the unit t is in. Ex.: months since year 0 for "month"
+func periodIndex(unit string, t time.Time) int {
+	days := int(time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).Unix() / 86400)
+	switch unit {
+	case "minute":
+		return (days*24+t.Hour())*60 + t.Minute()
+	case "hour":
+		return days*24 + t.Hour()
+	case "day":
+		return days
+	case "week":
+		//1970-01-01 was a thursday
+		return floorDiv(days+3, 7)
+	case "month":
+		return t.Year()*12 + int(t.Month()) - 1
 	}
-	tc, _ = res.RowsAffected()
-	logrus.Debugf("%d rows affected", tc)
+	return t.Year()
+}
 
-	logrus.Debug("Commiting transaction")
-	err = tx.Commit()
-	if err != nil {
-		tx.Rollback()
-		backupTagCounter.WithLabelValues(bs.Name, "error").Inc()
-		return fmt.Errorf("Error commiting transation. err=%s", err)
+func floorDiv(a int, b int) int {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+//checkRetentionPeriods checks the custom retention periods of a backup spec
+func checkRetentionPeriods(bs BackupSpec) error {
+	names := map[string]bool{"reference": true, "all": true}
+	for _, t := range materializedTags {
+		names[t] = true
+	}
+	for _, p := range bs.Periods {
+		if !periodNamePattern.MatchString(p.Name) {
+			return fmt.Errorf("Period name '%s' must have only lowercase letters, numbers and '-'", p.Name)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("Period name '%s' is reserved or declared more than once", p.Name)
+		}
+		names[p.Name] = true
+		if _, ok := periodUnits[p.Unit]; !ok {
+			return fmt.Errorf("Period %s: 'unit' must be minute, hour, day, week, month or year", p.Name)
+		}
+		every := p.Every
+		if every == 0 {
+			every = 1
+		}
+		if every < 0 {
+			return fmt.Errorf("Period %s: 'every' must be positive", p.Name)
+		}
+		if p.Offset < 0 || p.Offset >= every {
+			return fmt.Errorf("Period %s: 'offset' must be between 0 and %d", p.Name, every-1)
+		}
+		if p.Keep < 0 || p.Keep > maxRetentionCount {
+			return fmt.Errorf("Period %s: 'keep' must be between 0 and %d", p.Name, maxRetentionCount)
+		}
 	}
-	backupTagCounter.WithLabelValues(bs.Name, "success").Inc()
 	return nil
 }
 
-func mu(a ...interface{}) []interface{} {
-	return a
+//calculateTags sets the tags of backups according to the backup spec. The backup identified by lastBackupID gets all tags
+func calculateTags(backups []MaterializedBackup, bs BackupSpec, lastBackupID string) {
+	//oldest first so that ties are won by the oldest backup
+	ordered := make([]*MaterializedBackup, len(backups))
+	for i := range backups {
+		backups[i].Tags = []string{}
+		ordered[i] = &backups[i]
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].StartTime.Before(ordered[j].StartTime)
+	})
+
+	loc := tagLocation(bs)
+	rules := tagRules(bs)
+	for _, rule := range rules {
+		logrus.Debugf("Marking %s tags", rule.tag)
+		ref := 0
+		if rule.unit != nil {
+			var err error
+			ref, err = strconv.Atoi(rule.ref)
+			if err != nil {
+				logrus.Warnf("Invalid %s reference '%s'. Using 0", rule.tag, rule.ref)
+			}
+		}
+		elected := make(map[string]*MaterializedBackup)
+		diffs := make(map[string]int)
+		periods := make([]string, 0)
+		for _, m := range ordered {
+			if rule.previousTag != "" && !hasTag(*m, rule.previousTag) {
+				continue
+			}
+			t := m.StartTime.In(loc)
+			p := rule.period(t)
+			d := 0
+			if rule.unit != nil {
+				d = rule.unit(t) - ref
+				if d < 0 {
+					d = -d
+				}
+			}
+			_, ok := elected[p]
+			if !ok {
+				periods = append(periods, p)
+			}
+			if !ok || d < diffs[p] || rule.unit == nil {
+				elected[p] = m
+				diffs[p] = d
+			}
+		}
+		for _, p := range periods {
+			m := elected[p]
+			if rule.previousTag == "" {
+				m.Tags = append(m.Tags, "reference")
+			}
+			m.Tags = append(m.Tags, rule.tag)
+		}
+		logrus.Debugf("%d backups tagged %s", len(periods), rule.tag)
+	}
+
+	logrus.Debug("Tagging last backup with all tags")
+	for i := range backups {
+		if backups[i].ID == lastBackupID {
+			backups[i].Tags = append([]string{"reference"}, periodTags(bs)...)
+		}
+	}
+}
+
+//mondayWeekOfYear week number of the year where weeks start on monday. Days before the first monday are in week 0 (same as strftime %W)
+func mondayWeekOfYear(t time.Time) int {
+	return (t.YearDay() - 1 + 7 - (int(t.Weekday())+6)%7) / 7
 }
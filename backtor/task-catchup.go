@@ -0,0 +1,222 @@
+package backtor
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robfig/cron"
+	"github.com/sirupsen/logrus"
+)
+
+//misfire policies
+const (
+	misfireSkip    = "skip"
+	misfireRunOnce = "run-once"
+	misfireRunAll  = "run-all"
+)
+
+//defaultMisfireMaxRuns max catch-up backups of "run-all" when 'misfireMaxRuns' is not set
+const defaultMisfireMaxRuns = 3
+
+//maxMissedWindows missed windows counted in a single detection. Avoids walking years of a per-second schedule
+const maxMissedWindows = 10000
+
+//catchupInterval time between checks for pending catch-up backups
+const catchupInterval = 10 * time.Second
+
+//METRICS
+var missedSchedulesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "backtor_missed_schedules_total",
+	Help: "Total backup schedule windows missed while no replica was leading",
+}, []string{
+	"backup",
+})
+
+var catchupCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "backtor_catchup_total",
+	Help: "Total catch-up backups launched for missed schedule windows",
+}, []string{
+	"backup",
+	"status",
+})
+
+//InitTaskCatchup registers catch-up metrics
+func InitTaskCatchup() {
+	prometheus.MustRegister(missedSchedulesCounter)
+	prometheus.MustRegister(catchupCounter)
+}
+
+//checkMisfirePolicy checks the misfire settings of a backup spec
+func checkMisfirePolicy(bs BackupSpec) error {
+	if bs.MisfirePolicy != "" && bs.MisfirePolicy != misfireSkip && bs.MisfirePolicy != misfireRunOnce && bs.MisfirePolicy != misfireRunAll {
+		return fmt.Errorf("'misfirePolicy' must be '%s', '%s' or '%s'", misfireSkip, misfireRunOnce, misfireRunAll)
+	}
+	if bs.MisfireMaxRuns < 0 {
+		return fmt.Errorf("'misfireMaxRuns' must not be negative")
+	}
+	return nil
+}
+
+//recordScheduleFire stores when the main schedule of a backup spec fired, so that windows missed after it can be detected later
+func recordScheduleFire(backupName string, t time.Time) {
+	err := store.UpdateBackupSpecLastScheduledTime(backupName, t.Truncate(time.Second))
+	if err != nil {
+		logrus.Warnf("Couldn't record schedule time of backup %s. err=%s", backupName, err)
+	}
+}
+
+//detectMissedSchedules counts the windows of the main schedule between its last fire (or the last spec change) and now,
+//records them and queues catch-up backups according to the spec's misfire policy
+func detectMissedSchedules(bs BackupSpec, now time.Time) error {
+	if bs.LastScheduledTime == nil {
+		//nothing known about earlier windows
+		return store.UpdateBackupSpecLastScheduledTime(bs.Name, now)
+	}
+	from := bs.LastScheduledTime.In(scheduleLocation(bs))
+	//windows of the schedule before the spec was changed don't count
+	if bs.LastUpdate.After(from) {
+		from = bs.LastUpdate.In(scheduleLocation(bs))
+	}
+	schedule, err := cron.Parse(*bs.BackupCronString)
+	if err != nil {
+		return fmt.Errorf("Invalid backup cron string of %s. err=%s", bs.Name, err)
+	}
+
+	count := 0
+	var first, last time.Time
+	for t := schedule.Next(from); !t.IsZero() && t.Before(now) && count < maxMissedWindows; t = schedule.Next(t) {
+		if (bs.FromDate != nil && t.Before(*bs.FromDate)) || (bs.ToDate != nil && t.After(*bs.ToDate)) {
+			continue
+		}
+		if count == 0 {
+			first = t
+		}
+		last = t
+		count++
+	}
+
+	err = store.UpdateBackupSpecLastScheduledTime(bs.Name, now)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return nil
+	}
+
+	policy := bs.MisfirePolicy
+	if policy == "" {
+		policy = misfireSkip
+	}
+	pending := bs.CatchupPending
+	switch policy {
+	case misfireRunOnce:
+		pending = 1
+	case misfireRunAll:
+		max := bs.MisfireMaxRuns
+		if max == 0 {
+			max = defaultMisfireMaxRuns
+		}
+		pending = pending + count
+		if pending > max {
+			pending = max
+		}
+	}
+	logrus.Warnf("Backup %s missed %d scheduled windows between %s and %s. policy=%s. catchup backups=%d", bs.Name, count, first, last, policy, pending)
+	missedSchedulesCounter.WithLabelValues(bs.Name).Add(float64(count))
+
+	err = store.CreateCatchup(Catchup{
+		ID:          fmt.Sprintf("%s-missed-%d", bs.Name, now.UnixNano()),
+		BackupName:  bs.Name,
+		Action:      "missed",
+		Policy:      policy,
+		MissedCount: count,
+		FirstMissed: &first,
+		LastMissed:  &last,
+		Time:        now,
+	})
+	if err != nil {
+		return fmt.Errorf("Couldn't record missed windows of %s. err=%s", bs.Name, err)
+	}
+	if pending != bs.CatchupPending {
+		return store.UpdateBackupSpecCatchupPending(bs.Name, pending)
+	}
+	return nil
+}
+
+//launchCatchupRoutine periodically launches pending catch-up backups. Only the leader launches them
+func launchCatchupRoutine() {
+	go func() {
+		for {
+			time.Sleep(catchupInterval)
+			if isLeader() {
+				processCatchups()
+			}
+		}
+	}()
+}
+
+//processCatchups launches the next catch-up backup of each enabled spec with pending catch-ups. Catch-up backups
+//of a spec run one after the other, so a new one is only launched after the previous create workflow finished
+func processCatchups() {
+	a := 1
+	bss, err := store.ListBackupSpecs(&a)
+	if err != nil {
+		logrus.Warnf("Couldn't list backup specs for catch-up. err=%s", err)
+		return
+	}
+	for _, bs := range bss {
+		if bs.CatchupPending > 0 {
+			runCatchup(bs.Name)
+		}
+	}
+}
+
+func runCatchup(backupName string) {
+	checkBackupWorkflow(backupName)
+	bs, err := store.GetBackupSpec(backupName)
+	if err != nil {
+		logrus.Warnf("Couldn't load backup spec %s for catch-up. err=%s", backupName, err)
+		return
+	}
+	if bs.RunningCreateWorkflowID != nil {
+		logrus.Debugf("Catch-up of backup %s waiting for workflow %s", backupName, *bs.RunningCreateWorkflowID)
+		return
+	}
+
+	now := time.Now()
+	if (bs.FromDate != nil && now.Before(*bs.FromDate)) || (bs.ToDate != nil && now.After(*bs.ToDate)) {
+		logrus.Infof("Backup %s is not within activation date. Dropping %d catch-up backups", backupName, bs.CatchupPending)
+		err = store.UpdateBackupSpecCatchupPending(backupName, 0)
+		if err != nil {
+			logrus.Warnf("Couldn't clear catch-up backups of %s. err=%s", backupName, err)
+		}
+		return
+	}
+
+	wid, err := triggerNewBackup(backupName)
+	if err != nil {
+		logrus.Warnf("Error launching catch-up backup for backup %s. err=%s", backupName, err)
+		catchupCounter.WithLabelValues(backupName, "error").Inc()
+		return
+	}
+	logrus.Infof("Catch-up backup launched. backup=%s workflowId=%s", backupName, wid)
+	catchupCounter.WithLabelValues(backupName, "success").Inc()
+
+	err = store.UpdateBackupSpecCatchupPending(backupName, bs.CatchupPending-1)
+	if err != nil {
+		logrus.Warnf("Couldn't update catch-up backups of %s. err=%s", backupName, err)
+	}
+	err = store.CreateCatchup(Catchup{
+		ID:          wid,
+		BackupName:  backupName,
+		Action:      "run",
+		Policy:      bs.MisfirePolicy,
+		MissedCount: 1,
+		WorkflowID:  &wid,
+		Time:        now,
+	})
+	if err != nil {
+		logrus.Warnf("Couldn't record catch-up backup %s of %s. err=%s", wid, backupName, err)
+	}
+}
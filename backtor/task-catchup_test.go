@@ -0,0 +1,112 @@
+package backtor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/flaviostutz/backtor/backtor/backtortest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCatchupMissedSchedules(t *testing.T) {
+	conductor, teardown := setupTest(t)
+	defer teardown()
+
+	hourly := "0 0 * * * *"
+	lastUpdate := time.Date(2020, 1, 9, 0, 0, 0, 0, time.UTC)
+	lastFire := time.Date(2020, 1, 10, 7, 0, 0, 0, time.UTC)
+	now := time.Date(2020, 1, 10, 12, 30, 0, 0, time.UTC)
+	for _, bs := range []BackupSpec{
+		{Name: "all", BackupCronString: &hourly, MisfirePolicy: misfireRunAll, MisfireMaxRuns: 2},
+		{Name: "skip", BackupCronString: &hourly},
+		{Name: "new", BackupCronString: &hourly, MisfirePolicy: misfireRunOnce},
+	} {
+		bs = createTestBackupSpec(t, bs)
+		bs.LastUpdate = lastUpdate
+		require.Nil(t, store.UpdateBackupSpec(bs))
+		if bs.Name != "new" {
+			require.Nil(t, store.UpdateBackupSpecLastScheduledTime(bs.Name, lastFire))
+		}
+		bs, err := store.GetBackupSpec(bs.Name)
+		require.Nil(t, err)
+		require.Nil(t, detectMissedSchedules(bs, now))
+	}
+
+	//8h to 12h were missed
+	catchups, err := store.GetCatchups("all")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(catchups))
+	assert.Equal(t, "missed", catchups[0].Action)
+	assert.Equal(t, 5, catchups[0].MissedCount)
+	assert.Equal(t, time.Date(2020, 1, 10, 8, 0, 0, 0, time.UTC), catchups[0].FirstMissed.UTC())
+	assert.Equal(t, time.Date(2020, 1, 10, 12, 0, 0, 0, time.UTC), catchups[0].LastMissed.UTC())
+
+	//missed windows are recorded but not run with the default policy. Specs without a last scheduled time have nothing to catch up
+	catchups, err = store.GetCatchups("skip")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(catchups))
+	assert.Equal(t, misfireSkip, catchups[0].Policy)
+	catchups, err = store.GetCatchups("new")
+	require.Nil(t, err)
+	assert.Equal(t, 0, len(catchups))
+	for name, pending := range map[string]int{"all": 2, "skip": 0, "new": 0} {
+		bs, err := store.GetBackupSpec(name)
+		require.Nil(t, err)
+		assert.Equal(t, pending, bs.CatchupPending, name)
+		assert.Equal(t, now, bs.LastScheduledTime.UTC(), name)
+	}
+
+	//catch-up backups run one after the other, up to the cap
+	conductor.Script("create_backup", backtortest.Running(), backtortest.Completed("c2", 10))
+	processCatchups()
+	processCatchups()
+	wfs := conductor.Workflows("create_backup")
+	require.Equal(t, 1, len(wfs))
+	require.Nil(t, conductor.Finish(wfs[0].WorkflowID, backtortest.Completed("c1", 10)))
+	processCatchups()
+	processCatchups()
+	wfs = conductor.Workflows("create_backup")
+	require.Equal(t, 2, len(wfs))
+	for _, wf := range wfs {
+		assert.Equal(t, "all", wf.Input["backupName"])
+	}
+
+	bs, err := store.GetBackupSpec("all")
+	require.Nil(t, err)
+	assert.Equal(t, 0, bs.CatchupPending)
+	catchups, err = store.GetCatchups("all")
+	require.Nil(t, err)
+	runs := 0
+	for _, c := range catchups {
+		if c.Action == "run" {
+			runs++
+			assert.Equal(t, misfireRunAll, c.Policy)
+			require.NotNil(t, c.WorkflowID)
+		}
+	}
+	assert.Equal(t, 2, runs)
+	checkBackupWorkflow("all")
+	assert.Equal(t, map[string]string{"c1": "COMPLETED", "c2": "COMPLETED"}, materializedStatuses(t, "all"))
+}
+
+func TestCatchupMissedSchedulesAfterSpecChangeInTimezone(t *testing.T) {
+	_, teardown := setupTest(t)
+	defer teardown()
+
+	//01:00 in Tokyo is 16:00 UTC of the previous day
+	daily := "0 0 1 * * *"
+	bs := createTestBackupSpec(t, BackupSpec{Name: "test", BackupCronString: &daily, Timezone: "Asia/Tokyo"})
+	bs.LastUpdate = time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	require.Nil(t, store.UpdateBackupSpec(bs))
+	require.Nil(t, store.UpdateBackupSpecLastScheduledTime("test", time.Date(2019, 12, 31, 16, 0, 0, 0, time.UTC)))
+	bs, err := store.GetBackupSpec("test")
+	require.Nil(t, err)
+
+	require.Nil(t, detectMissedSchedules(bs, time.Date(2020, 1, 1, 20, 0, 0, 0, time.UTC)))
+	catchups, err := store.GetCatchups("test")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(catchups))
+	assert.Equal(t, 1, catchups[0].MissedCount)
+	assert.Equal(t, time.Date(2020, 1, 1, 16, 0, 0, 0, time.UTC), catchups[0].FirstMissed.UTC())
+}
@@ -0,0 +1,137 @@
+package backtor
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+//METRICS
+var importCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "backtor_import_backups_total",
+	Help: "Total externally created backups imported",
+}, []string{
+	"backup",
+	"status",
+})
+
+//InitTaskImport registers import metrics
+func InitTaskImport() {
+	prometheus.MustRegister(importCounter)
+}
+
+//ImportedBackup backup created outside backtor (before adopting it or by hand) to be managed by retention
+type ImportedBackup struct {
+	DataID    string    `json:"dataId"`
+	StartTime time.Time `json:"startTime"`
+	EndTime   time.Time `json:"endTime"`
+	SizeMB    float64   `json:"sizeMB"`
+	//ExternalID optional id of the materialized backup. Defaults to an id derived from the backup name and dataId
+	ExternalID string `json:"externalId,omitempty"`
+	//Checksum optional checksum of the backup contents. Verifications of the backup must report the same one
+	Checksum *string `json:"checksum,omitempty"`
+}
+
+//importError invalid import request. The other errors of importBackups are internal errors
+type importError struct {
+	msg string
+}
+
+func (e importError) Error() string {
+	return e.msg
+}
+
+//importBackups records externally created backups as COMPLETED materialized backups and retags all backups of the spec,
+//so that they follow the normal retention lifecycle. Nothing is recorded if any of them is invalid or already known
+func importBackups(backupName string, backups []ImportedBackup) ([]string, error) {
+	logrus.Infof(">>>> IMPORT %d BACKUPS INTO %s", len(backups), backupName)
+
+	bs, err := store.GetBackupSpec(backupName)
+	if err != nil {
+		return nil, importError{fmt.Sprintf("Backup spec %s not found", backupName)}
+	}
+	if bs.Purging == 1 {
+		return nil, importError{fmt.Sprintf("Backup spec %s is being purged", backupName)}
+	}
+	if len(backups) == 0 {
+		return nil, importError{"No backups to import"}
+	}
+
+	retentionLock(backupName).Lock()
+	defer retentionLock(backupName).Unlock()
+
+	current, err := store.GetMaterializedBackups(backupName, 0, "", "", false)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't load materialized backups of %s. err=%s", backupName, err)
+	}
+	dataIDs := make(map[string]bool)
+	for _, mb := range current {
+		if mb.Status != "deleted" {
+			dataIDs[mb.DataID] = true
+		}
+	}
+
+	ids := make([]string, 0)
+	seenIDs := make(map[string]bool)
+	mbs := make([]MaterializedBackup, 0)
+	now := time.Now()
+	for i, b := range backups {
+		if b.EndTime.IsZero() {
+			backups[i].EndTime = b.StartTime
+			b.EndTime = b.StartTime
+		}
+		if b.DataID == "" || b.StartTime.IsZero() {
+			return nil, importError{fmt.Sprintf("Backup %d: 'dataId' and 'startTime' are required", i)}
+		}
+		if b.EndTime.Before(b.StartTime) || b.StartTime.After(now) {
+			return nil, importError{fmt.Sprintf("Backup %s: 'startTime' must be in the past and before 'endTime'", b.DataID)}
+		}
+		if b.SizeMB < 0 {
+			return nil, importError{fmt.Sprintf("Backup %s: 'sizeMB' must not be negative", b.DataID)}
+		}
+		if dataIDs[b.DataID] {
+			return nil, importError{fmt.Sprintf("Backup %s: dataId is already known by backup %s", b.DataID, backupName)}
+		}
+		dataIDs[b.DataID] = true
+
+		id := b.ExternalID
+		if id == "" {
+			h := sha256.Sum256([]byte(backupName + "|" + b.DataID))
+			id = "import-" + hex.EncodeToString(h[:8])
+		}
+		if seenIDs[id] {
+			return nil, importError{fmt.Sprintf("Backup %s: materialized backup id %s is repeated in the request", b.DataID, id)}
+		}
+		seenIDs[id] = true
+		_, err := store.GetMaterializedBackup(id)
+		if err == nil {
+			return nil, importError{fmt.Sprintf("Backup %s: materialized backup id %s already exists", b.DataID, id)}
+		}
+		if err != sql.ErrNoRows {
+			return nil, fmt.Errorf("Couldn't check materialized backup id %s. err=%s", id, err)
+		}
+		ids = append(ids, id)
+		mbs = append(mbs, MaterializedBackup{ID: id, DataID: b.DataID, StartTime: b.StartTime, EndTime: b.EndTime, SizeMB: b.SizeMB, Checksum: b.Checksum})
+	}
+
+	err = store.CreateMaterializedBackups(backupName, mbs)
+	if err != nil {
+		importCounter.WithLabelValues(backupName, "error").Add(float64(len(mbs)))
+		return nil, fmt.Errorf("Couldn't record imported backups. err=%s", err)
+	}
+	for _, mb := range mbs {
+		importCounter.WithLabelValues(backupName, "success").Inc()
+		logrus.Infof("Imported backup %s recorded as materialized backup %s", mb.DataID, mb.ID)
+	}
+
+	err = tagAllBackups(backupName)
+	if err != nil {
+		return ids, fmt.Errorf("Backups imported but couldn't be tagged. err=%s", err)
+	}
+	return ids, nil
+}
@@ -0,0 +1,167 @@
+package backtor
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/robfig/cron"
+	"github.com/sirupsen/logrus"
+)
+
+var purgeRoutine *cron.Cron
+
+//startPurgeRoutine periodically continues purges of backup specs marked for purge
+func startPurgeRoutine() {
+	timersMutex.Lock()
+	defer timersMutex.Unlock()
+	if purgeRoutine != nil {
+		return
+	}
+	c := cron.New()
+	c.AddFunc("@every 1m", func() {
+		if !isLeader() {
+			return
+		}
+		bss, err := store.ListBackupSpecs(nil)
+		if err != nil {
+			logrus.Errorf("Couldn't list backup specs for purge check. err=%s", err)
+			return
+		}
+		for _, bs := range bss {
+			if bs.Purging == 1 {
+				checkBackupSpecPurge(bs.Name)
+			}
+		}
+	})
+	purgeRoutine = c
+	c.Start()
+}
+
+func stopPurgeRoutine() {
+	timersMutex.Lock()
+	defer timersMutex.Unlock()
+	if purgeRoutine != nil {
+		purgeRoutine.Stop()
+		purgeRoutine = nil
+	}
+}
+
+//triggerBackupSpecPurge disables a backup spec and launches removal of all its materialized backups.
+//The spec itself is only deleted by checkBackupSpecPurge after all removals have finished
+func triggerBackupSpecPurge(backupName string) error {
+	logrus.Info("")
+	logrus.Infof(">>>> PURGE BACKUP SPEC %s", backupName)
+
+	bs, err := store.GetBackupSpec(backupName)
+	if err != nil {
+		return fmt.Errorf("Couldn't load backup spec. err=%s", err)
+	}
+
+	if bs.Purging == 0 {
+		err = store.SetBackupSpecPurging(backupName)
+		if err != nil {
+			return fmt.Errorf("Couldn't mark backup spec for purge. err=%s", err)
+		}
+	}
+
+	if bs.RunningCreateWorkflowID != nil {
+		logrus.Infof("Terminating running create workflow %s of backup %s", *bs.RunningCreateWorkflowID, backupName)
+		err = executor.TerminateWorkflow(*bs.RunningCreateWorkflowID, "backup spec purged")
+		if err != nil {
+			logrus.Warnf("Couldn't terminate create workflow %s. Its data may be left behind. err=%s", *bs.RunningCreateWorkflowID, err)
+			overallBackupWarnCounter.WithLabelValues(backupName, "warning").Inc()
+		}
+		err = store.UpdateBackupSpecRunningCreateWorkflowID(backupName, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	checkBackupSpecPurge(backupName)
+	return nil
+}
+
+//checkBackupSpecPurge tracks removal workflows of a purging backup spec and deletes the spec when all of them are done
+func checkBackupSpecPurge(backupName string) {
+	logrus.Debugf("checkBackupSpecPurge %s", backupName)
+
+	checkWorkflowBackupRemove(backupName)
+
+	checkReplicateWorkflows(backupName)
+
+	mbs, err := store.GetMaterializedBackups(backupName, 0, "", "", false)
+	if err != nil {
+		logrus.Warnf("Couldn't load materializeds for backup %s. err=%s", backupName, err)
+		overallBackupWarnCounter.WithLabelValues(backupName, "error").Inc()
+		return
+	}
+	replicas, err := store.GetReplicaBackups(backupName, "", "")
+	if err != nil {
+		logrus.Warnf("Couldn't load replicas for backup %s. err=%s", backupName, err)
+		overallBackupWarnCounter.WithLabelValues(backupName, "error").Inc()
+		return
+	}
+	mbs = append(mbs, replicas...)
+
+	pending := 0
+	held := 0
+	now := time.Now()
+	for _, mb := range mbs {
+		switch mb.Status {
+		case "COMPLETED":
+			if isHeld(mb, now) {
+				held++
+				continue
+			}
+			err := triggerBackupDelete(mb.ID)
+			if err != nil {
+				logrus.Errorf("Couldn't trigger backup delete for materialized backup %s. err=%s", mb.ID, err)
+				retentionBackupsDeleteCounter.WithLabelValues(backupName, "error").Inc()
+			}
+			pending++
+		case "deleting", "replicating":
+			pending++
+		case "delete-error":
+			//the spec can only be deleted after all its data is removed, so failed removals are retried on every purge check
+			logrus.Infof("Retrying removal of dataId %s of purging backup spec %s", mb.DataID, backupName)
+			err := relaunchBackupDelete(mb)
+			if err != nil {
+				logrus.Errorf("Couldn't retry backup delete for materialized backup %s. err=%s", mb.ID, err)
+				retentionBackupsDeleteCounter.WithLabelValues(backupName, "error").Inc()
+			}
+			pending++
+		}
+	}
+
+	if held > 0 {
+		logrus.Warnf("Backup spec %s cannot be purged because %d materialized backups are on hold", backupName, held)
+		overallBackupWarnCounter.WithLabelValues(backupName, "warning").Inc()
+		return
+	}
+	if pending > 0 {
+		logrus.Debugf("Backup spec %s purge is waiting for %d materialized backups to be removed", backupName, pending)
+		return
+	}
+
+	err = store.DeleteMaterializedBackups(backupName)
+	if err != nil {
+		logrus.Errorf("Couldn't delete materialized backups of %s. err=%s", backupName, err)
+		return
+	}
+	err = store.DeleteRestores(backupName)
+	if err != nil {
+		logrus.Errorf("Couldn't delete restores of %s. err=%s", backupName, err)
+		return
+	}
+	err = store.DeleteCatchups(backupName)
+	if err != nil {
+		logrus.Errorf("Couldn't delete catch-ups of %s. err=%s", backupName, err)
+		return
+	}
+	err = store.DeleteBackupSpec(backupName)
+	if err != nil {
+		logrus.Errorf("Couldn't delete backup spec %s. err=%s", backupName, err)
+		return
+	}
+	logrus.Infof("Backup spec %s purged", backupName)
+}
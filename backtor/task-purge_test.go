@@ -0,0 +1,87 @@
+package backtor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/flaviostutz/backtor/backtor/backtortest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupSpecPurge(t *testing.T) {
+	conductor, teardown := setupTest(t)
+	defer teardown()
+
+	createTestBackupSpec(t, BackupSpec{Name: "test"})
+	conductor.Script("create_backup", backtortest.Completed("day6", 1), backtortest.Completed("day7", 1), backtortest.Running())
+	conductor.Script("remove_backup", backtortest.Running(), backtortest.Running())
+	for _, day := range []int{6, 7} {
+		now := time.Date(2020, 1, day, 23, 0, 0, 0, time.UTC)
+		conductor.Now = func() time.Time { return now }
+		runBackupCycle(t, "test")
+	}
+	running, err := triggerNewBackup("test")
+	require.Nil(t, err)
+
+	require.Nil(t, triggerBackupSpecPurge("test"))
+
+	wf, _ := conductor.Workflow(running)
+	assert.Equal(t, "TERMINATED", wf.Status)
+	bs, err := store.GetBackupSpec("test")
+	require.Nil(t, err)
+	assert.Equal(t, 0, bs.Enabled)
+	assert.Equal(t, 1, bs.Purging)
+	assert.Equal(t, map[string]string{"day6": "deleting", "day7": "deleting"}, materializedStatuses(t, "test"))
+
+	removes := conductor.Workflows("remove_backup")
+	require.Equal(t, 2, len(removes))
+	require.Nil(t, conductor.Finish(removes[0].WorkflowID, backtortest.Completed("", 0)))
+	checkBackupSpecPurge("test")
+	_, err = store.GetBackupSpec("test")
+	assert.Nil(t, err, "spec must be kept while removals are running")
+
+	require.Nil(t, conductor.Finish(removes[1].WorkflowID, backtortest.Completed("", 0)))
+	checkBackupSpecPurge("test")
+	_, err = store.GetBackupSpec("test")
+	assert.NotNil(t, err, "spec must be deleted after all removals are done")
+	assert.Equal(t, map[string]string{}, materializedStatuses(t, "test"))
+}
+
+func TestBackupSpecPurgeRetriesDeleteErrors(t *testing.T) {
+	conductor, teardown := setupTest(t)
+	defer teardown()
+
+	createTestBackupSpec(t, BackupSpec{Name: "test"})
+	conductor.Script("create_backup", backtortest.Completed("day6", 1))
+	conductor.Script("remove_backup", backtortest.Failed(), backtortest.Completed("", 0))
+	runBackupCycle(t, "test")
+
+	require.Nil(t, triggerBackupSpecPurge("test"))
+	checkBackupSpecPurge("test")
+
+	//the failed removal is relaunched instead of halting the purge
+	assert.Equal(t, map[string]string{"day6": "deleting"}, materializedStatuses(t, "test"))
+	assert.Equal(t, 2, len(conductor.Workflows("remove_backup")))
+	_, err := store.GetBackupSpec("test")
+	assert.Nil(t, err, "spec must be kept while there are materialized backups to be removed")
+
+	checkBackupSpecPurge("test")
+	_, err = store.GetBackupSpec("test")
+	assert.NotNil(t, err, "spec must be deleted after the retried removal is done")
+}
+
+func TestBackupSpecOrphan(t *testing.T) {
+	conductor, teardown := setupTest(t)
+	defer teardown()
+
+	createTestBackupSpec(t, BackupSpec{Name: "test"})
+	conductor.Script("create_backup", backtortest.Completed("day6", 1))
+	runBackupCycle(t, "test")
+
+	require.Nil(t, store.DeleteBackupSpec("test"))
+	_, err := store.GetBackupSpec("test")
+	assert.NotNil(t, err)
+	assert.Equal(t, map[string]string{"day6": "COMPLETED"}, materializedStatuses(t, "test"))
+	assert.Equal(t, 0, len(conductor.Workflows("remove_backup")))
+}
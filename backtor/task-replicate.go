@@ -0,0 +1,294 @@
+package backtor
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+//METRICS
+var replicateTriggerCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "backtor_replicate_trigger_total",
+	Help: "Total replicate workflows launched",
+}, []string{
+	"backup",
+	"target",
+	"status",
+})
+
+var replicateResultCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "backtor_replicate_total",
+	Help: "Total replicate workflows finished",
+}, []string{
+	"backup",
+	"target",
+	"status",
+})
+
+//InitTaskReplicate registers replication metrics
+func InitTaskReplicate() {
+	prometheus.MustRegister(replicateTriggerCounter)
+	prometheus.MustRegister(replicateResultCounter)
+}
+
+//targetSpec backup spec used for tagging and retention of the replicas in a replication target.
+//Retention strings and worker config not set in the target are taken from the spec
+func targetSpec(bs BackupSpec, t ReplicationTarget) BackupSpec {
+	tbs := bs
+	fields := []struct {
+		value string
+		dest  *string
+	}{
+		{t.RetentionMinutely, &tbs.RetentionMinutely},
+		{t.RetentionHourly, &tbs.RetentionHourly},
+		{t.RetentionDaily, &tbs.RetentionDaily},
+		{t.RetentionWeekly, &tbs.RetentionWeekly},
+		{t.RetentionMonthly, &tbs.RetentionMonthly},
+		{t.RetentionYearly, &tbs.RetentionYearly},
+	}
+	for _, f := range fields {
+		if f.value != "" {
+			*f.dest = f.value
+		}
+	}
+	if t.WorkerConfig != nil {
+		tbs.WorkerConfig = t.WorkerConfig
+	}
+	//quotas limit the spec's own backups only
+	tbs.MaxTotalSizeMB = 0
+	tbs.MaxBackupCount = 0
+	return tbs
+}
+
+//workerConfigFor worker config sent to workflows of a materialized backup. Replicas use the config of their target
+func workerConfigFor(bs BackupSpec, mb MaterializedBackup) *string {
+	if mb.Target == "" {
+		return bs.WorkerConfig
+	}
+	for _, t := range bs.ReplicationTargets {
+		if t.Name == mb.Target {
+			return targetSpec(bs, t).WorkerConfig
+		}
+	}
+	return bs.WorkerConfig
+}
+
+//targetRetentions period and retention string pairs of a replication target
+func targetRetentions(t ReplicationTarget) [][2]string {
+	return [][2]string{{"minutely", t.RetentionMinutely}, {"hourly", t.RetentionHourly}, {"daily", t.RetentionDaily},
+		{"weekly", t.RetentionWeekly}, {"monthly", t.RetentionMonthly}, {"yearly", t.RetentionYearly}}
+}
+
+//checkReplicationTargets checks target names and retention strings of a backup spec
+func checkReplicationTargets(bs BackupSpec) error {
+	names := make(map[string]bool)
+	for _, t := range bs.ReplicationTargets {
+		if t.Name == "" {
+			return fmt.Errorf("Replication target 'name' is required")
+		}
+		if names[t.Name] {
+			return fmt.Errorf("Replication target %s is declared more than once", t.Name)
+		}
+		names[t.Name] = true
+		for _, pr := range targetRetentions(t) {
+			if pr[1] == "" {
+				continue
+			}
+			err := checkRetention(pr[0], pr[1])
+			if err != nil {
+				return fmt.Errorf("Replication target %s: invalid '%s'. %s", t.Name, retentionField(pr[0]), err)
+			}
+		}
+	}
+	return nil
+}
+
+//triggerReplications launches a replicate workflow to each replication target of the spec for a new materialized backup
+func triggerReplications(bs BackupSpec, mb MaterializedBackup) {
+	for _, t := range bs.ReplicationTargets {
+		wid, err := triggerReplication(bs, t, mb)
+		if err != nil {
+			logrus.Errorf("Couldn't launch replication of %s to target %s. err=%s", mb.ID, t.Name, err)
+			overallBackupWarnCounter.WithLabelValues(bs.Name, "error").Inc()
+			continue
+		}
+		logrus.Infof("Workflow %s launched for replicating dataId %s to target %s. workflowId=%s", workflowReplicate, mb.DataID, t.Name, wid)
+	}
+}
+
+func triggerReplication(bs BackupSpec, t ReplicationTarget, mb MaterializedBackup) (string, error) {
+	mi := map[string]interface{}{
+		"backupName":     bs.Name,
+		"dataId":         mb.DataID,
+		"materializedId": mb.ID,
+		"target":         t.Name,
+	}
+	if bs.TimeoutSeconds != nil {
+		mi["timeoutSeconds"] = *bs.TimeoutSeconds
+	}
+	wc := targetSpec(bs, t).WorkerConfig
+	if wc != nil {
+		mi["workerConfig"] = *wc
+	}
+	wid, err := executor.LaunchWorkflow(workflowReplicate, mi)
+	if err != nil {
+		replicateTriggerCounter.WithLabelValues(bs.Name, t.Name, "error").Inc()
+		return "", err
+	}
+
+	//replicas keep the start time of their source so that they are tagged for the same periods
+	sourceID := mb.ID
+	replica := MaterializedBackup{
+		ID:         wid,
+		BackupName: bs.Name,
+		DataID:     mb.DataID,
+		Status:     "replicating",
+		StartTime:  mb.StartTime,
+		EndTime:    mb.EndTime,
+		Target:     t.Name,
+		SourceID:   &sourceID,
+		BackupType: mb.BackupType,
+		//incremental replicas depend on the replica of their source's parent in the same target
+		ParentDataID: replicaParentDataID(bs.Name, t.Name, mb),
+	}
+	err = store.CreateReplicaBackup(replica)
+	if err != nil {
+		replicateTriggerCounter.WithLabelValues(bs.Name, t.Name, "error").Inc()
+		return wid, fmt.Errorf("Couldn't record replica %s. err=%s", wid, err)
+	}
+	replicateTriggerCounter.WithLabelValues(bs.Name, t.Name, "success").Inc()
+	return wid, nil
+}
+
+//replicaParentDataID dataId of the replica, in target, of the backup an incremental backup depends on. nil for full backups
+//or if the parent was not replicated to target
+func replicaParentDataID(backupName string, target string, mb MaterializedBackup) *string {
+	if mb.ParentDataID == nil {
+		return nil
+	}
+	mbs, err := store.GetMaterializedBackups(backupName, 0, "", "", false)
+	if err != nil {
+		logrus.Warnf("Couldn't load backups of %s for finding the parent of %s. err=%s", backupName, mb.ID, err)
+		return nil
+	}
+	parentID := ""
+	for _, p := range mbs {
+		if p.DataID == *mb.ParentDataID {
+			parentID = p.ID
+			break
+		}
+	}
+	replicas, err := store.GetReplicaBackups(backupName, target, "")
+	if err != nil {
+		logrus.Warnf("Couldn't load replicas of %s for finding the parent of %s. err=%s", backupName, mb.ID, err)
+		return nil
+	}
+	for _, r := range replicas {
+		if parentID != "" && r.SourceID != nil && *r.SourceID == parentID && r.Status != "replicate-error" {
+			dataID := r.DataID
+			return &dataID
+		}
+	}
+	logrus.Warnf("Parent %s of backup %s was not replicated to target %s", *mb.ParentDataID, mb.ID, target)
+	return nil
+}
+
+//checkReplicateWorkflows checks all running replications of a backup spec
+func checkReplicateWorkflows(backupName string) {
+	logrus.Debugf("checkReplicateWorkflows %s", backupName)
+
+	replicas, err := store.GetReplicaBackups(backupName, "", "replicating")
+	if err != nil {
+		logrus.Warnf("Couldn't load replicas being created for backup %s. err=%s", backupName, err)
+		overallBackupWarnCounter.WithLabelValues(backupName, "error").Inc()
+		return
+	}
+	for _, mb := range replicas {
+		checkReplicateWorkflow(mb)
+	}
+}
+
+//checkReplicateWorkflow records the outcome of the replicate workflow of a replica and tags the replicas of its target.
+//Replicas whose workflow didn't complete with a dataId get status 'replicate-error'
+func checkReplicateWorkflow(mb MaterializedBackup) error {
+	backupName := mb.BackupName
+	wf, err := getWorkflowInstance(mb.ID)
+	if err != nil && wf.Status != "NOT_FOUND" {
+		overallBackupWarnCounter.WithLabelValues(backupName, "error").Inc()
+		return fmt.Errorf("Couldn't get workflow instance %s. err=%s", mb.ID, err)
+	}
+	if wf.Status == "RUNNING" {
+		logrus.Debugf("Workflow %s for replicating dataId %s to %s is still running", mb.ID, mb.DataID, mb.Target)
+		return nil
+	}
+
+	retentionLock(backupName).Lock()
+	defer retentionLock(backupName).Unlock()
+
+	endTime := wf.EndTime
+	if endTime.IsZero() {
+		endTime = time.Now()
+	}
+	if wf.Status != "COMPLETED" || wf.DataID == nil || wf.DataSizeMB == nil {
+		logrus.Warnf("Replicate workflow %s finished with status %s or without dataId and dataSizeMB. backupName=%s. target=%s", mb.ID, wf.Status, backupName, mb.Target)
+		overallBackupWarnCounter.WithLabelValues(backupName, "warning").Inc()
+		replicateResultCounter.WithLabelValues(backupName, mb.Target, "error").Inc()
+		err := store.UpdateReplicaBackup(mb.ID, "replicate-error", mb.DataID, endTime, 0)
+		if err != nil {
+			return fmt.Errorf("Couldn't set replica status. err=%s", err)
+		}
+		return nil
+	}
+
+	err = store.UpdateReplicaBackup(mb.ID, "COMPLETED", *wf.DataID, endTime, *wf.DataSizeMB)
+	if err != nil {
+		overallBackupWarnCounter.WithLabelValues(backupName, "error").Inc()
+		return fmt.Errorf("Couldn't set replica status. err=%s", err)
+	}
+	//incremental replicas launched before this one completed point to the dataId it had while replicating
+	err = store.UpdateReplicaParents(backupName, mb.Target, mb.DataID, *wf.DataID)
+	if err != nil {
+		overallBackupWarnCounter.WithLabelValues(backupName, "error").Inc()
+		return fmt.Errorf("Couldn't update parents of replicas depending on %s. err=%s", mb.ID, err)
+	}
+	replicateResultCounter.WithLabelValues(backupName, mb.Target, "success").Inc()
+	logrus.Infof("Replica %s of %s in target %s completed. dataId=%s", mb.ID, backupName, mb.Target, *wf.DataID)
+
+	bs, err := store.GetBackupSpec(backupName)
+	if err != nil {
+		return fmt.Errorf("Couldn't load backup spec. err=%s", err)
+	}
+	for _, t := range bs.ReplicationTargets {
+		if t.Name == mb.Target {
+			return tagReplicas(targetSpec(bs, t), t.Name)
+		}
+	}
+	return nil
+}
+
+//tagReplicas calculates tags of the replicas in a replication target using the target's retention. The newest replica gets all tags
+func tagReplicas(tbs BackupSpec, target string) error {
+	replicas, err := store.GetReplicaBackups(tbs.Name, target, "")
+	if err != nil {
+		return fmt.Errorf("Error getting replicas for tagging. err=%s", err)
+	}
+	lastID := ""
+	for _, r := range replicas {
+		if r.Status == "COMPLETED" {
+			lastID = r.ID
+			break
+		}
+	}
+	if lastID == "" {
+		return nil
+	}
+	calculateTags(replicas, tbs, lastID)
+	err = store.UpdateTagsMaterializedBackups(tbs.Name, target, replicas)
+	if err != nil {
+		backupTagCounter.WithLabelValues(tbs.Name, "error").Inc()
+		return fmt.Errorf("Error saving replica tags. err=%s", err)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package backtor
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/flaviostutz/backtor/backtor/backtortest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplicationCycle(t *testing.T) {
+	conductor, teardown := setupTest(t)
+	defer teardown()
+
+	offsiteConfig := "bucket=offsite"
+	createTestBackupSpec(t, BackupSpec{Name: "test", RetentionDaily: "4@L", RetentionWeekly: "1@L", RetentionMonthly: "1@L",
+		ReplicationTargets: []ReplicationTarget{{Name: "offsite", WorkerConfig: &offsiteConfig, RetentionDaily: "1@L"}}})
+	conductor.Script("create_backup", backtortest.Completed("day6", 5), backtortest.Completed("day7", 5), backtortest.Completed("day8", 5))
+	conductor.Script("remove_backup", backtortest.Completed("", 0))
+
+	for day := 6; day <= 8; day++ {
+		now := time.Date(2020, 1, day, 23, 0, 0, 0, time.UTC)
+		conductor.Now = func() time.Time { return now }
+		runBackupCycle(t, "test")
+
+		reps := conductor.Workflows("replicate_backup")
+		require.Equal(t, day-5, len(reps))
+		wf := reps[len(reps)-1]
+		assert.Equal(t, fmt.Sprintf("day%d", day), wf.Input["dataId"])
+		assert.Equal(t, "offsite", wf.Input["target"])
+		assert.Equal(t, offsiteConfig, wf.Input["workerConfig"])
+		require.Nil(t, conductor.Finish(wf.WorkflowID, backtortest.Completed(fmt.Sprintf("offsite-day%d", day), 5)))
+		checkReplicateWorkflows("test")
+		RunRetentionTask("test")
+		checkWorkflowBackupRemove("test")
+	}
+
+	//primary retention keeps all backups while the target keeps one daily replica besides the newest one
+	assert.Equal(t, map[string]string{"day6": "COMPLETED", "day7": "COMPLETED", "day8": "COMPLETED"}, materializedStatuses(t, "test"))
+
+	replicas, err := store.GetReplicaBackups("test", "offsite", "")
+	require.Nil(t, err)
+	st := make(map[string]string)
+	for _, r := range replicas {
+		st[r.DataID] = r.Status
+		require.NotNil(t, r.SourceID)
+		source, err := store.GetMaterializedBackup(*r.SourceID)
+		require.Nil(t, err)
+		assert.Equal(t, "offsite-"+source.DataID, r.DataID)
+	}
+	assert.Equal(t, map[string]string{"offsite-day6": "deleted", "offsite-day7": "COMPLETED", "offsite-day8": "COMPLETED"}, st)
+
+	removes := conductor.Workflows("remove_backup")
+	require.Equal(t, 1, len(removes))
+	assert.Equal(t, "offsite-day6", removes[0].Input["dataId"])
+	assert.Equal(t, "offsite", removes[0].Input["target"])
+	assert.Equal(t, offsiteConfig, removes[0].Input["workerConfig"])
+}
+
+func TestReplicationFailure(t *testing.T) {
+	conductor, teardown := setupTest(t)
+	defer teardown()
+
+	createTestBackupSpec(t, BackupSpec{Name: "test", ReplicationTargets: []ReplicationTarget{{Name: "offsite"}}})
+	conductor.Script("create_backup", backtortest.Completed("data1", 5))
+	conductor.Script("replicate_backup", backtortest.Failed())
+	runBackupCycle(t, "test")
+	checkReplicateWorkflows("test")
+
+	replicas, err := store.GetReplicaBackups("test", "", "")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(replicas))
+	assert.Equal(t, "replicate-error", replicas[0].Status)
+
+	//replicas are not listed with the materialized backups of the spec
+	mbs, err := store.GetMaterializedBackups("test", 0, "", "", false)
+	require.Nil(t, err)
+	assert.Equal(t, 1, len(mbs))
+}
+
+func TestReplicationIncrementalChain(t *testing.T) {
+	conductor, teardown := setupTest(t)
+	defer teardown()
+
+	incrementalCron := "0 0 12 * * *"
+	createTestBackupSpec(t, BackupSpec{Name: "test", IncrementalCronString: &incrementalCron,
+		RetentionDaily: "10@L", RetentionWeekly: "1@L", RetentionMonthly: "1@L", RetentionYearly: "1@L",
+		ReplicationTargets: []ReplicationTarget{{Name: "offsite", RetentionDaily: "1@L"}}})
+	conductor.Script("remove_backup", backtortest.Completed("", 0))
+
+	//a full backup on monday followed by incrementals until the next monday
+	for day := 6; day <= 13; day++ {
+		now := time.Date(2020, 1, day, 23, 0, 0, 0, time.UTC)
+		conductor.Now = func() time.Time { return now }
+		bt := backupTypeIncremental
+		if day == 6 {
+			bt = ""
+			conductor.Script("create_backup", backtortest.Full("day6", 10))
+		} else {
+			conductor.Script("create_backup", backtortest.Incremental(fmt.Sprintf("day%d", day), fmt.Sprintf("day%d", day-1), 1))
+		}
+		conductor.Script("replicate_backup", backtortest.Completed(fmt.Sprintf("offsite-day%d", day), 1))
+		_, err := triggerNewBackupOfType("test", bt)
+		require.Nil(t, err)
+		checkBackupWorkflow("test")
+		//on odd days the replica of the previous day is still being recorded when the next one is launched
+		if day%2 == 0 {
+			checkReplicateWorkflows("test")
+		}
+		RunRetentionTask("test")
+		checkWorkflowBackupRemove("test")
+	}
+	checkReplicateWorkflows("test")
+	RunRetentionTask("test")
+	checkWorkflowBackupRemove("test")
+
+	replicas, err := store.GetReplicaBackups("test", "offsite", "")
+	require.Nil(t, err)
+	require.Equal(t, 8, len(replicas))
+	for _, r := range replicas {
+		//older replicas are beyond the target's daily retention, but retained replicas depend on them
+		assert.Equal(t, "COMPLETED", r.Status, r.DataID)
+		if r.DataID == "offsite-day6" {
+			assert.Equal(t, "full", r.BackupType)
+			assert.Nil(t, r.ParentDataID)
+			continue
+		}
+		assert.Equal(t, backupTypeIncremental, r.BackupType)
+		require.NotNil(t, r.ParentDataID, r.DataID)
+		var day int
+		fmt.Sscanf(r.DataID, "offsite-day%d", &day)
+		assert.Equal(t, fmt.Sprintf("offsite-day%d", day-1), *r.ParentDataID)
+	}
+	assert.Equal(t, 0, len(conductor.Workflows("remove_backup")))
+}
@@ -0,0 +1,164 @@
+package backtor
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+//METRICS
+var restoreTriggerCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "backtor_restore_trigger_total",
+	Help: "Total restores triggered",
+}, []string{
+	"backup",
+	"status",
+})
+
+var restoreWorkflowCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "backtor_restore_workflow_total",
+	Help: "Total restore workflows finished",
+}, []string{
+	"backup",
+	"status",
+})
+
+func InitTaskRestore() {
+	prometheus.MustRegister(restoreTriggerCounter)
+	prometheus.MustRegister(restoreWorkflowCounter)
+}
+
+//restoreError restore request that can't be accepted. Conflict is set for backups that exist but can't be restored now,
+//otherwise the backup was not found. The other errors of triggerRestore are internal errors
+type restoreError struct {
+	msg      string
+	conflict bool
+}
+
+func (e restoreError) Error() string {
+	return e.msg
+}
+
+func triggerRestore(backupName string, materializedID string, target map[string]interface{}) (restoreID string, err error) {
+	logrus.Info("")
+	logrus.Infof(">>>> TRIGGER RESTORE %s %s", backupName, materializedID)
+
+	mb, err := store.GetMaterializedBackup(materializedID)
+	if err == sql.ErrNoRows {
+		return "", restoreError{msg: fmt.Sprintf("Materialized backup %s not found", materializedID)}
+	}
+	if err != nil {
+		return "", fmt.Errorf("Couldn't load materialized backup %s. err=%s", materializedID, err)
+	}
+	if mb.BackupName != backupName {
+		return "", restoreError{msg: fmt.Sprintf("Materialized backup %s doesn't belong to backup %s", materializedID, backupName)}
+	}
+	if mb.Status != "COMPLETED" {
+		return "", restoreError{msg: fmt.Sprintf("Materialized backup %s cannot be restored because its status is not 'COMPLETED'. status=%s", mb.ID, mb.Status), conflict: true}
+	}
+
+	bs, err := store.GetBackupSpec(backupName)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't load backup spec %s. err=%s", backupName, err)
+	}
+
+	mi := make(map[string]interface{})
+	mi["backupName"] = backupName
+	mi["dataId"] = mb.DataID
+	if bs.TimeoutSeconds != nil {
+		mi["timeoutSeconds"] = *bs.TimeoutSeconds
+	}
+	wc := workerConfigFor(bs, mb)
+	if wc != nil {
+		mi["workerConfig"] = *wc
+	}
+	if target != nil {
+		mi["target"] = target
+	}
+	if mb.Target != "" {
+		mi["replicationTarget"] = mb.Target
+	}
+
+	workflowID, err := executor.LaunchWorkflow(opt.RestoreWorkflowName, mi)
+	if err != nil {
+		restoreTriggerCounter.WithLabelValues(backupName, "error").Inc()
+		return "", fmt.Errorf("Couldn't invoke workflow for backup restore. err=%s", err)
+	}
+	logrus.Infof("Workflow %s launched for restoring dataID %s. workflowId=%s", opt.RestoreWorkflowName, mb.DataID, workflowID)
+
+	err = store.CreateRestore(Restore{
+		ID:             workflowID,
+		BackupName:     backupName,
+		MaterializedID: mb.ID,
+		DataID:         mb.DataID,
+		Status:         "RUNNING",
+		Target:         target,
+		StartTime:      time.Now(),
+	})
+	if err != nil {
+		restoreTriggerCounter.WithLabelValues(backupName, "error").Inc()
+		return "", fmt.Errorf("Restore workflow %s launched but couldn't be saved to database. err=%s", workflowID, err)
+	}
+	restoreTriggerCounter.WithLabelValues(backupName, "success").Inc()
+	return workflowID, nil
+}
+
+//checkRestoreWorkflows checks all running restores of a backup spec
+func checkRestoreWorkflows(backupName string) {
+	logrus.Debugf("checkRestoreWorkflows %s", backupName)
+
+	rs, err := store.GetRestores(backupName, "RUNNING")
+	if err != nil {
+		logrus.Warnf("Couldn't load running restores for backup %s. err=%s", backupName, err)
+		overallBackupWarnCounter.WithLabelValues(backupName, "error").Inc()
+		return
+	}
+
+	for _, r := range rs {
+		checkRestoreWorkflow(r)
+	}
+}
+
+//checkRestoreWorkflow sets the final status of a running restore after its workflow finishes
+func checkRestoreWorkflow(r Restore) error {
+	backupName := r.BackupName
+	wf, err0 := getWorkflowInstance(r.ID)
+	if err0 != nil && wf.Status != "NOT_FOUND" {
+		logrus.Debugf("Couldn't get workflow instance %s. err=%s", r.ID, err0)
+		overallBackupWarnCounter.WithLabelValues(backupName, "error").Inc()
+		return fmt.Errorf("Couldn't get workflow instance %s. err=%s", r.ID, err0)
+	}
+	if wf.Status == "NOT_FOUND" {
+		//the workflow will never finish, so the restore is failed instead of being checked forever
+		logrus.Warnf("Workflow %s of restore of dataId %s was not found", r.ID, r.DataID)
+		wf.WorkflowID = r.ID
+		wf.Status = "FAILED"
+	}
+
+	if wf.Status == "RUNNING" {
+		logrus.Debugf("Workflow %s for restoring dataId %s is still running", wf.WorkflowID, r.DataID)
+		return nil
+	}
+
+	logrus.Infof("Workflow %s for restoring dataId %s has finished. status=%s. backup=%s", wf.WorkflowID, r.DataID, wf.Status, backupName)
+	if wf.Status != "COMPLETED" {
+		logrus.Warnf("Restore workflow %s finished with status!=COMPLETED. backupName=%s. status=%s", wf.WorkflowID, backupName, wf.Status)
+		overallBackupWarnCounter.WithLabelValues(backupName, "warning").Inc()
+	}
+
+	endTime := wf.EndTime
+	if endTime.IsZero() {
+		endTime = time.Now()
+	}
+	err1 := store.SetStatusRestore(r.ID, wf.Status, &endTime)
+	if err1 != nil {
+		logrus.Errorf("Couldn't set restore status. err=%s", err1)
+		overallBackupWarnCounter.WithLabelValues(backupName, "error").Inc()
+		return fmt.Errorf("Couldn't set restore status. err=%s", err1)
+	}
+	restoreWorkflowCounter.WithLabelValues(backupName, wf.Status).Inc()
+	return nil
+}
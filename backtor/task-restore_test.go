@@ -0,0 +1,107 @@
+package backtor
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/flaviostutz/backtor/backtor/backtortest"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestoreCycle(t *testing.T) {
+	conductor, teardown := setupTest(t)
+	defer teardown()
+
+	createTestBackupSpec(t, BackupSpec{Name: "test"})
+	conductor.Script("create_backup", backtortest.Completed("data1", 5))
+	conductor.Now = func() time.Time { return time.Date(2020, 1, 6, 23, 0, 0, 0, time.UTC) }
+	runBackupCycle(t, "test")
+
+	mbs, err := store.GetMaterializedBackups("test", 0, "", "COMPLETED", false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(mbs))
+
+	_, err = triggerRestore("other", mbs[0].ID, nil)
+	assert.NotNil(t, err, "materialized backup from another spec must not be restored")
+
+	rid, err := triggerRestore("test", mbs[0].ID, map[string]interface{}{"host": "db2"})
+	require.Nil(t, err)
+
+	wf, ok := conductor.Workflow(rid)
+	require.True(t, ok)
+	assert.Equal(t, "restore_backup", wf.WorkflowType)
+	assert.Equal(t, "data1", wf.Input["dataId"])
+	assert.Equal(t, map[string]interface{}{"host": "db2"}, wf.Input["target"])
+
+	checkRestoreWorkflows("test")
+	rs, err := store.GetRestores("test", "")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(rs))
+	assert.Equal(t, "RUNNING", rs[0].Status)
+	assert.Nil(t, rs[0].EndTime)
+
+	require.Nil(t, conductor.Finish(rid, backtortest.Failed()))
+	checkRestoreWorkflows("test")
+	rs, err = store.GetRestores("test", "")
+	require.Nil(t, err)
+	assert.Equal(t, "FAILED", rs[0].Status)
+	assert.Equal(t, "db2", rs[0].Target["host"])
+	assert.NotNil(t, rs[0].EndTime)
+}
+
+func TestTriggerRestoreStatus(t *testing.T) {
+	conductor, teardown := setupTest(t)
+	defer teardown()
+
+	router := gin.New()
+	router.POST("/backup/:name/materialized/:id/restore", TriggerRestore())
+	post := func(path string) int {
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader([]byte(`{}`)))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	createTestBackupSpec(t, BackupSpec{Name: "test"})
+	createTestBackupSpec(t, BackupSpec{Name: "other"})
+	conductor.Script("create_backup", backtortest.Completed("data1", 5), backtortest.Completed("data2", 5))
+	conductor.Now = func() time.Time { return time.Date(2020, 1, 6, 23, 0, 0, 0, time.UTC) }
+	runBackupCycle(t, "test")
+	conductor.Now = func() time.Time { return time.Date(2020, 1, 7, 23, 0, 0, 0, time.UTC) }
+	runBackupCycle(t, "test")
+
+	mbs, err := store.GetMaterializedBackups("test", 0, "", "", false)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(mbs))
+	deleting := "wf-deleting"
+	require.Nil(t, store.SetStatusMaterializedBackup(mbs[0].ID, "deleting", &deleting))
+
+	assert.Equal(t, http.StatusNotFound, post("/backup/test/materialized/unknown/restore"))
+	assert.Equal(t, http.StatusNotFound, post("/backup/other/materialized/"+mbs[1].ID+"/restore"))
+	assert.Equal(t, http.StatusConflict, post("/backup/test/materialized/"+mbs[0].ID+"/restore"))
+	assert.Equal(t, http.StatusAccepted, post("/backup/test/materialized/"+mbs[1].ID+"/restore"))
+
+	//store failures are not reported as missing backups
+	store.Close()
+	assert.Equal(t, http.StatusInternalServerError, post("/backup/test/materialized/"+mbs[1].ID+"/restore"))
+}
+
+func TestRestoreWorkflowNotFound(t *testing.T) {
+	_, teardown := setupTest(t)
+	defer teardown()
+
+	createTestBackupSpec(t, BackupSpec{Name: "test"})
+	require.Nil(t, store.CreateRestore(Restore{ID: "lost", BackupName: "test", MaterializedID: "m1", DataID: "data1", Status: "RUNNING", StartTime: time.Now()}))
+
+	checkRestoreWorkflows("test")
+	rs, err := store.GetRestores("test", "")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(rs))
+	assert.Equal(t, "FAILED", rs[0].Status)
+	assert.NotNil(t, rs[0].EndTime)
+}
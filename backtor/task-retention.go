@@ -2,6 +2,7 @@ package backtor
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -29,10 +30,16 @@ var retentionBackupsRetriesCounter = prometheus.NewCounter(prometheus.CounterOpt
 	Help: "Total retention backup delete retries",
 })
 
+//maxRetentionDeletesPerTag max delete workflows launched for each tag on a retention run
+const maxRetentionDeletesPerTag = 20
+
 // var avoidRetentionLock = &sync.Mutex{}
 var retentionLocks = make(map[string]*sync.Mutex)
+var retentionLocksMutex sync.Mutex
 
 func retentionLock(backupName string) *sync.Mutex {
+	retentionLocksMutex.Lock()
+	defer retentionLocksMutex.Unlock()
 	m, ok := retentionLocks[backupName]
 	if !ok {
 		m = &sync.Mutex{}
@@ -58,7 +65,7 @@ func RunRetentionTask(backupName string) {
 	start := time.Now()
 	retentionTasksCounter.Inc()
 
-	bs, err := getBackupSpec(backupName)
+	bs, err := store.GetBackupSpec(backupName)
 	if err != nil {
 		logrus.Errorf("Could not get backup spec for %s. err=%s", backupName, err)
 		return
@@ -68,37 +75,86 @@ func RunRetentionTask(backupName string) {
 
 	logrus.Debugf("Retention policy: minutely=%s, hourly=%s, daily=%s, weekly=%s, monthly=%s, yearly=%s", bs.MinutelyParams()[0], bs.HourlyParams()[0], bs.DailyParams()[0], bs.WeeklyParams()[0], bs.MonthlyParams()[0], bs.YearlyParams()[0])
 
-	electedBackups := make([]MaterializedBackup, 0)
-	electedBackups = appendElectedForTag(backupName, "", "0", electedBackups)
-	electedBackups = appendElectedForTag(backupName, "minutely", bs.MinutelyParams()[0], electedBackups)
-	electedBackups = appendElectedForTag(backupName, "hourly", bs.HourlyParams()[0], electedBackups)
-	electedBackups = appendElectedForTag(backupName, "daily", bs.DailyParams()[0], electedBackups)
-	electedBackups = appendElectedForTag(backupName, "weekly", bs.WeeklyParams()[0], electedBackups)
-	electedBackups = appendElectedForTag(backupName, "monthly", bs.MonthlyParams()[0], electedBackups)
-	electedBackups = appendElectedForTag(backupName, "yearly", bs.YearlyParams()[0], electedBackups)
-	logrus.Infof("%d backups elected for deletion", len(electedBackups))
+	mbs, err := store.GetMaterializedBackups(backupName, 0, "", "COMPLETED", false)
+	if err != nil {
+		logrus.Errorf("Error querying backups for deletion. err=%s", err)
+		return
+	}
+	elected := electForDeletion(mbs, bs)
+	logrus.Infof("%d backups elected for deletion", len(elected))
+	deleteElected(bs, mbs, elected)
+
+	//each replication target has its own retention
+	for _, t := range bs.ReplicationTargets {
+		tbs := targetSpec(bs, t)
+		err := tagReplicas(tbs, t.Name)
+		if err != nil {
+			logrus.Errorf("Error tagging replicas of %s in target %s. err=%s", backupName, t.Name, err)
+			continue
+		}
+		replicas, err := store.GetReplicaBackups(backupName, t.Name, "COMPLETED")
+		if err != nil {
+			logrus.Errorf("Error querying replicas for deletion. target=%s err=%s", t.Name, err)
+			continue
+		}
+		elected := electForDeletion(replicas, tbs)
+		logrus.Infof("%d replicas elected for deletion in target %s", len(elected), t.Name)
+		deleteElected(tbs, replicas, elected)
+	}
 
-	for _, backup := range electedBackups {
-		logrus.Debugf("Deleting backup '%s'...", backup.ID)
+	elapsed := time.Now().Sub(start)
+	logrus.Infof("Retention management task done. elapsed=%s", elapsed)
+}
+
+//deleteElected launches delete workflows for the elected backups (newest first), limited to maxRetentionDeletesPerTag per tag.
+//Backups of a full/incremental chain are counted as their oldest elected ancestor so that chains are deleted together
+func deleteElected(bs BackupSpec, mbs []MaterializedBackup, elected map[string]string) {
+	tiers := retentionTiers(bs)
+	parent := chainParents(mbs)
+	tierCount := make(map[string]int)
+	allowed := make(map[string]bool)
+	for _, backup := range mbs {
+		if _, ok := elected[backup.ID]; !ok {
+			continue
+		}
+		root := backup
+		for i := 0; i < len(mbs); i++ {
+			p, ok := parent(root)
+			if !ok {
+				break
+			}
+			if _, e := elected[p.ID]; !e {
+				break
+			}
+			root = p
+		}
+		ok, decided := allowed[root.ID]
+		if !decided {
+			tier := retentionTier(root, tiers)
+			tierCount[tier]++
+			ok = tierCount[tier] <= maxRetentionDeletesPerTag
+			allowed[root.ID] = ok
+		}
+		if !ok {
+			continue
+		}
+		logrus.Debugf("Deleting backup '%s'. reason=%s", backup.ID, elected[backup.ID])
 
 		err := triggerBackupDelete(backup.ID)
 		if err != nil {
 			logrus.Errorf("Couldn't trigger backup delete for materialized backup %s. err=%s", backup.ID, err)
-			retentionBackupsDeleteCounter.WithLabelValues("error").Inc()
+			retentionBackupsDeleteCounter.WithLabelValues(bs.Name, "error").Inc()
 			continue
 		}
 
 		//give some breath to backed webhook
 		// time.Sleep(1000 * time.Millisecond)
 	}
-
-	elapsed := time.Now().Sub(start)
-	logrus.Infof("Retention management task done. elapsed=%s", elapsed)
 }
 
 func triggerBackupDelete(materializedID string) error {
 	logrus.Debugf("triggerBackupDelete %s", materializedID)
-	mb, err := getMaterializedBackup(materializedID)
+	mb, err := store.GetMaterializedBackup(materializedID)
 	if err != nil {
 		return fmt.Errorf("Couldn't load materized backup %s", materializedID)
 	}
@@ -111,12 +167,16 @@ func triggerBackupDelete(materializedID string) error {
 		return fmt.Errorf("Materialized backup %s cannot be deleted because it already has a runningCreateWorkflowID set", mb.ID)
 	}
 
-	bs, err1 := getBackupSpec(mb.BackupName)
+	if isHeld(mb, time.Now()) {
+		return fmt.Errorf("Materialized backup %s cannot be deleted because it is on hold by %s", mb.ID, *mb.HoldBy)
+	}
+
+	bs, err1 := store.GetBackupSpec(mb.BackupName)
 	if err1 != nil {
 		return fmt.Errorf("Error getting backup spec %s. err=%s", mb.BackupName, err1)
 	}
 
-	workflowID, err1 := launchRemoveBackupWorkflow(mb.BackupName, mb.DataID, bs.TimeoutSeconds, bs.WorkerConfig)
+	workflowID, err1 := launchRemoveBackupWorkflow(mb.BackupName, mb.DataID, mb.Target, bs.TimeoutSeconds, workerConfigFor(bs, mb))
 	if err1 != nil {
 		overallBackupWarnCounter.WithLabelValues(mb.BackupName, "error").Inc()
 		m := fmt.Sprintf("Couldn't invoke Conductor workflow for backup removal. err=%s", err1)
@@ -124,7 +184,7 @@ func triggerBackupDelete(materializedID string) error {
 	}
 	logrus.Infof("Backup %s delete workflow launched successfuly for dataID %s. workflowID=%s", mb.BackupName, mb.DataID, workflowID)
 
-	_, err3 := setStatusMaterializedBackup(materializedID, "deleting", &workflowID)
+	err3 := store.SetStatusMaterializedBackup(materializedID, "deleting", &workflowID)
 	if err3 != nil {
 		return fmt.Errorf("Couldn't update status of materialized backup %s to 'deleting'. err=%s", mb.ID, err3)
 	}
@@ -132,95 +192,350 @@ func triggerBackupDelete(materializedID string) error {
 	return nil
 }
 
+//relaunchBackupDelete launches a new remove workflow for a materialized backup (or replica) whose removal was lost or failed
+func relaunchBackupDelete(mb MaterializedBackup) error {
+	bs, err1 := store.GetBackupSpec(mb.BackupName)
+	if err1 != nil {
+		logrus.Errorf("Error getting backup spec %s. err=%s", mb.BackupName, err1)
+		return fmt.Errorf("Error getting backup spec %s. err=%s", mb.BackupName, err1)
+	}
+	wid, err2 := launchRemoveBackupWorkflow(mb.BackupName, mb.DataID, mb.Target, bs.TimeoutSeconds, workerConfigFor(bs, mb))
+	if err2 != nil {
+		logrus.Warnf("Couldn't relaunch workflow for deleting dataId %s. err=%s", mb.DataID, err2)
+		return fmt.Errorf("Couldn't relaunch workflow for deleting dataId %s. err=%s", mb.DataID, err2)
+	}
+	err3 := store.SetStatusMaterializedBackup(mb.ID, "deleting", &wid)
+	if err3 != nil {
+		overallBackupWarnCounter.WithLabelValues(mb.BackupName, "error").Inc()
+		return fmt.Errorf("Couldn't record relaunched workflow %s of materialized backup %s. err=%s", wid, mb.ID, err3)
+	}
+	logrus.Infof("Workflow relaunched to delete dataId %s. workflowId=%s", mb.DataID, wid)
+	return nil
+}
+
+//checkWorkflowBackupRemove checks the delete workflows of all materialized backups and replicas of a spec in 'deleting' status
 func checkWorkflowBackupRemove(backupName string) {
 	logrus.Debugf("checkWorkflowBackupRemove backupName=%s", backupName)
 
-	mbs, err := getMaterializedBackups(backupName, 20, "", "deleting", false)
+	mbs, err := store.GetMaterializedBackups(backupName, 0, "", "deleting", false)
 	if err != nil {
 		logrus.Warnf("Couldn't load materializeds for backup %s", backupName)
 		overallBackupWarnCounter.WithLabelValues(backupName, "error").Inc()
 		return
 	}
+	replicas, err := store.GetReplicaBackups(backupName, "", "deleting")
+	if err != nil {
+		logrus.Warnf("Couldn't load replicas for backup %s", backupName)
+		overallBackupWarnCounter.WithLabelValues(backupName, "error").Inc()
+		return
+	}
+	mbs = append(mbs, replicas...)
 	if len(mbs) == 0 {
 		logrus.Debugf("No materialized backups pending delete for backup %s", backupName)
 		return
 	}
 
 	for _, mb := range mbs {
-		if mb.RunningDeleteWorkflowID == nil {
-			logrus.Errorf("Materialized backup %s has no running delete workflow set but status is 'deleting'", mb.ID)
+		checkBackupRemoveWorkflow(mb)
+	}
+}
+
+//checkBackupRemoveWorkflow sets the final status of a materialized backup in 'deleting' status after its delete workflow finishes
+func checkBackupRemoveWorkflow(mb MaterializedBackup) error {
+	backupName := mb.BackupName
+	if mb.RunningDeleteWorkflowID == nil {
+		logrus.Errorf("Materialized backup %s has no running delete workflow set but status is 'deleting'", mb.ID)
+		overallBackupWarnCounter.WithLabelValues(backupName, "error").Inc()
+		return fmt.Errorf("Materialized backup %s has no running delete workflow set but status is 'deleting'", mb.ID)
+	}
+
+	logrus.Debugf("Checking backup %s. dataId=%s. deleteWorkflowId=%s", mb.BackupName, mb.DataID, *mb.RunningDeleteWorkflowID)
+
+	wf, err0 := getWorkflowInstance(*mb.RunningDeleteWorkflowID)
+	if err0 != nil && wf.Status != "NOT_FOUND" {
+		//the executor may be temporarily unavailable. The workflow is checked again on the next run
+		logrus.Debugf("Couldn't get workflow instance %s. err=%s", *mb.RunningDeleteWorkflowID, err0)
+		overallBackupWarnCounter.WithLabelValues(backupName, "error").Inc()
+		return fmt.Errorf("Couldn't get workflow instance %s. err=%s", *mb.RunningDeleteWorkflowID, err0)
+	}
+	logrus.Debugf("Found workflowId=%s. status=%s", wf.WorkflowID, wf.Status)
+
+	if wf.Status == "NOT_FOUND" {
+		logrus.Warnf("Materialized backup %s has status 'deleting' but its workflow %s was not found. Relaunching", mb.ID, *mb.RunningDeleteWorkflowID)
+		return relaunchBackupDelete(mb)
+	}
+
+	if wf.Status == "RUNNING" {
+		logrus.Debugf("Workflow %s for removing materialized backup is still running", *mb.RunningDeleteWorkflowID)
+		return nil
+	}
+
+	logrus.Infof("Conductor workflow %s for backup deletion of %s has finished. status=%s", wf.WorkflowID, backupName, wf.Status)
+
+	if wf.Status != "COMPLETED" {
+		logrus.Warnf("Workflow %s has finished but status is not COMPLETED. status=%s. backupName=%s. dataId=%s", wf.WorkflowID, wf.Status, mb.BackupName, mb.DataID)
+		err2 := store.SetStatusMaterializedBackup(mb.ID, "delete-error", mb.RunningDeleteWorkflowID)
+		if err2 != nil {
+			logrus.Errorf("Couldn't set materialized backup status. err=%s", err2)
 			overallBackupWarnCounter.WithLabelValues(backupName, "error").Inc()
-			continue
+			return fmt.Errorf("Couldn't set materialized backup status. err=%s", err2)
+		}
+		retentionBackupsDeleteCounter.WithLabelValues(backupName, wf.Status).Inc()
+		notify(Notification{Event: notifyDeleteError, BackupName: backupName, WorkflowID: wf.WorkflowID, MaterializedID: mb.ID,
+			Message: fmt.Sprintf("Remove workflow of dataId %s finished with status %s. The backup is in 'delete-error' status", mb.DataID, wf.Status)})
+		return nil
+	}
+
+	logrus.Warnf("Workflow %s has finished. status=%s. backupName=%s. dataId=%s", wf.WorkflowID, wf.Status, mb.BackupName, mb.DataID)
+	err2 := store.SetStatusMaterializedBackup(mb.ID, "deleted", nil)
+	if err2 != nil {
+		logrus.Errorf("Couldn't set materialized backup status. err=%s", err2)
+		overallBackupWarnCounter.WithLabelValues(backupName, "error").Inc()
+		return fmt.Errorf("Couldn't set materialized backup status. err=%s", err2)
+	}
+	logrus.Warnf("Workflow %s has completed and backup was removed. dataId=%s. backupName=%s", wf.WorkflowID, mb.DataID, mb.BackupName)
+	retentionBackupsDeleteCounter.WithLabelValues(backupName, wf.Status).Inc()
+	return nil
+}
+
+//retentionTiers tags that group backups for retention, from the lowest to the highest
+func retentionTiers(bs BackupSpec) []string {
+	return append([]string{"reference"}, periodTags(bs)...)
+}
+
+//retentionTier highest tag of a materialized backup among tiers, or "" if it has no tags
+func retentionTier(mb MaterializedBackup, tiers []string) string {
+	tier := ""
+	for _, t := range tiers {
+		if hasTag(mb, t) {
+			tier = t
 		}
+	}
+	return tier
+}
 
-		logrus.Debugf("Checking backup %s. dataId=%s. deleteWorkflowId=%s", mb.BackupName, mb.DataID, *mb.RunningDeleteWorkflowID)
+//retentionCounts number of backups to be retained for each tag. Tags with an invalid count are not present
+func retentionCounts(bs BackupSpec) map[string]int {
+	params := map[string]string{
+		"minutely": bs.MinutelyParams()[0],
+		"hourly":   bs.HourlyParams()[0],
+		"daily":    bs.DailyParams()[0],
+		"weekly":   bs.WeeklyParams()[0],
+		"monthly":  bs.MonthlyParams()[0],
+		"yearly":   bs.YearlyParams()[0],
+	}
+	counts := make(map[string]int)
+	for tag, p := range params {
+		ret, err := strconv.Atoi(p)
+		if err != nil {
+			logrus.Errorf("%s: Invalid retention parameter: err=%s", tag, err)
+			continue
+		}
+		counts[tag] = ret
+	}
+	for _, p := range bs.Periods {
+		counts[p.Name] = p.Keep
+	}
+	return counts
+}
 
-		relaunch := false
-		wf, err0 := getWorkflowInstance(*mb.RunningDeleteWorkflowID)
-		if err0 != nil {
-			logrus.Debugf("Couldn't get workflow instance %s. err=%s", *mb.RunningDeleteWorkflowID, err0)
-			overallBackupWarnCounter.WithLabelValues(backupName, "error").Inc()
-			relaunch = true
+//electForDeletion elects the COMPLETED backups that are not needed anymore, with the reason, by materialized id.
+//Backups are grouped by their highest tag and, for each tag, the newest ones are kept up to the tag's retention count.
+//Backups without tags are always elected, unless a retained incremental backup depends on them. Backups on hold are never elected
+//and don't count toward retention. Tags must already be calculated
+func electForDeletion(backups []MaterializedBackup, bs BackupSpec) map[string]string {
+	counts := retentionCounts(bs)
+	tiers := retentionTiers(bs)
+
+	ordered := make([]MaterializedBackup, 0)
+	for _, mb := range backups {
+		if mb.Status == "COMPLETED" {
+			ordered = append(ordered, mb)
 		}
-		logrus.Debugf("Found workflowId=%s. status=%s. relaunch=%s", wf.workflowID, wf.status, relaunch)
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].StartTime.After(ordered[j].StartTime)
+	})
+
+	now := time.Now()
+	elected := make(map[string]string)
+	kept := make(map[string]int)
+	for _, mb := range ordered {
+		//held backups are kept without taking the place of other backups of their tag
+		if isHeld(mb, now) {
+			continue
+		}
+		tier := retentionTier(mb, tiers)
+		if tier == "" {
+			elected[mb.ID] = "no tags"
+			continue
+		}
+		ret, ok := counts[tier]
+		if !ok {
+			continue
+		}
+		kept[tier]++
+		if kept[tier] > ret {
+			elected[mb.ID] = fmt.Sprintf("%s retention is %d", tier, ret)
+		}
+	}
 
-		if relaunch {
-			logrus.Warnf("Materialized backup %s has status 'deleting' but there is something wrong with its workflow. Relaunching", mb.ID)
-			bs, err1 := getBackupSpec(mb.BackupName)
-			if err1 != nil {
-				logrus.Errorf("Error getting backup spec %s. err=%s", mb.BackupName, err1)
-				continue
-			}
-			wid, err2 := launchRemoveBackupWorkflow(mb.BackupName, mb.DataID, bs.TimeoutSeconds, bs.WorkerConfig)
-			if err2 != nil {
-				logrus.Warnf("Couldn't relaunch workflow for deleting dataId %s. err=%s", mb.DataID, err2)
-				continue
-			}
-			logrus.Infof("Workflow relaunched to delete dataId %s. workflowId=%s", mb.DataID, wid)
+	//backups that retained incremental backups depend on are never deleted
+	parent := chainParents(ordered)
+	for _, mb := range ordered {
+		if _, ok := elected[mb.ID]; ok {
 			continue
 		}
+		p := mb
+		for i := 0; i < len(ordered); i++ {
+			var ok bool
+			p, ok = parent(p)
+			if !ok {
+				break
+			}
+			delete(elected, p.ID)
+		}
+	}
+
+	electOverQuota(ordered, bs, elected, now)
+	return elected
+}
 
-		if wf.status == "RUNNING" {
-			logrus.Debugf("Workflow %s for removing materialized backup is still running", *mb.RunningDeleteWorkflowID)
+//quotaUsage total size and number of the backups that count toward the spec's quotas. Held backups don't count
+func quotaUsage(backups []MaterializedBackup, elected map[string]string, now time.Time) (float64, int) {
+	size := 0.0
+	count := 0
+	for _, mb := range backups {
+		if _, ok := elected[mb.ID]; ok || mb.Status != "COMPLETED" || isHeld(mb, now) {
 			continue
 		}
+		size += mb.SizeMB
+		count++
+	}
+	return size, count
+}
+
+//electOverQuota elects, while the retained backups exceed maxTotalSizeMB or maxBackupCount, the backups of the lowest tier,
+//oldest first. The newest backup (which has all tags) and backups a retained backup depends on are never elected.
+//ordered must be newest first
+func electOverQuota(ordered []MaterializedBackup, bs BackupSpec, elected map[string]string, now time.Time) {
+	if (bs.MaxTotalSizeMB <= 0 && bs.MaxBackupCount <= 0) || len(ordered) == 0 {
+		return
+	}
+	size, count := quotaUsage(ordered, elected, now)
+	over := func() bool {
+		return (bs.MaxTotalSizeMB > 0 && size > bs.MaxTotalSizeMB) || (bs.MaxBackupCount > 0 && count > bs.MaxBackupCount)
+	}
+	if !over() {
+		return
+	}
 
-		logrus.Infof("Conductor workflow %s for backup deletion of %s has finished. status=%s", wf.workflowID, backupName, wf.status)
+	tiers := retentionTiers(bs)
+	rank := make(map[string]int)
+	for i, t := range tiers {
+		rank[t] = i
+	}
+	candidates := make([]MaterializedBackup, 0)
+	for _, mb := range ordered[1:] {
+		if _, ok := elected[mb.ID]; ok || isHeld(mb, now) {
+			continue
+		}
+		candidates = append(candidates, mb)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		ri := rank[retentionTier(candidates[i], tiers)]
+		rj := rank[retentionTier(candidates[j], tiers)]
+		if ri != rj {
+			return ri < rj
+		}
+		return candidates[i].StartTime.Before(candidates[j].StartTime)
+	})
 
-		if wf.status != "COMPLETED" {
-			logrus.Warnf("Workflow %s has finished but status is not COMPLETED. status=%s. backupName=%s. dataId=%s", wf.workflowID, wf.status, mb.BackupName, mb.DataID)
-			_, err2 := setStatusMaterializedBackup(mb.ID, "delete-error", mb.RunningDeleteWorkflowID)
-			if err2 != nil {
-				logrus.Errorf("Couldn't set materialized backup status. err=%s", err2)
-				overallBackupWarnCounter.WithLabelValues(backupName, "error").Inc()
+	parent := chainParents(ordered)
+	dependedOn := func(c MaterializedBackup) bool {
+		for _, mb := range ordered {
+			if _, ok := elected[mb.ID]; ok {
 				continue
 			}
+			if p, ok := parent(mb); ok && p.ID == c.ID {
+				return true
+			}
 		}
+		return false
+	}
 
-		logrus.Warnf("Workflow %s has finished. status=%s. backupName=%s. dataId=%s", wf.workflowID, wf.status, mb.BackupName, mb.DataID)
-		_, err2 := setStatusMaterializedBackup(mb.ID, "deleted", nil)
-		if err2 != nil {
-			logrus.Errorf("Couldn't set materialized backup status. err=%s", err2)
-			overallBackupWarnCounter.WithLabelValues(backupName, "error").Inc()
-			continue
+	for over() {
+		i := 0
+		for ; i < len(candidates); i++ {
+			if !dependedOn(candidates[i]) {
+				break
+			}
 		}
-		logrus.Warnf("Workflow %s has completed and backup was removed. dataId=%s. backupName=%s", wf.workflowID, mb.DataID, mb.BackupName)
-		retentionBackupsDeleteCounter.WithLabelValues(backupName, wf.status).Inc()
-		continue
+		if i == len(candidates) {
+			logrus.Warnf("Backup %s is over quota but no more backups can be deleted. size=%.1fMB count=%d", bs.Name, size, count)
+			return
+		}
+		c := candidates[i]
+		elected[c.ID] = fmt.Sprintf("over quota. size=%.1fMB maxTotalSizeMB=%.1f count=%d maxBackupCount=%d", size, bs.MaxTotalSizeMB, count, bs.MaxBackupCount)
+		size -= c.SizeMB
+		count--
+		candidates = append(candidates[:i], candidates[i+1:]...)
 	}
 }
 
-func appendElectedForTag(backupName string, tag string, retentionCount string, appendTo []MaterializedBackup) []MaterializedBackup {
-	ret, err0 := strconv.Atoi(retentionCount)
-	if err0 != nil {
-		logrus.Errorf("%s: Invalid retention parameter: err=%s", tag, err0)
-		return appendTo
+//chainParents returns a function that finds, among backups, the backup an incremental backup depends on
+func chainParents(backups []MaterializedBackup) func(MaterializedBackup) (MaterializedBackup, bool) {
+	byDataID := make(map[string]MaterializedBackup)
+	for _, mb := range backups {
+		byDataID[mb.DataID] = mb
+	}
+	return func(mb MaterializedBackup) (MaterializedBackup, bool) {
+		if mb.ParentDataID == nil || *mb.ParentDataID == mb.DataID {
+			return MaterializedBackup{}, false
+		}
+		p, ok := byDataID[*mb.ParentDataID]
+		return p, ok
 	}
-	mbackups, err := getExclusiveTagAvailableMaterializedBackups(backupName, tag, ret, 20)
+}
+
+//RetentionPreviewItem a materialized backup with the tags and retention verdict calculated for a backup spec
+type RetentionPreviewItem struct {
+	MaterializedBackup
+	//Verdict 'keep' or 'delete' for COMPLETED backups. Other backups are 'ignored'
+	Verdict string `json:"verdict"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+//previewRetention calculates tags and elects backups for deletion the same way the retention task does, without changing anything
+func previewRetention(bs BackupSpec) ([]RetentionPreviewItem, error) {
+	all, err := store.GetMaterializedBackups(bs.Name, 0, "", "", false)
 	if err != nil {
-		logrus.Errorf("%s: Error querying backups for deletion. err=%s", tag, err)
-		return appendTo
+		return nil, fmt.Errorf("Error getting materialized backups. err=%s", err)
+	}
+
+	lastBackupID := ""
+	for _, mb := range all {
+		if mb.Status == "COMPLETED" {
+			lastBackupID = mb.ID
+			break
+		}
+	}
+	calculateTags(all, bs, lastBackupID)
+	elected := electForDeletion(all, bs)
+
+	items := make([]RetentionPreviewItem, 0)
+	for _, mb := range all {
+		it := RetentionPreviewItem{MaterializedBackup: mb, Verdict: "keep"}
+		if mb.Status != "COMPLETED" {
+			it.Verdict = "ignored"
+			it.Reason = fmt.Sprintf("status is %s", mb.Status)
+		} else if reason, ok := elected[mb.ID]; ok {
+			it.Verdict = "delete"
+			it.Reason = reason
+		} else if isHeld(mb, time.Now()) {
+			it.Reason = fmt.Sprintf("on hold by %s", *mb.HoldBy)
+		}
+		items = append(items, it)
 	}
-	logrus.Debugf("%s: %d backups elected for deletion (limited to 20)", tag, len(mbackups))
-	return append(appendTo, mbackups...)
+	return items, nil
 }
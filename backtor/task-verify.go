@@ -0,0 +1,166 @@
+package backtor
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+//METRICS
+var verifyTriggerCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "backtor_verify_trigger_total",
+	Help: "Total backup verifications triggered",
+}, []string{
+	"backup",
+	"status",
+})
+
+var verifyResultCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "backtor_verify_total",
+	Help: "Total backup verifications finished",
+}, []string{
+	"backup",
+	"status",
+})
+
+//InitTaskVerify registers verification metrics
+func InitTaskVerify() {
+	prometheus.MustRegister(verifyTriggerCounter)
+	prometheus.MustRegister(verifyResultCounter)
+}
+
+//triggerVerify launches verify workflows for a random sample of COMPLETED materialized backups of a spec.
+//Backups that are already being verified are skipped
+func triggerVerify(backupName string) ([]string, error) {
+	logrus.Info("")
+	logrus.Infof(">>>> TRIGGER VERIFY %s", backupName)
+
+	bs, err := store.GetBackupSpec(backupName)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't load backup spec. err=%s", err)
+	}
+	sampleSize := bs.VerifySampleSize
+	if sampleSize < 1 {
+		sampleSize = 1
+	}
+
+	mbs, err := store.GetMaterializedBackups(backupName, 0, "", "COMPLETED", true)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't load materialized backups. err=%s", err)
+	}
+
+	wids := make([]string, 0)
+	for _, mb := range mbs {
+		if len(wids) >= sampleSize {
+			break
+		}
+		if mb.RunningVerifyWorkflowID != nil {
+			continue
+		}
+
+		mi := map[string]interface{}{
+			"backupName":     backupName,
+			"dataId":         mb.DataID,
+			"materializedId": mb.ID,
+		}
+		if mb.Checksum != nil {
+			mi["checksum"] = *mb.Checksum
+		}
+		if bs.TimeoutSeconds != nil {
+			mi["timeoutSeconds"] = *bs.TimeoutSeconds
+		}
+		if bs.WorkerConfig != nil {
+			mi["workerConfig"] = *bs.WorkerConfig
+		}
+		wid, err := executor.LaunchWorkflow(workflowVerify, mi)
+		if err != nil {
+			verifyTriggerCounter.WithLabelValues(backupName, "error").Inc()
+			return wids, fmt.Errorf("Couldn't launch verify workflow for dataId %s. err=%s", mb.DataID, err)
+		}
+		logrus.Infof("Workflow %s launched for verifying dataId %s. workflowId=%s", workflowVerify, mb.DataID, wid)
+
+		//keep the checksum of the last verification until this one finishes
+		now := time.Now()
+		err = store.SetVerifyMaterializedBackup(mb.ID, "RUNNING", &wid, mb.VerifyChecksum, &now)
+		if err != nil {
+			verifyTriggerCounter.WithLabelValues(backupName, "error").Inc()
+			return wids, fmt.Errorf("Couldn't update verify status of materialized backup %s. err=%s", mb.ID, err)
+		}
+		verifyTriggerCounter.WithLabelValues(backupName, "success").Inc()
+		wids = append(wids, wid)
+	}
+
+	if len(wids) == 0 {
+		logrus.Infof("No COMPLETED materialized backups available for verification. backup=%s", backupName)
+	}
+	return wids, nil
+}
+
+//checkVerifyWorkflows checks all running verifications of a backup spec
+func checkVerifyWorkflows(backupName string) {
+	logrus.Debugf("checkVerifyWorkflows %s", backupName)
+
+	mbs, err := store.GetVerifyingMaterializedBackups(backupName)
+	if err != nil {
+		logrus.Warnf("Couldn't load materialized backups being verified for backup %s. err=%s", backupName, err)
+		overallBackupWarnCounter.WithLabelValues(backupName, "error").Inc()
+		return
+	}
+	for _, mb := range mbs {
+		checkVerifyWorkflow(mb)
+	}
+}
+
+//checkVerifyWorkflow stores the outcome of a verify workflow on its materialized backup.
+//Verification passes if the workflow completes and the checksum it reports matches the one reported by the create workflow (if any).
+//Checksums of previous verifications are never used as the reference, as they may have been taken from an already damaged backup
+func checkVerifyWorkflow(mb MaterializedBackup) error {
+	backupName := mb.BackupName
+	if mb.RunningVerifyWorkflowID == nil {
+		return fmt.Errorf("Materialized backup %s has verify status RUNNING but no verify workflow set", mb.ID)
+	}
+
+	wf, err := getWorkflowInstance(*mb.RunningVerifyWorkflowID)
+	if err != nil && wf.Status != "NOT_FOUND" {
+		overallBackupWarnCounter.WithLabelValues(backupName, "error").Inc()
+		return fmt.Errorf("Couldn't get workflow instance %s. err=%s", *mb.RunningVerifyWorkflowID, err)
+	}
+	if wf.Status == "RUNNING" {
+		logrus.Debugf("Workflow %s for verifying dataId %s is still running", wf.WorkflowID, mb.DataID)
+		return nil
+	}
+
+	result := "passed"
+	checksum := wf.Checksum
+	if checksum == nil {
+		checksum = mb.VerifyChecksum
+	}
+	if wf.Status != "COMPLETED" {
+		logrus.Warnf("Verify workflow %s finished with status!=COMPLETED. backupName=%s. dataId=%s. status=%s", *mb.RunningVerifyWorkflowID, backupName, mb.DataID, wf.Status)
+		result = "failed"
+	} else if mb.Checksum != nil && wf.Checksum == nil {
+		logrus.Warnf("Verify workflow %s reported no checksum, but the backup was created with checksum %s. backupName=%s. dataId=%s", wf.WorkflowID, *mb.Checksum, backupName, mb.DataID)
+		result = "failed"
+	} else if mb.Checksum != nil && *mb.Checksum != *wf.Checksum {
+		logrus.Warnf("Verify workflow %s reported checksum %s, but the backup was created with checksum %s. backupName=%s. dataId=%s", wf.WorkflowID, *wf.Checksum, *mb.Checksum, backupName, mb.DataID)
+		result = "failed"
+	}
+	if result == "failed" {
+		overallBackupWarnCounter.WithLabelValues(backupName, "warning").Inc()
+	}
+	logrus.Infof("Verification of dataId %s %s. backup=%s", mb.DataID, result, backupName)
+
+	endTime := wf.EndTime
+	if endTime.IsZero() {
+		endTime = time.Now()
+	}
+	err = store.SetVerifyMaterializedBackup(mb.ID, result, nil, checksum, &endTime)
+	if err != nil {
+		overallBackupWarnCounter.WithLabelValues(backupName, "error").Inc()
+		return fmt.Errorf("Couldn't set verify status. err=%s", err)
+	}
+	verifyResultCounter.WithLabelValues(backupName, result).Inc()
+	return nil
+}
@@ -0,0 +1,123 @@
+package backtor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/flaviostutz/backtor/backtor/backtortest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func verified(checksum string) backtortest.Outcome {
+	return backtortest.Outcome{Status: "COMPLETED", Output: map[string]interface{}{"checksum": checksum}}
+}
+
+//createdWithChecksum outcome of a create workflow that reports the checksum of the backup contents
+func createdWithChecksum(dataID string, checksum string) backtortest.Outcome {
+	o := backtortest.Completed(dataID, 5)
+	o.Output["checksum"] = checksum
+	return o
+}
+
+func TestVerifyCycle(t *testing.T) {
+	conductor, teardown := setupTest(t)
+	defer teardown()
+
+	createTestBackupSpec(t, BackupSpec{Name: "test", VerifySampleSize: 2})
+	conductor.Script("create_backup", createdWithChecksum("data1", "abc"), createdWithChecksum("data2", "abc"), createdWithChecksum("data3", "abc"))
+	conductor.Now = func() time.Time { return time.Date(2020, 1, 6, 23, 0, 0, 0, time.UTC) }
+	runBackupCycle(t, "test")
+	conductor.Now = func() time.Time { return time.Date(2020, 1, 7, 23, 0, 0, 0, time.UTC) }
+	runBackupCycle(t, "test")
+	conductor.Now = func() time.Time { return time.Date(2020, 1, 8, 23, 0, 0, 0, time.UTC) }
+	runBackupCycle(t, "test")
+
+	wids, err := triggerVerify("test")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(wids))
+
+	//backups being verified are not sampled again
+	wids2, err := triggerVerify("test")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(wids2))
+	wids = append(wids, wids2...)
+
+	for _, wid := range wids {
+		wf, ok := conductor.Workflow(wid)
+		require.True(t, ok)
+		assert.Equal(t, "verify_backup", wf.WorkflowType)
+		assert.NotEmpty(t, wf.Input["dataId"])
+		assert.Equal(t, "abc", wf.Input["checksum"])
+		require.Nil(t, conductor.Finish(wid, verified("abc")))
+	}
+	checkVerifyWorkflows("test")
+
+	mbs, err := store.GetMaterializedBackups("test", 0, "", "COMPLETED", false)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(mbs))
+	for _, mb := range mbs {
+		require.NotNil(t, mb.VerifyStatus)
+		assert.Equal(t, "passed", *mb.VerifyStatus)
+		assert.Equal(t, "abc", *mb.VerifyChecksum)
+		assert.NotNil(t, mb.VerifyTime)
+		assert.Nil(t, mb.RunningVerifyWorkflowID)
+	}
+
+	//same backup reporting a different checksum means its contents changed
+	wids, err = triggerVerify("test")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(wids))
+	require.Nil(t, conductor.Finish(wids[0], verified("xyz")))
+	require.Nil(t, conductor.Finish(wids[1], backtortest.Failed()))
+	checkVerifyWorkflows("test")
+
+	statuses := map[string]int{}
+	mbs, err = store.GetMaterializedBackups("test", 0, "", "COMPLETED", false)
+	require.Nil(t, err)
+	for _, mb := range mbs {
+		statuses[*mb.VerifyStatus]++
+		assert.Equal(t, "abc", *mb.Checksum)
+	}
+	assert.Equal(t, map[string]int{"passed": 1, "failed": 2}, statuses)
+}
+
+func TestVerifyAgainstCreateChecksum(t *testing.T) {
+	conductor, teardown := setupTest(t)
+	defer teardown()
+
+	createTestBackupSpec(t, BackupSpec{Name: "test", VerifySampleSize: 1})
+	conductor.Script("create_backup", createdWithChecksum("data1", "abc"))
+	runBackupCycle(t, "test")
+
+	//the first verification is checked against the checksum reported when the backup was created
+	wids, err := triggerVerify("test")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(wids))
+	require.Nil(t, conductor.Finish(wids[0], verified("xyz")))
+	checkVerifyWorkflows("test")
+
+	mbs, err := store.GetMaterializedBackups("test", 0, "", "COMPLETED", false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(mbs))
+	assert.Equal(t, "failed", *mbs[0].VerifyStatus)
+	assert.Equal(t, "xyz", *mbs[0].VerifyChecksum)
+	assert.Equal(t, "abc", *mbs[0].Checksum)
+
+	//a checksum reported by a failed verification doesn't become the reference
+	wids, err = triggerVerify("test")
+	require.Nil(t, err)
+	require.Nil(t, conductor.Finish(wids[0], verified("xyz")))
+	checkVerifyWorkflows("test")
+	mb, err := store.GetMaterializedBackup(mbs[0].ID)
+	require.Nil(t, err)
+	assert.Equal(t, "failed", *mb.VerifyStatus)
+
+	wids, err = triggerVerify("test")
+	require.Nil(t, err)
+	require.Nil(t, conductor.Finish(wids[0], verified("abc")))
+	checkVerifyWorkflows("test")
+	mb, err = store.GetMaterializedBackup(mbs[0].ID)
+	require.Nil(t, err)
+	assert.Equal(t, "passed", *mb.VerifyStatus)
+}
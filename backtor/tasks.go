@@ -1,8 +1,8 @@
 package backtor
 
 import (
-	"database/sql"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/robfig/cron"
@@ -11,33 +11,102 @@ import (
 
 var (
 	opt                    Options
-	db                     *sql.DB
+	store                  Store
+	executor               Executor
 	scheduledRoutineHashes = make(map[string]*cron.Cron)
+	timersMutex            sync.Mutex
 )
 
 //Options command line options used to run backtor
 type Options struct {
 	ConductorAPIURL string
 	DataDir         string
+	//DBURL database connection url. SQLite at DataDir is used if empty
+	DBURL string
+	//RestoreWorkflowName workflow launched for restoring a materialized backup
+	RestoreWorkflowName string
+	//Executor used to run backup workflows. Defaults to Conductor at ConductorAPIURL
+	Executor Executor
+	//NodeID identifies this replica in leader election. Defaults to hostname-pid
+	NodeID string
+	//AdvertiseURL base url other replicas use to proxy mutating API calls to this replica when it is the leader
+	AdvertiseURL string
+	//LeaseTimeout time without renewal after which another replica takes over leadership
+	LeaseTimeout time.Duration
+	//ReconcileInterval time between reconciler runs
+	ReconcileInterval time.Duration
+	//ReconcileConcurrency max workflows checked in parallel by the reconciler
+	ReconcileConcurrency int
+	//ReconcileBatchSize max workflows whose status is looked up in a single executor request
+	ReconcileBatchSize int
+	//VerifyWorkflowName workflow launched for verifying a materialized backup
+	VerifyWorkflowName string
+	//SpecsDir directory with YAML/JSON backup spec files. Specs are loaded from it at startup and when files change
+	SpecsDir string
+	//CallbackSecret HMAC secret of workflow events posted to /events/conductor. Callbacks are disabled if empty
+	CallbackSecret string
+	//NotifyWebhookURL receives notifications of all backup specs
+	NotifyWebhookURL string
+	//NotifyWebhookTemplate text/template of the global webhook body. Defaults to the notification as JSON
+	NotifyWebhookTemplate string
+	//NotifySMTPAddr host:port of the SMTP server used for email notifications
+	NotifySMTPAddr     string
+	NotifySMTPUser     string
+	NotifySMTPPassword string
+	NotifyEmailFrom    string
+	//NotifyEmailTo receive email notifications of all backup specs
+	NotifyEmailTo []string
+	//NotifyThrottle min time between notifications of the same event for the same backup spec
+	NotifyThrottle time.Duration
 }
 
 func InitAll(opt0 Options) error {
 	opt = opt0
+	if opt.VerifyWorkflowName != "" {
+		workflowVerify = opt.VerifyWorkflowName
+	}
 
 	InitConductor()
-	db0, err := InitDB()
+	InitMetrics()
+	executor = opt.Executor
+	if executor == nil {
+		executor = NewConductorExecutor(opt.ConductorAPIURL)
+	}
+	store0, err := InitStore()
 	if err != nil {
 		return err
 	}
-	db = db0
+	store = store0
+
+	_, err = parseNotifyTemplate(opt.NotifyWebhookTemplate)
+	if err != nil {
+		return fmt.Errorf("Invalid notify webhook template. err=%s", err)
+	}
+
+	if opt.SpecsDir != "" {
+		err := specsDirExists(opt.SpecsDir)
+		if err != nil {
+			return fmt.Errorf("Invalid specs dir. err=%s", err)
+		}
+	}
 
 	InitTaskBackup()
 	InitTaskRetention()
+	InitTaskRestore()
+	InitTaskVerify()
+	InitTaskReplicate()
+	InitTaskImport()
+	InitTaskCatchup()
+	InitNotifier()
+	InitLeaderElection()
+	InitReconciler()
 
-	err1 := prepareTimers()
-	if err1 != nil {
-		return err1
-	}
+	//timers, reconciler and purge routine only run on the replica that holds the leader lease
+	launchLeaderElection()
+	launchReconciler()
+	launchSpecsDirWatcher()
+	launchMissedBackupCheck()
+	launchCatchupRoutine()
 
 	h := NewHTTPServer()
 	err2 := h.Start()
@@ -48,19 +117,28 @@ func InitAll(opt0 Options) error {
 }
 
 func prepareTimers() error {
+	timersMutex.Lock()
+	defer timersMutex.Unlock()
+
+	if !isLeader() {
+		logrus.Debugf("Not the leader. Skipping timers refresh")
+		stopTimersLocked()
+		return nil
+	}
+
 	logrus.Debugf("Refreshing timers according to active schedules")
 
 	//activate go routines for backup spec that weren't activated yet
 	a := 1
-	enabledBackupSpecs, err := listBackupSpecs(&a)
+	enabledBackupSpecs, err := store.ListBackupSpecs(&a)
 	if err != nil {
 		return err
 	}
-	logrus.Debugf("Enabled backup specs: %s", enabledBackupSpecs)
-	logrus.Debugf("Current routine hashes: %s", scheduledRoutineHashes)
+	logrus.Debugf("Enabled backup specs: %v", enabledBackupSpecs)
+	logrus.Debugf("Current routine hashes: %v", scheduledRoutineHashes)
 	for _, bs := range enabledBackupSpecs {
 		isScheduled := false
-		activeRoutineHash := fmt.Sprintf("%s|%s)", bs.Name, *bs.BackupCronString)
+		activeRoutineHash := routineHash(bs)
 		for hashRoutine := range scheduledRoutineHashes {
 			if activeRoutineHash == hashRoutine {
 				isScheduled = true
@@ -76,18 +154,18 @@ func prepareTimers() error {
 	}
 
 	//remove go routines that are not currently active
-	logrus.Debugf("Current routine hashes after launches: %s", scheduledRoutineHashes)
+	logrus.Debugf("Current routine hashes after launches: %v", scheduledRoutineHashes)
 	for hashRoutine, cronJob := range scheduledRoutineHashes {
 		isActive := false
 		for _, bs := range enabledBackupSpecs {
-			activeRoutineHash := fmt.Sprintf("%s|%s)", bs.Name, *bs.BackupCronString)
+			activeRoutineHash := routineHash(bs)
 			if hashRoutine == activeRoutineHash {
 				isActive = true
 				//break
 			}
 		}
 		if !isActive {
-			logrus.Infof("Stopping timer", hashRoutine)
+			logrus.Infof("Stopping timer %s", hashRoutine)
 			cronJob.Stop()
 			delete(scheduledRoutineHashes, hashRoutine)
 		}
@@ -96,65 +174,141 @@ func prepareTimers() error {
 	return nil
 }
 
-func launchBackupRoutine(backupName string) error {
-	bs1, err := getBackupSpec(backupName)
-	if err != nil {
-		return fmt.Errorf("Couldn't load backup spec %s. err=%s", backupName, err)
+//routineHash identifies the timers of a backup spec. Timers are recreated when it changes
+func routineHash(bs BackupSpec) string {
+	verifyCron := ""
+	if bs.VerifyCronString != nil {
+		verifyCron = *bs.VerifyCronString
+	}
+	incrementalCron := ""
+	if bs.IncrementalCronString != nil {
+		incrementalCron = *bs.IncrementalCronString
 	}
+	return fmt.Sprintf("%s|%s|%s|%s|%s)", bs.Name, *bs.BackupCronString, verifyCron, incrementalCron, bs.Timezone)
+}
 
-	c := cron.New()
-	logrus.Infof("Creating timer for backup %s. cron=%s", backupName, *bs1.BackupCronString)
-	c.AddFunc(*bs1.BackupCronString, func() {
-		logrus.Debugf("Timer triggered for backup %s", backupName)
+//stopTimers stops all backup spec timers
+func stopTimers() {
+	timersMutex.Lock()
+	defer timersMutex.Unlock()
+	stopTimersLocked()
+}
 
-		checkBackupWorkflow(backupName)
-		checkWorkflowBackupRemove(backupName)
+func stopTimersLocked() {
+	for hashRoutine, cronJob := range scheduledRoutineHashes {
+		logrus.Infof("Stopping timer %s", hashRoutine)
+		cronJob.Stop()
+		delete(scheduledRoutineHashes, hashRoutine)
+	}
+}
 
-		bs, err := getBackupSpec(backupName)
-		if err != nil {
-			logrus.Errorf("Couldn't load backup spec %s. err=%s", backupName, err)
-			return
-		}
+//runBackupTimer launches a backup of backupType ("" for the spec's main schedule) followed by retention, as scheduled by the timers of a backup spec
+func runBackupTimer(backupName string, backupType string) {
+	logrus.Debugf("Timer triggered for backup %s", backupName)
+	if !isLeader() {
+		logrus.Debugf("Not the leader. Skipping backup %s", backupName)
+		return
+	}
 
-		if bs.Enabled == 0 {
-			logrus.Warnf("Backup %s is not enabled but its go routine is running", backupName)
-			return
-		}
+	//make sure a finished create workflow is recorded before deciding whether a new one can be launched.
+	//Delete and restore workflows are tracked by the reconciler
+	checkBackupWorkflow(backupName)
 
-		isBefore := false
-		if bs.ToDate == nil || time.Now().Before(*bs.ToDate) {
-			isBefore = true
-		}
-		isAfter := false
-		if bs.FromDate == nil || time.Now().After(*bs.FromDate) {
-			isAfter = true
-		}
+	bs, err := store.GetBackupSpec(backupName)
+	if err != nil {
+		logrus.Errorf("Couldn't load backup spec %s. err=%s", backupName, err)
+		return
+	}
 
-		if isBefore && isAfter {
+	if bs.Enabled == 0 {
+		logrus.Warnf("Backup %s is not enabled but its go routine is running", backupName)
+		return
+	}
+	if backupType == "" {
+		recordScheduleFire(backupName, time.Now())
+	}
 
-			wid, err := triggerNewBackup(backupName)
-			if err != nil {
-				logrus.Warnf("Error launching backup workflow for backup %s. err=%s", backupName, err)
-				backupTriggerCounter.WithLabelValues(backupName, "error").Inc()
-				overallBackupWarnCounter.WithLabelValues(backupName, "warning").Inc()
-			} else {
-				logrus.Infof("Backup launched. workflowId=%s", wid)
-				backupTriggerCounter.WithLabelValues(backupName, "success").Inc()
-			}
+	isBefore := false
+	if bs.ToDate == nil || time.Now().Before(*bs.ToDate) {
+		isBefore = true
+	}
+	isAfter := false
+	if bs.FromDate == nil || time.Now().After(*bs.FromDate) {
+		isAfter = true
+	}
 
-			RunRetentionTask(backupName)
+	if isBefore && isAfter {
 
+		wid, err := triggerNewBackupOfType(backupName, backupType)
+		if err != nil {
+			logrus.Warnf("Error launching backup workflow for backup %s. err=%s", backupName, err)
+			backupTriggerCounter.WithLabelValues(backupName, "error").Inc()
+			overallBackupWarnCounter.WithLabelValues(backupName, "warning").Inc()
 		} else {
-			logrus.Debugf("Backup %s is enabled, but not within activation date", backupName)
+			logrus.Infof("Backup launched. workflowId=%s", wid)
+			backupTriggerCounter.WithLabelValues(backupName, "success").Inc()
 		}
+
+		RunRetentionTask(backupName)
+
+	} else {
+		logrus.Debugf("Backup %s is enabled, but not within activation date", backupName)
+	}
+}
+
+func launchBackupRoutine(backupName string) error {
+	bs1, err := store.GetBackupSpec(backupName)
+	if err != nil {
+		return fmt.Errorf("Couldn't load backup spec %s. err=%s", backupName, err)
+	}
+
+	err = detectMissedSchedules(bs1, time.Now())
+	if err != nil {
+		logrus.Warnf("Couldn't check missed schedules of backup %s. err=%s", backupName, err)
+	}
+
+	c := cron.NewWithLocation(scheduleLocation(bs1))
+	logrus.Infof("Creating timer for backup %s. cron=%s timezone=%s", backupName, *bs1.BackupCronString, c.Location())
+	err = c.AddFunc(*bs1.BackupCronString, func() {
+		runBackupTimer(backupName, "")
 	})
+	if err != nil {
+		logrus.Errorf("Invalid backup cron string of %s. Backups won't be scheduled. err=%s", backupName, err)
+		overallBackupWarnCounter.WithLabelValues(backupName, "error").Inc()
+	}
+	if bs1.IncrementalCronString != nil && *bs1.IncrementalCronString != "" {
+		logrus.Infof("Creating incremental backup timer for backup %s. cron=%s", backupName, *bs1.IncrementalCronString)
+		err = c.AddFunc(*bs1.IncrementalCronString, func() {
+			runBackupTimer(backupName, backupTypeIncremental)
+		})
+		if err != nil {
+			logrus.Errorf("Invalid incremental cron string of %s. Incremental backups won't be scheduled. err=%s", backupName, err)
+			overallBackupWarnCounter.WithLabelValues(backupName, "error").Inc()
+		}
+	}
 	c.AddFunc("@every 4h", func() {
-		checkBackupWorkflow(backupName)
-		checkWorkflowBackupRemove(backupName)
+		if !isLeader() {
+			return
+		}
 		RunRetentionTask(backupName)
 	})
-	routineHash := fmt.Sprintf("%s|%s)", backupName, *bs1.BackupCronString)
-	scheduledRoutineHashes[routineHash] = c
-	go c.Start()
+	if bs1.VerifyCronString != nil && *bs1.VerifyCronString != "" {
+		logrus.Infof("Creating verify timer for backup %s. cron=%s", backupName, *bs1.VerifyCronString)
+		err = c.AddFunc(*bs1.VerifyCronString, func() {
+			if !isLeader() {
+				return
+			}
+			_, err := triggerVerify(backupName)
+			if err != nil {
+				logrus.Warnf("Error launching verify workflows for backup %s. err=%s", backupName, err)
+			}
+		})
+		if err != nil {
+			logrus.Errorf("Invalid verify cron string of %s. Verifications won't be scheduled. err=%s", backupName, err)
+			overallBackupWarnCounter.WithLabelValues(backupName, "error").Inc()
+		}
+	}
+	scheduledRoutineHashes[routineHash(bs1)] = c
+	c.Start()
 	return nil
 }
@@ -0,0 +1,403 @@
+package backtor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/flaviostutz/backtor/backtor/backtortest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+//setupTest points backtor to a fresh database and to a fake Conductor. Call the returned func when done
+func setupTest(t *testing.T) (*backtortest.Conductor, func()) {
+	conductor := backtortest.NewConductor()
+	dir, err := ioutil.TempDir("", "backtor-test")
+	require.Nil(t, err)
+
+	opt = Options{ConductorAPIURL: conductor.URL(), DataDir: dir, RestoreWorkflowName: "restore_backup"}
+	executor = NewConductorExecutor(conductor.URL())
+	store0, err := InitStore()
+	require.Nil(t, err)
+	store = store0
+	notifyLast = make(map[string]time.Time)
+	notifySuppressed = make(map[string]int)
+
+	return conductor, func() {
+		stepDown()
+		store.Close()
+		conductor.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func createTestBackupSpec(t *testing.T, bs BackupSpec) BackupSpec {
+	bs.Enabled = 1
+	setBackupSpecDefaultValues(&bs)
+	bs.LastUpdate = time.Now()
+	require.Nil(t, store.CreateBackupSpec(bs))
+	return bs
+}
+
+//runBackupCycle runs the same steps a backup spec timer does
+func runBackupCycle(t *testing.T, backupName string) {
+	checkBackupWorkflow(backupName)
+	checkWorkflowBackupRemove(backupName)
+	_, err := triggerNewBackup(backupName)
+	require.Nil(t, err)
+	checkBackupWorkflow(backupName)
+	RunRetentionTask(backupName)
+	checkWorkflowBackupRemove(backupName)
+}
+
+func materializedStatuses(t *testing.T, backupName string) map[string]string {
+	mbs, err := store.GetMaterializedBackups(backupName, 0, "", "", false)
+	require.Nil(t, err)
+	st := make(map[string]string)
+	for _, mb := range mbs {
+		st[mb.DataID] = mb.Status
+	}
+	return st
+}
+
+func TestBackupRetentionCycle(t *testing.T) {
+	conductor, teardown := setupTest(t)
+	defer teardown()
+
+	createTestBackupSpec(t, BackupSpec{Name: "test", RetentionDaily: "2@L", RetentionWeekly: "1@L", RetentionMonthly: "1@L"})
+
+	//Mon 2020-01-06 to Fri 2020-01-10, one backup per day at 23h, with a failure and a timeout in between
+	conductor.Script("create_backup",
+		backtortest.Completed("day6", 10),
+		backtortest.Failed(),
+		backtortest.Completed("day7", 10),
+		backtortest.Completed("day8", 10),
+		backtortest.TimedOut(),
+		backtortest.Completed("day9", 10),
+		backtortest.Completed("day10", 10))
+	conductor.Script("remove_backup", backtortest.Completed("", 0), backtortest.Completed("", 0))
+
+	day := 6
+	for i := 0; i < 7; i++ {
+		now := time.Date(2020, 1, day, 23, 0, 0, 0, time.UTC)
+		conductor.Now = func() time.Time { return now }
+		runBackupCycle(t, "test")
+		wfs := conductor.Workflows("create_backup")
+		if wfs[len(wfs)-1].Status == "COMPLETED" {
+			day++
+		}
+	}
+
+	st := materializedStatuses(t, "test")
+	assert.Equal(t, map[string]string{
+		"day6":  "deleted",
+		"day7":  "deleted",
+		"day8":  "COMPLETED",
+		"day9":  "COMPLETED",
+		"day10": "COMPLETED",
+	}, st)
+
+	removes := conductor.Workflows("remove_backup")
+	require.Equal(t, 2, len(removes))
+	assert.Equal(t, "day6", removes[0].Input["dataId"])
+	assert.Equal(t, "day7", removes[1].Input["dataId"])
+
+	mb, err := store.GetMaterializedBackups("test", 1, "", "COMPLETED", false)
+	require.Nil(t, err)
+	assert.Equal(t, "day10", mb[0].DataID)
+	assert.Equal(t, []string{"reference", "minutely", "hourly", "daily", "weekly", "monthly", "yearly"}, getTags(mb[0]))
+}
+
+func TestTriggerBackupSkipsWhileRunning(t *testing.T) {
+	conductor, teardown := setupTest(t)
+	defer teardown()
+
+	createTestBackupSpec(t, BackupSpec{Name: "test"})
+
+	wid, err := triggerNewBackup("test")
+	require.Nil(t, err)
+
+	_, err = triggerNewBackup("test")
+	assert.NotNil(t, err, "a second backup must not be launched while another is running")
+
+	checkBackupWorkflow("test")
+	bs, err := store.GetBackupSpec("test")
+	require.Nil(t, err)
+	require.NotNil(t, bs.RunningCreateWorkflowID)
+	assert.Equal(t, wid, *bs.RunningCreateWorkflowID)
+
+	require.Nil(t, conductor.Finish(wid, backtortest.Completed("data1", 1.5)))
+	checkBackupWorkflow("test")
+
+	bs, err = store.GetBackupSpec("test")
+	require.Nil(t, err)
+	assert.Nil(t, bs.RunningCreateWorkflowID)
+	mb, err := store.GetMaterializedBackup(wid)
+	require.Nil(t, err)
+	assert.Equal(t, "data1", mb.DataID)
+	assert.Equal(t, 1.5, mb.SizeMB)
+	assert.Equal(t, "COMPLETED", mb.Status)
+}
+
+func TestIncrementalChainRetention(t *testing.T) {
+	conductor, teardown := setupTest(t)
+	defer teardown()
+
+	incrementalCron := "0 0 12 * * *"
+	createTestBackupSpec(t, BackupSpec{Name: "test", IncrementalCronString: &incrementalCron, RetentionDaily: "2@L", RetentionWeekly: "1@L", RetentionMonthly: "1@L", RetentionYearly: "1@L"})
+	conductor.Script("create_backup",
+		backtortest.Full("day6", 10),
+		backtortest.Incremental("day7", "day6", 1),
+		backtortest.Incremental("day8", "day7", 1),
+		backtortest.Full("day9", 10),
+		backtortest.Incremental("day10", "day9", 1),
+		backtortest.Incremental("day11", "day10", 1))
+	conductor.Script("remove_backup", backtortest.Completed("", 0), backtortest.Completed("", 0), backtortest.Completed("", 0))
+
+	types := []string{"", backupTypeIncremental, backupTypeIncremental, "", backupTypeIncremental, backupTypeIncremental}
+	for i, bt := range types {
+		now := time.Date(2020, 1, 6+i, 23, 0, 0, 0, time.UTC)
+		conductor.Now = func() time.Time { return now }
+		wid, err := triggerNewBackupOfType("test", bt)
+		require.Nil(t, err)
+		checkBackupWorkflow("test")
+		RunRetentionTask("test")
+		checkWorkflowBackupRemove("test")
+
+		wf, ok := conductor.Workflow(wid)
+		require.True(t, ok)
+		if bt == "" {
+			assert.Equal(t, "full", wf.Input["backupType"])
+			assert.Nil(t, wf.Input["parentDataId"])
+		} else {
+			assert.Equal(t, "incremental", wf.Input["backupType"])
+			assert.Equal(t, fmt.Sprintf("day%d", 5+i), wf.Input["parentDataId"])
+		}
+
+		if i == 4 {
+			//day6 and day7 are beyond daily retention, but retained day8 depends on them
+			assert.Equal(t, map[string]string{"day6": "COMPLETED", "day7": "COMPLETED", "day8": "COMPLETED", "day9": "COMPLETED", "day10": "COMPLETED"}, materializedStatuses(t, "test"))
+		}
+	}
+
+	//the first chain is not needed anymore and is deleted as a whole
+	assert.Equal(t, map[string]string{
+		"day6":  "deleted",
+		"day7":  "deleted",
+		"day8":  "deleted",
+		"day9":  "COMPLETED",
+		"day10": "COMPLETED",
+		"day11": "COMPLETED",
+	}, materializedStatuses(t, "test"))
+
+	mb, err := store.GetMaterializedBackups("test", 1, "", "COMPLETED", false)
+	require.Nil(t, err)
+	assert.Equal(t, "incremental", mb[0].BackupType)
+	require.NotNil(t, mb[0].ParentDataID)
+	assert.Equal(t, "day10", *mb[0].ParentDataID)
+}
+
+func TestTimezoneTagBoundaries(t *testing.T) {
+	//22:00, 23:30 and 17:00 in Sao Paulo (UTC-3) fall on two local days but on a single UTC day
+	starts := []time.Time{
+		time.Date(2020, 1, 6, 1, 0, 0, 0, time.UTC),
+		time.Date(2020, 1, 6, 2, 30, 0, 0, time.UTC),
+		time.Date(2020, 1, 6, 20, 0, 0, 0, time.UTC),
+		time.Date(2020, 1, 7, 12, 0, 0, 0, time.UTC),
+	}
+	dailies := func(timezone string) []string {
+		bs := BackupSpec{Name: "test", Timezone: timezone, RetentionDaily: "3@L"}
+		setBackupSpecDefaultValues(&bs)
+		mbs := make([]MaterializedBackup, 0)
+		for i, s := range starts {
+			mbs = append(mbs, MaterializedBackup{ID: fmt.Sprintf("b%d", i), Status: "COMPLETED", StartTime: s, EndTime: s})
+		}
+		calculateTags(mbs, bs, "b3")
+		ids := make([]string, 0)
+		for _, mb := range mbs {
+			if hasTag(mb, "daily") {
+				ids = append(ids, mb.ID)
+			}
+		}
+		return ids
+	}
+
+	assert.Equal(t, []string{"b2", "b3"}, dailies(""))
+	assert.Equal(t, []string{"b1", "b2", "b3"}, dailies("America/Sao_Paulo"))
+
+	assert.Nil(t, checkTimezone(BackupSpec{Timezone: "Europe/Berlin"}))
+	assert.NotNil(t, checkTimezone(BackupSpec{Timezone: "Mars/Olympus"}))
+}
+
+func TestCustomRetentionPeriods(t *testing.T) {
+	bs := BackupSpec{Name: "test", RetentionMinutely: "0@L", RetentionHourly: "0@L", RetentionDaily: "0@L", RetentionWeekly: "0@L", RetentionMonthly: "0@L", RetentionYearly: "1@L",
+		Periods: []RetentionPeriod{{Name: "quarterly", Unit: "month", Every: 3, Keep: 2}}}
+	setBackupSpecDefaultValues(&bs)
+	require.Nil(t, checkRetentionPeriods(bs))
+	assert.Equal(t, []string{"minutely", "hourly", "daily", "weekly", "monthly", "quarterly", "yearly"}, periodTags(bs))
+
+	//one backup in the middle of each month, from january to july
+	mbs := make([]MaterializedBackup, 0)
+	for i := 0; i < 7; i++ {
+		s := time.Date(2020, time.Month(i+1), 15, 12, 0, 0, 0, time.UTC)
+		mbs = append(mbs, MaterializedBackup{ID: fmt.Sprintf("b%d", i), Status: "COMPLETED", StartTime: s, EndTime: s})
+	}
+	calculateTags(mbs, bs, "b6")
+	quarterly := make([]string, 0)
+	for _, mb := range mbs {
+		if hasTag(mb, "quarterly") {
+			quarterly = append(quarterly, mb.ID)
+		}
+	}
+	//newest backup of each quarter
+	assert.Equal(t, []string{"b2", "b5", "b6"}, quarterly)
+	assert.Equal(t, "quarterly", retentionTier(mbs[2], retentionTiers(bs)))
+
+	elected := electForDeletion(mbs, bs)
+	assert.Equal(t, 4, len(elected))
+	for _, id := range []string{"b2", "b5", "b6"} {
+		_, ok := elected[id]
+		assert.False(t, ok, id)
+	}
+
+	//an offset of 1 month starts quarters in february
+	bs.Periods[0].Offset = 1
+	calculateTags(mbs, bs, "b6")
+	assert.True(t, hasTag(mbs[0], "quarterly"))
+	assert.True(t, hasTag(mbs[3], "quarterly"))
+	assert.False(t, hasTag(mbs[2], "quarterly"))
+
+	assert.NotNil(t, checkRetentionPeriods(BackupSpec{Periods: []RetentionPeriod{{Name: "daily", Unit: "day"}}}))
+	assert.NotNil(t, checkRetentionPeriods(BackupSpec{Periods: []RetentionPeriod{{Name: "fortnight", Unit: "fortnight"}}}))
+	assert.NotNil(t, checkRetentionPeriods(BackupSpec{Periods: []RetentionPeriod{{Name: "biweekly", Unit: "week", Every: 2, Offset: 2}}}))
+	assert.NotNil(t, checkRetentionPeriods(BackupSpec{Periods: []RetentionPeriod{{Name: "q", Unit: "month"}, {Name: "q", Unit: "month"}}}))
+}
+
+func TestQuotaRetention(t *testing.T) {
+	conductor, teardown := setupTest(t)
+	defer teardown()
+
+	createTestBackupSpec(t, BackupSpec{Name: "test", RetentionDaily: "10@L", MaxTotalSizeMB: 25})
+	for day := 1; day <= 5; day++ {
+		conductor.Script("create_backup", backtortest.Completed(fmt.Sprintf("day%d", day), 10))
+		d := day
+		conductor.Now = func() time.Time { return time.Date(2020, 1, d, 23, 0, 0, 0, time.UTC) }
+		runBackupCycle(t, "test")
+	}
+
+	completed := make([]string, 0)
+	for dataID, status := range materializedStatuses(t, "test") {
+		if status == "COMPLETED" {
+			completed = append(completed, dataID)
+		}
+	}
+	//10MB each, so only two backups fit. The newest one is always kept
+	assert.Equal(t, 2, len(completed))
+	assert.Contains(t, completed, "day5")
+
+	//lower tiers go first, oldest first within a tier
+	bs := BackupSpec{Name: "test", RetentionDaily: "10@L", RetentionWeekly: "10@L", MaxBackupCount: 2}
+	setBackupSpecDefaultValues(&bs)
+	mbs := []MaterializedBackup{
+		{ID: "d3", Status: "COMPLETED", Tags: []string{"reference", "daily", "weekly"}, StartTime: time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC)},
+		{ID: "d2", Status: "COMPLETED", Tags: []string{"reference", "daily", "weekly"}, StartTime: time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{ID: "d1", Status: "COMPLETED", Tags: []string{"reference", "daily", "weekly"}, StartTime: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{ID: "d0", Status: "COMPLETED", Tags: []string{"reference", "daily"}, StartTime: time.Date(2019, 12, 31, 0, 0, 0, 0, time.UTC)},
+	}
+	elected := electForDeletion(mbs, bs)
+	assert.Equal(t, 2, len(elected))
+	assert.Contains(t, elected, "d0")
+	assert.Contains(t, elected, "d1")
+}
+
+func TestCheckBackupWorkflowKeepsNewerWorkflow(t *testing.T) {
+	conductor, teardown := setupTest(t)
+	defer teardown()
+
+	createTestBackupSpec(t, BackupSpec{Name: "test"})
+	conductor.Script("create_backup", backtortest.Completed("data1", 1))
+	wid, err := triggerNewBackup("test")
+	require.Nil(t, err)
+
+	//another caller recorded the workflow and launched a newer one before this late check clears it
+	newer := "newer-workflow"
+	require.Nil(t, store.UpdateBackupSpecRunningCreateWorkflowID("test", &newer))
+	cleared, err := store.ClearBackupSpecRunningCreateWorkflowID("test", wid)
+	require.Nil(t, err)
+	assert.False(t, cleared)
+	bs, err := store.GetBackupSpec("test")
+	require.Nil(t, err)
+	require.NotNil(t, bs.RunningCreateWorkflowID)
+	assert.Equal(t, newer, *bs.RunningCreateWorkflowID)
+
+	require.Nil(t, store.UpdateBackupSpecRunningCreateWorkflowID("test", &wid))
+	require.Nil(t, checkBackupWorkflow("test"))
+	require.Nil(t, checkBackupWorkflow("test"))
+	assert.Equal(t, map[string]string{"data1": "COMPLETED"}, materializedStatuses(t, "test"))
+}
+
+func TestCheckBackupWorkflowRetriesFailedRecord(t *testing.T) {
+	conductor, teardown := setupTest(t)
+	defer teardown()
+
+	createTestBackupSpec(t, BackupSpec{Name: "test"})
+	conductor.Script("create_backup", backtortest.Completed("data1", 1))
+	wid, err := triggerNewBackup("test")
+	require.Nil(t, err)
+
+	//the workflow keeps being tracked while its backup can't be recorded
+	db := store.(*sqlStore).db
+	_, err = db.Exec("CREATE TRIGGER fail_insert BEFORE INSERT ON materialized_backup BEGIN SELECT RAISE(FAIL, 'insert failed'); END")
+	require.Nil(t, err)
+	assert.NotNil(t, checkBackupWorkflow("test"))
+	bs, err := store.GetBackupSpec("test")
+	require.Nil(t, err)
+	require.NotNil(t, bs.RunningCreateWorkflowID)
+	assert.Equal(t, wid, *bs.RunningCreateWorkflowID)
+
+	_, err = db.Exec("DROP TRIGGER fail_insert")
+	require.Nil(t, err)
+	require.Nil(t, checkBackupWorkflow("test"))
+	bs, err = store.GetBackupSpec("test")
+	require.Nil(t, err)
+	assert.Nil(t, bs.RunningCreateWorkflowID)
+	assert.Equal(t, map[string]string{"data1": "COMPLETED"}, materializedStatuses(t, "test"))
+}
+
+func TestCheckBackupRemoveWorkflowRelaunch(t *testing.T) {
+	conductor, teardown := setupTest(t)
+	defer teardown()
+
+	createTestBackupSpec(t, BackupSpec{Name: "test"})
+	id := "m1"
+	size := 1.0
+	now := time.Now()
+	require.Nil(t, store.CreateMaterializedBackup(id, "test", &id, "COMPLETED", now, now, &size, "", nil, nil))
+	unknown := "unknown-workflow"
+	require.Nil(t, store.SetStatusMaterializedBackup(id, "deleting", &unknown))
+
+	//executor errors don't relaunch the workflow
+	conductor.Unavailable = true
+	mb, err := store.GetMaterializedBackup(id)
+	require.Nil(t, err)
+	assert.NotNil(t, checkBackupRemoveWorkflow(mb))
+	conductor.Unavailable = false
+	assert.Equal(t, 0, len(conductor.Workflows("remove_backup")))
+
+	//workflows unknown to the executor are relaunched and the new one is tracked
+	require.Nil(t, checkBackupRemoveWorkflow(mb))
+	removes := conductor.Workflows("remove_backup")
+	require.Equal(t, 1, len(removes))
+	mb, err = store.GetMaterializedBackup(id)
+	require.Nil(t, err)
+	assert.Equal(t, "deleting", mb.Status)
+	require.NotNil(t, mb.RunningDeleteWorkflowID)
+	assert.Equal(t, removes[0].WorkflowID, *mb.RunningDeleteWorkflowID)
+
+	require.Nil(t, conductor.Finish(removes[0].WorkflowID, backtortest.Completed("", 0)))
+	require.Nil(t, checkBackupRemoveWorkflow(mb))
+	assert.Equal(t, map[string]string{"m1": "deleted"}, materializedStatuses(t, "test"))
+}
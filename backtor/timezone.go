@@ -0,0 +1,105 @@
+package backtor
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+//specTimezone location of the spec's 'timezone'. nil if it is not set or invalid
+func specTimezone(bs BackupSpec) *time.Location {
+	if bs.Timezone == "" {
+		return nil
+	}
+	loc, err := time.LoadLocation(bs.Timezone)
+	if err != nil {
+		logrus.Warnf("Invalid timezone %s of backup spec %s. err=%s", bs.Timezone, bs.Name, err)
+		return nil
+	}
+	return loc
+}
+
+//scheduleLocation time zone of the cron schedules of a spec. Process local time if 'timezone' is not set
+func scheduleLocation(bs BackupSpec) *time.Location {
+	loc := specTimezone(bs)
+	if loc == nil {
+		return time.Local
+	}
+	return loc
+}
+
+//tagLocation time zone of the hour/day/week/month/year boundaries used when tagging. UTC if 'timezone' is not set
+func tagLocation(bs BackupSpec) *time.Location {
+	loc := specTimezone(bs)
+	if loc == nil {
+		return time.UTC
+	}
+	return loc
+}
+
+//checkTimezone checks that the spec's 'timezone' is a known IANA time zone name
+func checkTimezone(bs BackupSpec) error {
+	if bs.Timezone == "" {
+		return nil
+	}
+	_, err := time.LoadLocation(bs.Timezone)
+	if err != nil {
+		return fmt.Errorf("Invalid 'timezone'. Use an IANA name such as 'America/Sao_Paulo'. err=%s", err)
+	}
+	return nil
+}
+
+//apiLocation time zone used for rendering times of a backup spec in API responses. nil keeps times as stored
+func apiLocation(backupName string) *time.Location {
+	bs, err := store.GetBackupSpec(backupName)
+	if err != nil {
+		return nil
+	}
+	return specTimezone(bs)
+}
+
+func inLocation(t *time.Time, loc *time.Location) {
+	if t != nil && !t.IsZero() {
+		*t = t.In(loc)
+	}
+}
+
+func localizeBackupSpec(bs *BackupSpec) {
+	loc := specTimezone(*bs)
+	if loc == nil {
+		return
+	}
+	inLocation(&bs.LastUpdate, loc)
+	inLocation(bs.FromDate, loc)
+	inLocation(bs.ToDate, loc)
+	inLocation(bs.LastScheduledTime, loc)
+}
+
+func localizeMaterialized(mb *MaterializedBackup, loc *time.Location) {
+	if loc == nil {
+		return
+	}
+	inLocation(&mb.StartTime, loc)
+	inLocation(&mb.EndTime, loc)
+	inLocation(mb.VerifyTime, loc)
+	inLocation(mb.HoldTime, loc)
+	inLocation(mb.HoldUntil, loc)
+}
+
+func localizeRestore(r *Restore, loc *time.Location) {
+	if loc == nil {
+		return
+	}
+	inLocation(&r.StartTime, loc)
+	inLocation(r.EndTime, loc)
+}
+
+func localizeCatchup(c *Catchup, loc *time.Location) {
+	if loc == nil {
+		return
+	}
+	inLocation(&c.Time, loc)
+	inLocation(c.FirstMissed, loc)
+	inLocation(c.LastMissed, loc)
+}
@@ -5,9 +5,11 @@ go 1.12
 require (
 	github.com/gin-gonic/gin v1.4.0
 	github.com/itsjamie/gin-cors v0.0.0-20160420130702-97b4a9da7933
-	github.com/mattn/go-sqlite3 v1.10.0
+	github.com/lib/pq v1.3.0
+	github.com/mattn/go-sqlite3 v1.14.7
 	github.com/prometheus/client_golang v1.0.0
 	github.com/robfig/cron v1.2.0
 	github.com/sirupsen/logrus v1.4.2
 	github.com/stretchr/testify v1.3.0
+	gopkg.in/yaml.v2 v2.2.2
 )
@@ -6,5 +6,24 @@ echo "Starting backtor..."
 backtor \
     --conductor-api-url=$CONDUCTOR_API_URL \
     --data-dir="$DATA_DIR" \
+    --db-url="$DB_URL" \
+    --restore-workflow-name="$RESTORE_WORKFLOW_NAME" \
+    --verify-workflow-name="$VERIFY_WORKFLOW_NAME" \
+    --specs-dir="$SPECS_DIR" \
+    --node-id="$NODE_ID" \
+    --advertise-url="$ADVERTISE_URL" \
+    --lease-timeout="$LEASE_TIMEOUT" \
+    --callback-secret="$CALLBACK_SECRET" \
+    --reconcile-interval="$RECONCILE_INTERVAL" \
+    --reconcile-concurrency=$RECONCILE_CONCURRENCY \
+    --reconcile-batch-size=$RECONCILE_BATCH_SIZE \
+    --notify-webhook-url="$NOTIFY_WEBHOOK_URL" \
+    --notify-webhook-template="$NOTIFY_WEBHOOK_TEMPLATE" \
+    --notify-smtp-addr="$NOTIFY_SMTP_ADDR" \
+    --notify-smtp-user="$NOTIFY_SMTP_USER" \
+    --notify-smtp-password="$NOTIFY_SMTP_PASSWORD" \
+    --notify-email-from="$NOTIFY_EMAIL_FROM" \
+    --notify-email-to="$NOTIFY_EMAIL_TO" \
+    --notify-throttle="$NOTIFY_THROTTLE" \
     --log-level=$LOG_LEVEL
 